@@ -0,0 +1,100 @@
+package boltql
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+//
+// A WriteBatch collects Put and Delete operations on a table, that are applied in a single transaction by Commit
+// (so that the batch can be built incrementally, i.e. by different parts of the application).
+//
+// A WriteBatch should not be used concurrently
+//
+type WriteBatch struct {
+	t   *Table
+	ops []batchOp
+}
+
+//
+// a batch operation: a Put if index is empty, a Delete otherwise
+//
+type batchOp struct {
+	index string
+	rec   DataRecord
+}
+
+//
+// Return a new (empty) WriteBatch for the table
+//
+func (t *Table) NewBatch() *WriteBatch {
+	return &WriteBatch{t: t}
+}
+
+//
+// Add a record to the batch (see Table.Put)
+//
+func (wb *WriteBatch) Put(rec DataRecord) {
+	wb.ops = append(wb.ops, batchOp{rec: rec})
+}
+
+//
+// Add the deletion of the record with the specified key to the batch (see Table.Delete)
+//
+func (wb *WriteBatch) Delete(index string, key DataRecord) {
+	wb.ops = append(wb.ops, batchOp{index: index, rec: key})
+}
+
+//
+// Return the number of operations in the batch
+//
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+//
+// Apply the operations, in the order they were added, in a single transaction:
+// either all of them are applied or, if any of them fails, none is.
+//
+// After a successful Commit the batch is empty and can be reused
+//
+func (wb *WriteBatch) Commit() (err error) {
+	t := wb.t
+
+	defer t.wrapError("Commit", "", &err)
+
+	for _, op := range wb.ops {
+		if isNil(op.rec) {
+			return BAD_VALUES
+		}
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Batch")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, op := range wb.ops {
+			var err error
+
+			if op.index == "" {
+				_, err = t.put(tx, op.rec)
+			} else {
+				_, err = t.delete(tx, op.index, op.rec)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, len(wb.ops), err)
+
+	if err == nil {
+		wb.ops = nil
+	}
+
+	return err
+}
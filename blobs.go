@@ -0,0 +1,259 @@
+package boltql
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/gobs/typedbuffer"
+)
+
+//
+// The values of the external fields are stored in a nested bucket of the schema bucket,
+// keyed by the primary key of the record and the position of the field.
+//
+var blobName = []byte("_blob")
+
+//
+// the positions of the external fields are stored in the table metadata (as "_blob/<position>")
+//
+const blobMeta = "_blob/"
+
+func blobField(pos int) string {
+	return fmt.Sprintf("%v%v", blobMeta, pos)
+}
+
+//
+// the key of an external field value
+//
+func blobKey(id uint64, pos int) []byte {
+	k, _ := typedbuffer.Encode(uint64(pos))
+	return append(primaryKey(id), k...)
+}
+
+//
+// Store a field ([]byte or string) outside of the record, so that large values don't slow down the scans.
+//
+// The value is stored in a separate bucket, keyed by the primary key of the record, and the record
+// (in the primary storage and in the indices) only contains the length of the value.
+// The methods that return records (Get, GetBy, GetKey, GetViaIndex, GetNearest, First, Last, MinKey, MaxKey,
+// Scan, ScanProgress, Range, ScanFromToken, Take, GetAll, GetPrefix, ScanGrouped, ScanPrefixes, ModifiedSince,
+// Cursor.Record, Query and MergeScan) return the full value, while ScanFields and ScanFieldsReuse return the length
+// (ScanKeys never reads the values).
+//
+// External fields are only supported for tables with primary storage (i.e. with an AUTOINCREMENT field):
+// for the other tables the field is stored in the record as usual.
+//
+// Returns BAD_VALUES if the field is included in a covering index (see CreateCoveringIndex)
+//
+func (t *Table) SetExternalField(field uint) (err error) {
+	defer t.wrapError("SetExternalField", "", &err)
+
+	for _, info := range t.indices {
+		if !info.complete() && info.stores(uint64(field)) {
+			return BAD_VALUES
+		}
+	}
+
+	db := t.d.db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		return putMeta(b, blobField(int(field)), true)
+	})
+
+	if err == nil {
+		blobs := map[int]bool{int(field): true}
+
+		for pos := range t.blobs {
+			blobs[pos] = true
+		}
+
+		t.blobs = blobs
+	}
+
+	return err
+}
+
+//
+// load the positions of the external fields from the table metadata
+//
+func (t *Table) loadBlobFields(b *bolt.Bucket) {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return
+	}
+
+	prefix := []byte(blobMeta)
+
+	c := m.Cursor()
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if pos, err := strconv.Atoi(string(k[len(prefix):])); err == nil {
+			if t.blobs == nil {
+				t.blobs = map[int]bool{}
+			}
+
+			t.blobs[pos] = true
+		}
+	}
+}
+
+//
+// move the values of the external fields to the blob bucket, replacing them (in place) with their length.
+//
+// Fields that already contain a length (i.e. records read by a scan and written back) are not modified
+//
+func (t *Table) storeBlobs(b *bolt.Bucket, id uint64, fields []interface{}) error {
+	if len(t.blobs) == 0 {
+		return nil
+	}
+
+	bb, err := b.CreateBucketIfNotExists(blobName)
+	if err != nil {
+		return err
+	}
+
+	for pos := range t.blobs {
+		if pos >= len(fields) {
+			continue
+		}
+
+		var v []byte
+
+		switch f := fields[pos].(type) {
+		case []byte:
+			v = f
+		case string:
+			v = []byte(f)
+		case nil:
+			if err := bb.Delete(blobKey(id, pos)); err != nil {
+				return err
+			}
+
+			continue
+		default:
+			continue
+		}
+
+		sv, err := t.sealValue(v)
+		if err != nil {
+			return err
+		}
+
+		if err := bb.Put(blobKey(id, pos), sv); err != nil {
+			return err
+		}
+
+		fields[pos] = int64(len(v))
+	}
+
+	return nil
+}
+
+//
+// decode an index entry (or a primary record) into the list of record fields, as decode,
+// loading the values of the external fields
+//
+func (t *Table) decodeRecord(tx *bolt.Tx, info indexinfo, k, v []byte) ([]interface{}, error) {
+	fields, err := t.decode(info, k, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.loadBlobs(tx, fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+//
+// replace (in place) the lengths of the external fields with their values
+//
+func (t *Table) loadBlobs(tx *bolt.Tx, fields []interface{}) error {
+	if len(t.blobs) == 0 {
+		return nil
+	}
+
+	b := tx.Bucket(schema(t.name))
+	if b == nil {
+		return NO_TABLE
+	}
+
+	bb := b.Bucket(blobName)
+	if bb == nil {
+		return nil
+	}
+
+	primary, err := primaryIndex(b)
+	if primary == nil || err != nil {
+		return err
+	}
+
+	pos := primary.iplist[0].field
+	if pos >= uint(len(fields)) {
+		return nil
+	}
+
+	id, ok := toUint64(fields[pos])
+	if !ok {
+		return nil
+	}
+
+	for pos := range t.blobs {
+		if pos >= len(fields) {
+			continue
+		}
+
+		if _, ok := fields[pos].(int64); !ok {
+			continue
+		}
+
+		v := bb.Get(blobKey(id, pos))
+		if v == nil {
+			continue
+		}
+
+		v, _, err := t.openValue(v)
+		if err != nil {
+			return err
+		}
+
+		fields[pos] = append([]byte{}, v...)
+	}
+
+	return nil
+}
+
+//
+// remove the values of the external fields of a record (if any)
+//
+func deleteBlobs(b *bolt.Bucket, id uint64) error {
+	bb := b.Bucket(blobName)
+	if bb == nil {
+		return nil
+	}
+
+	prefix := primaryKey(id)
+
+	var keys [][]byte
+
+	c := bb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err := bb.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
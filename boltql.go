@@ -2,12 +2,25 @@ package boltql
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/gobs/typedbuffer"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -18,649 +31,5970 @@ var (
 	SCHEMA_CORRUPTED = errors.New("schema corrupted")
 	NO_KEY           = errors.New("key not found")
 	BAD_VALUES       = errors.New("bad values")
+	NESTED_KEY       = errors.New("nested values (lists, maps or structs) are not supported in keys")
+	NO_PREDICATE     = errors.New("partial index predicate not set")
+	ENCRYPTED        = errors.New("encrypted value (the database was not opened with OpenEncrypted)")
+	NO_COUNTER       = errors.New("no counter fields for index")
+	DUPLICATE_KEY    = errors.New("duplicate key")
+	NO_CHANGELOG     = errors.New("change log not enabled")
+	LOG_TRUNCATED    = errors.New("change log truncated")
+	VALUE_TOO_LARGE  = errors.New("value too large")
+	ALREADY_OPEN     = errors.New("database already open")
 
 	// this is just a marker for auto-increment fields
 	AUTOINCREMENT = &struct{}{}
 )
 
 //
-// A DataStore is the main interface to a BoltDB database
+// AutoIncrement is the typed form of the AUTOINCREMENT marker, for records that are serialized and replayed
+// (i.e. exported as JSON and imported later), where the identity of the AUTOINCREMENT pointer is lost.
 //
-type DataStore bolt.DB
-
-//
-// A DataRecord is the interface for elements that can be stored in a table.
-// A DataRecord needs to implement two methods:
-//
-// ToFieldList() should convert the record fields into a list of values, preserving their order
-// (i.e. the same fields should always be in the same position)
-//
-// FromFieldList() should fill the record with values from the input list. The order of values
-// is the same as what was returned from ToFieldList()
+// It's encoded as the text "$autoincrement" (see AutoIncrementText) and Put recognizes both AutoIncrement{}
+// (or a pointer to it) and AUTOINCREMENT.
 //
-type DataRecord interface {
-	ToFieldList() []interface{}
-	FromFieldList([]interface{})
+type AutoIncrement struct{}
+
+// the serialized form of AutoIncrement
+const AutoIncrementText = "$autoincrement"
+
+func (AutoIncrement) String() string {
+	return AutoIncrementText
 }
 
-//
-// Open the database (create if it doesn't exist)
-//
-func Open(dbfile string) (*DataStore, error) {
-	db, err := bolt.Open(dbfile, 0666, nil)
-	if err != nil {
-		return nil, err
+func (AutoIncrement) MarshalText() ([]byte, error) {
+	return []byte(AutoIncrementText), nil
+}
+
+func (*AutoIncrement) UnmarshalText(text []byte) error {
+	if string(text) != AutoIncrementText {
+		return BAD_VALUES
 	}
 
-	return (*DataStore)(db), nil
+	return nil
 }
 
 //
-// Close the database
+// return true if the field value is an autoincrement marker (AUTOINCREMENT, AutoIncrement or *AutoIncrement)
 //
-func (d *DataStore) Close() error {
-	db := (*bolt.DB)(d)
-	return db.Close()
-}
+func isAutoIncrement(v interface{}) bool {
+	switch v.(type) {
+	case AutoIncrement, *AutoIncrement:
+		return true
+	}
 
-func (d *DataStore) SetBulk(b bool) {
-	db := (*bolt.DB)(d)
-	db.NoSync = b
+	return v == AUTOINCREMENT
 }
 
-func indices(name string) []byte {
-	return []byte(name + "_idx")
-}
+//
+// returned from a transaction function to roll back a writable transaction (never returned to the caller)
+//
+var errRollback = errors.New("rollback")
 
-func schema(name string) []byte {
-	return []byte(name)
+//
+// A DataStore is the main interface to a BoltDB database.
+//
+// Each Open returns a new DataStore (a handle), but the handles of the same database share the database
+// and its settings (i.e. the cache, the metrics and the sync policy)
+//
+type DataStore struct {
+	*store
+
+	released bool // Close was called on this handle (guarded by openLock)
 }
 
 //
-// A Table is a container for the table name and indices
+// the state of an open database, shared by all its DataStore handles
 //
-type Table struct {
-	name    string
-	indices map[string]indexinfo
+type store struct {
+	db *bolt.DB
 
-	d *DataStore
+	lock   sync.Mutex
+	closed bool
+	temp   bool
+	aead   cipher.AEAD
+
+	metricsLock sync.RWMutex // guards metrics
+	metrics     Metrics
+
+	cacheLock sync.RWMutex // guards cache
+	cache     *cache
+
+	traceLock sync.RWMutex // guards tracer
+	tracer    trace.Tracer
+
+	path   string // the key in the registry of open databases
+	refs   int    // the number of handles not yet closed (guarded by openLock)
+	shared bool   // the database can be opened again in the process (see openRegistered)
+
+	syncLock   sync.Mutex // guards syncPolicy
+	syncPolicy SyncPolicy
+	writes     int64  // the changes since the last sync, for SyncEveryN (atomic)
+	syncs      uint64 // the number of syncs done for SyncEveryN (atomic)
 }
 
 //
-// Implement the Stringer interface
+// The registry of the open databases, by absolute path:
+// bolt locks the file exclusively, so opening it again in the same process would block forever
 //
-func (t *Table) String() string {
-	return fmt.Sprintf("Table{name: %q, indices: %v}", t.name, t.indices)
-}
+var (
+	openLock   sync.Mutex
+	openStores = map[string]*store{}
+)
 
-type indexinfo struct {
-	nilFirst bool
-	iplist   []indexpos
-}
+//
+// open a database with the open function, registering it by path. If the database is already open in the process,
+// a new handle for it is returned if both opens are shared and ALREADY_OPEN otherwise
+//
+func openRegistered(dbfile string, shared bool, open func() (*store, error)) (*DataStore, error) {
+	path, err := filepath.Abs(dbfile)
+	if err != nil {
+		return nil, err
+	}
 
-type indexpos struct {
-	field uint
-	pos   uint
-}
+	openLock.Lock()
+	defer openLock.Unlock()
 
-type iplist []indexpos
+	if s, ok := openStores[path]; ok {
+		if !shared || !s.shared {
+			return nil, ALREADY_OPEN
+		}
 
-func makeIndexPos(fields []uint64) iplist {
-	ip := make(iplist, len(fields))
+		s.refs++
+		return &DataStore{store: s}, nil
+	}
 
-	for i, f := range fields {
-		ip[i].field = uint(f)
-		ip[i].pos = uint(i)
+	s, err := open()
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Sort(ip)
-	return ip
-}
+	s.path, s.refs, s.shared = path, 1, shared
 
-func (ip iplist) Len() int {
-	return len(ip)
+	openStores[path] = s
+	return &DataStore{store: s}, nil
 }
 
-func (ip iplist) Less(i, j int) bool {
-	return ip[i].field < ip[j].field
+//
+// A DataRecord is the interface for elements that can be stored in a table.
+// A DataRecord needs to implement two methods:
+//
+// ToFieldList() should convert the record fields into a list of values, preserving their order
+// (i.e. the same fields should always be in the same position)
+//
+// FromFieldList() should fill the record with values from the input list. The order of values
+// is the same as what was returned from ToFieldList()
+//
+type DataRecord interface {
+	ToFieldList() []interface{}
+	FromFieldList([]interface{})
 }
 
-func (ip iplist) Swap(i, j int) {
-	ip[i], ip[j] = ip[j], ip[i]
+//
+// Open the database (create if it doesn't exist)
+//
+// If the database is already open in the process (i.e. by another package), Open returns a new DataStore
+// that shares the open database, that is only closed when all the DataStores returned by Open are closed.
+// If the database was opened with OpenEncrypted or OpenMemory, Open returns ALREADY_OPEN.
+//
+func Open(dbfile string) (*DataStore, error) {
+	return OpenWith(dbfile, nil)
 }
 
 //
-// Create table if doesn't exist
+// Open the database (create if it doesn't exist) with the specified bolt options (nil for the default options).
 //
-func (d *DataStore) CreateTable(name string) (*Table, error) {
-	db := (*bolt.DB)(d)
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket(schema(name))
+// The options are passed as they are to bolt.Open (i.e. Timeout, ReadOnly, MmapFlags or InitialMmapSize).
+//
+// As for Open, if the database is already open in the process a DataStore sharing it is returned
+// (and the options are ignored).
+//
+func OpenWith(dbfile string, opts *bolt.Options) (*DataStore, error) {
+	return openRegistered(dbfile, true, func() (*store, error) {
+		db, err := bolt.Open(dbfile, 0666, opts)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		return nil
+		return &store{db: db}, nil
 	})
-
-	if err == nil {
-		return &Table{name: name, indices: map[string]indexinfo{}, d: d}, nil
-	} else {
-		return nil, err
-	}
 }
 
 //
-// Get existing Table
+// release the reference to the database of this handle.
 //
-func (d *DataStore) GetTable(name string) (*Table, error) {
-	db := (*bolt.DB)(d)
-	table := Table{name: name, indices: map[string]indexinfo{}, d: d}
+// Returns true if the database is still referenced (or the handle was already released) and should not be closed
+//
+func (d *DataStore) release() bool {
+	openLock.Lock()
+	defer openLock.Unlock()
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(schema(name))
-		if b == nil {
-			return NO_TABLE
-		}
+	if d.released {
+		return true
+	}
 
-		b.ForEach(func(k, v []byte) error {
-			name := string(k)
+	d.released = true
 
-			nilFirst, rest, err := typedbuffer.Decode(v)
-			if err != nil {
-				return SCHEMA_CORRUPTED
-			}
-			fields, err := typedbuffer.DecodeUintArray(rest)
-			if err != nil {
-				return SCHEMA_CORRUPTED
-			}
+	if d.refs > 1 {
+		d.refs--
+		return true
+	}
 
-			table.indices[name] = indexinfo{
-				nilFirst: nilFirst.(bool),
-				iplist:   makeIndexPos(fields),
-			}
+	d.refs = 0
 
-			return nil
-		})
+	if openStores[d.path] == d.store {
+		delete(openStores, d.path)
+	}
 
-		return nil
-	})
+	return false
+}
 
-	if err == nil {
-		return &table, nil
-	} else {
-		return nil, err
+//
+// Open the database (create if it doesn't exist), with an initial memory map of initialSizeMB megabytes.
+//
+// bolt remaps the whole file every time it grows beyond the mapped size, and a remap blocks all the
+// transactions (readers included) until it completes. For large databases, mapping a size close to the
+// expected size of the file from the start avoids most of the remaps.
+//
+// The mapped size is virtual memory, not allocated memory, and the file itself doesn't grow until it's
+// needed, but on 32 bit systems the address space is limited, so the initial size should be kept small.
+//
+func OpenLarge(dbfile string, initialSizeMB int) (*DataStore, error) {
+	if initialSizeMB < 0 {
+		return nil, BAD_VALUES
 	}
+
+	return OpenWith(dbfile, &bolt.Options{InitialMmapSize: initialSizeMB << 20})
 }
 
 //
-// Create an index given the name (index) and a list of field positions
-// used to create a composite key.
+// Open the database (create if it doesn't exist), encrypting the record values with AES-GCM.
 //
-// nilFirst specifies if nil values should sort first (lowest possible value) or last (highest possible value)
+// The key should be 16, 24 or 32 bytes long (to select AES-128, AES-192 or AES-256).
 //
-// The field position should corrispond to the entries in DataRecord ToFieldList() and FromFieldList()
+// Only the values are encrypted: the keys are stored in plain text, so that the indices still sort correctly.
+// Records written without encryption can still be read, and reading encrypted records from a database
+// opened without encryption returns ENCRYPTED.
+//
+// The DataStore is not shared (the encryption is a property of the DataStore): if the database is already open
+// in the process, OpenEncrypted returns ALREADY_OPEN (and so does Open, while the database is open with OpenEncrypted).
 //
-func (t *Table) CreateIndex(index string, nilFirst bool, fields ...uint64) error {
-	db := (*bolt.DB)(t.d)
+func OpenEncrypted(dbfile string, key []byte) (*DataStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(schema(t.name))
-		if b == nil {
-			return NO_TABLE
-		}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
 
-		b1, err := typedbuffer.Encode(nilFirst)
-		if err != nil {
-			return BAD_VALUES
-		}
-		b2, err := typedbuffer.Encode(fields)
+	return openRegistered(dbfile, false, func() (*store, error) {
+		db, err := bolt.Open(dbfile, 0666, nil)
 		if err != nil {
-			return BAD_VALUES
+			return nil, err
 		}
 
-		enc := append(b1, b2...)
-		if err := b.Put([]byte(index), enc); err != nil {
-			return err
-		}
+		return &store{db: db, aead: aead}, nil
+	})
+}
 
-		if _, err := tx.CreateBucket(indices(index)); err != nil {
-			return err
+//
+// Open a temporary database, useful for testing.
+//
+// The database is backed by a new file in the system temporary directory, that is never synced to disk (NoSync)
+// and is removed when the DataStore is closed.
+//
+func OpenMemory() (*DataStore, error) {
+	f, err := os.CreateTemp("", "boltql-*.db")
+	if err != nil {
+		return nil, err
+	}
+
+	dbfile := f.Name()
+	f.Close()
+
+	d, err := openRegistered(dbfile, false, func() (*store, error) {
+		db, err := bolt.Open(dbfile, 0600, nil)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil
+		db.NoSync = true
+		return &store{db: db, temp: true}, nil
 	})
 
-	if err == nil {
-		t.indices[index] = indexinfo{
-			nilFirst: nilFirst,
-			iplist:   makeIndexPos(fields),
-		}
+	if err != nil {
+		os.Remove(dbfile)
+		return nil, err
 	}
 
-	return err
+	return d, nil
 }
 
 //
-// marshal an array of fields into a key and value pair of encoded values
+// Close the database.
 //
-// the key is a composed key of the fields described in info.iplist (field number and order)
-// the value is a collection of the remaning fields
+// It's safe to call Close multiple times (only the first call closes the database, the following ones return nil).
+// For a database opened more than once by Open, the database is closed when all the DataStores are closed
+// (closing the same DataStore again doesn't affect the others).
 //
-func (info indexinfo) marshalKeyValue(fields []interface{}) (key, value []byte, err error) {
-	if len(info.iplist) == 0 {
-		return
+func (d *DataStore) Close() error {
+	if d.release() {
+		return nil
 	}
 
-	vkey := make([]interface{}, len(info.iplist))
-	vval := make([]interface{}, 0)
-
-	kk, lk := 0, len(info.iplist)
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	for fi, fv := range fields {
-		if kk < lk && uint(fi) == info.iplist[kk].field {
-			vkey[info.iplist[kk].pos] = fv
-			kk += 1
-		} else {
-			vval = append(vval, fv)
-		}
+	if d.closed {
+		return nil
 	}
 
-	if len(vkey) > 0 {
-		if key, err = typedbuffer.EncodeNils(info.nilFirst, vkey...); err != nil {
-			return
-		}
-	}
+	d.closed = true
 
-	if len(vval) > 0 {
-		value, err = typedbuffer.EncodeNils(info.nilFirst, vval...)
+	dbfile := d.db.Path()
+
+	err := d.db.Close()
+	if d.temp {
+		if rerr := os.Remove(dbfile); err == nil {
+			err = rerr
+		}
 	}
 
-	return
+	return err
 }
 
 //
-// unmarshal key, value into a list of decoded fields
+// Return the underlying bolt database (same as Bolt)
 //
-func (info indexinfo) unmarshalKeyValue(k, v []byte) ([]interface{}, error) {
-	vkey, err := typedbuffer.DecodeAll(false, k)
-	if err != nil {
-		return nil, err
-	}
-
-	vval, err := typedbuffer.DecodeAll(false, v)
-	if err != nil {
-		return nil, err
-	}
-
-	lkey := len(vkey)
-	lval := len(vval)
-
-	fields := []interface{}{}
+func (d *DataStore) DB() *bolt.DB {
+	return d.db
+}
 
-	var ival interface{}
+//
+// Return the underlying bolt database, for operations not supported by boltql
+// (i.e. custom buckets or direct cursor access).
+//
+// The bolt database is owned by the DataStore: callers must not close it directly (use DataStore.Close)
+// and should not modify the buckets used by boltql tables and indices.
+//
+func (d *DataStore) Bolt() *bolt.DB {
+	return d.db
+}
 
-	kk, lk := 0, len(info.iplist)
+//
+// Return the path of the database file (as passed to Open)
+//
+func (d *DataStore) Path() string {
+	db := d.db
+	return db.Path()
+}
 
-	for i := 0; i < lkey+lval; i++ {
-		if kk < lk && uint(i) == info.iplist[kk].field {
-			ival = vkey[info.iplist[kk].pos]
-			kk += 1
-		} else {
-			ival = vval[0]
-			vval = vval[1:]
-		}
+//
+// Return the size of the database file, in bytes.
+//
+// bolt grows the file in large steps (and never shrinks it), so the size is only a coarse measure of the data size
+//
+func (d *DataStore) FileSize() (int64, error) {
+	db := d.db
 
-		fields = append(fields, ival)
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return 0, err
 	}
 
-	return fields, nil
+	return info.Size(), nil
 }
 
 //
-// Add a record to the table, updating all indices.
+// Enable or disable bulk mode. In bulk mode the database is not synced to disk after
+// every transaction (NoSync), making writes faster but less durable.
+//
+// Note that SetBulk(false) re-enables syncing for the following transactions but
+// doesn't itself flush what was written in bulk mode: call Sync() for that.
+//
+func (d *DataStore) SetBulk(b bool) {
+	if b {
+		d.SetSyncPolicy(SyncPolicy{Mode: SyncNever})
+	} else {
+		d.SetSyncPolicy(SyncPolicy{Mode: SyncAlways})
+	}
+}
+
+//
+// SyncMode is the mode of a SyncPolicy
+//
+type SyncMode int
+
+const (
+	SyncAlways SyncMode = iota // sync after every transaction (the default)
+	SyncNever                  // never sync (as in bulk mode): call Sync to flush
+	SyncEveryN                 // sync after every N changed records
+)
+
+//
+// A SyncPolicy specifies when the database is synced to disk (see SetSyncPolicy).
+// N is the number of changed records between syncs, for SyncEveryN
+//
+type SyncPolicy struct {
+	Mode SyncMode
+	N    int
+}
+
+//
+// Set when the database is synced to disk, trading durability for write throughput:
+// with SyncEveryN, a crash can lose the changes of the transactions committed after the last sync
+// (up to N changed records), but the database is never corrupted.
+//
+// With SyncEveryN the records are counted when the transactions are committed and the sync is done
+// by the transaction that reaches N. Returns BAD_VALUES for an unknown mode or, for SyncEveryN, if N < 1
+//
+// The policy is changed in a write transaction (so it waits for the running one to commit)
+// and it should not be called from within a transaction.
+//
+func (d *DataStore) SetSyncPolicy(p SyncPolicy) error {
+	db := d.db
+
+	switch p.Mode {
+	case SyncAlways, SyncNever:
+	case SyncEveryN:
+		if p.N < 1 {
+			return BAD_VALUES
+		}
+	default:
+		return BAD_VALUES
+	}
+
+	// bolt reads NoSync when a write transaction is committed,
+	// so it's only changed while holding the write lock
+	set := func(tx *bolt.Tx) error {
+		d.syncLock.Lock()
+		d.syncPolicy = p
+		d.syncLock.Unlock()
+
+		atomic.StoreInt64(&d.writes, 0)
+
+		db.NoSync = p.Mode != SyncAlways
+		return nil
+	}
+
+	if db.IsReadOnly() {
+		return set(nil)
+	}
+
+	return db.Update(set)
+}
+
+//
+// return the current sync policy
+//
+func (d *DataStore) policy() SyncPolicy {
+	d.syncLock.Lock()
+	defer d.syncLock.Unlock()
+
+	return d.syncPolicy
+}
+
+//
+// count the records changed by a committed transaction and sync the database every N records (for SyncEveryN)
+//
+func (d *DataStore) countWrites(p SyncPolicy, n int) {
+	if p.Mode != SyncEveryN {
+		return
+	}
+
+	w := atomic.AddInt64(&d.writes, int64(n))
+	if w < int64(p.N) {
+		return
+	}
+
+	// only one of the concurrent transactions that reached N resets the counter (and syncs),
+	// the writes counted after w are kept for the next sync
+	if !atomic.CompareAndSwapInt64(&d.writes, w, 0) {
+		return
+	}
+
+	if err := d.db.Sync(); err == nil {
+		atomic.AddUint64(&d.syncs, 1)
+	}
+}
+
+//
+// Force a sync of the database to disk (useful after a bulk load)
+//
+func (d *DataStore) Sync() error {
+	db := d.db
+	return db.Sync()
+}
+
+func indices(name string) []byte {
+	return []byte(name + "_idx")
+}
+
+//
+// index buckets created for a copy of a table are prefixed with the table name
+// (so that they don't conflict with the index buckets of the original table)
+//
+func tableIndices(table, name string) []byte {
+	return []byte(table + "." + name + "_idx")
+}
+
+func schema(name string) []byte {
+	return []byte(name)
+}
+
+//
+// the table metadata (index options, etc.) is stored in a nested bucket of the schema bucket,
+// with this name (that can't be used as an index name)
+//
+var metaName = []byte("_meta")
+
+//
+// the metadata key for an index option
+//
+func indexOption(index, option string) string {
+	return index + "/" + option
+}
+
+//
+// store a metadata value in the table metadata bucket
+//
+func putMeta(b *bolt.Bucket, key string, value interface{}) error {
+	m, err := b.CreateBucketIfNotExists(metaName)
+	if err != nil {
+		return err
+	}
+
+	enc, err := typedbuffer.Encode(value)
+	if err != nil {
+		return BAD_VALUES
+	}
+
+	return m.Put([]byte(key), enc)
+}
+
+//
+// get a metadata value from the table metadata bucket (nil if not found)
+//
+func getMeta(b *bolt.Bucket, key string) interface{} {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return nil
+	}
+
+	v := m.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+
+	value, _, err := typedbuffer.Decode(v)
+	if err != nil {
+		return nil
+	}
+
+	return value
+}
+
+//
+// Tables with an AUTOINCREMENT field also store the full records in a nested bucket (primary storage),
+// keyed by the value of the first AUTOINCREMENT field (the primary key).
+//
+// The position of the primary key field is recorded in the table metadata
+// the first time a record with an AUTOINCREMENT field is added, when the existing records are copied
+// to the primary storage (see enablePrimary).
+//
+var dataName = []byte("_data")
+
+//
+// the encoded primary key
+//
+func primaryKey(id uint64) []byte {
+	k, _ := typedbuffer.EncodeNils(true, id)
+	return k
+}
+
+//
+// return the primary storage "index" (the primary key field) or nil if the table has no primary storage
+//
+func primaryIndex(b *bolt.Bucket) (*indexinfo, error) {
+	pos, ok := getMeta(b, "primary").(uint64)
+	if !ok {
+		return nil, nil
+	}
+
+	return &indexinfo{nilFirst: true, iplist: makeIndexPos([]uint64{pos})}, nil
+}
+
+//
+// return the primary storage "index" as primaryIndex but, if the table doesn't have a primary key yet
+// and auto is a valid field position, enable the primary storage with auto as the primary key.
+//
+// The records already in the table (written before the primary storage was enabled) are copied to the primary storage
+// from the indices, so that it always contains all the records. If some of them don't have a valid primary key
+// the primary storage can't be complete: it's not enabled (and this is recorded, so it's not tried again)
+//
+func (t *Table) enablePrimary(b *bolt.Bucket, auto int) (*indexinfo, error) {
+	primary, err := primaryIndex(b)
+	if primary != nil || err != nil || auto < 0 {
+		return primary, err
+	}
+
+	if getMeta(b, noPrimaryMeta) == true {
+		return nil, nil
+	}
+
+	primary = &indexinfo{nilFirst: true, iplist: makeIndexPos([]uint64{uint64(auto)})}
+
+	ok, err := t.fillPrimary(b, *primary)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, putMeta(b, noPrimaryMeta, true)
+	}
+
+	if err := putMeta(b, "primary", uint64(auto)); err != nil {
+		return nil, err
+	}
+
+	return primary, nil
+}
+
+//
+// recorded in the table metadata when the primary storage can't be enabled (see enablePrimary)
+//
+const noPrimaryMeta = "noprimary"
+
+//
+// copy the records in the indices to the primary storage.
+//
+// The records are read from all the full (non-partial) indices and they are only copied if every index
+// contains the same records, with the same values. Returns false (and leaves the primary storage empty)
+// if the indices don't agree (e.g. an index with stale entries, as left by older versions)
+// or if a record doesn't have a valid primary key
+//
+func (t *Table) fillPrimary(b *bolt.Bucket, primary indexinfo) (bool, error) {
+	tx := b.Tx()
+
+	type entry struct {
+		cmp   []byte // the record fields as compared across indices
+		value []byte // the encoded record, for the primary storage
+		exact bool   // false if value was read from a numeric index (where uint64 keys are stored as int64)
+	}
+
+	var records map[string]entry
+
+	for _, info := range t.indices {
+		ib := tx.Bucket(info.bucket)
+		if ib == nil {
+			continue
+		}
+
+		if info.partial || !info.complete() {
+			// a partial index can't tell if the other records are missing
+			// and a covering index doesn't contain the full records
+			continue
+		}
+
+		found := map[string]entry{}
+
+		c := ib.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			fields, err := t.decode(info, k, v)
+			if err != nil {
+				return false, err
+			}
+
+			if _, err := primary.primaryID(fields); err != nil {
+				return false, nil
+			}
+
+			pk, pv, err := primary.marshalKeyValue(fields)
+			if err != nil {
+				return false, err
+			}
+
+			cmp := make([]interface{}, len(fields))
+			for i, f := range fields {
+				cmp[i] = numericKey(f)
+			}
+
+			cv, err := typedbuffer.EncodeNils(true, cmp...)
+			if err != nil {
+				return false, err
+			}
+
+			if prev, ok := found[string(pk)]; ok && !bytes.Equal(prev.cmp, cv) {
+				return false, nil
+			}
+
+			found[string(pk)] = entry{cmp: cv, value: pv, exact: !info.numeric}
+		}
+
+		if records == nil {
+			records = found
+			continue
+		}
+
+		if len(found) != len(records) {
+			return false, nil
+		}
+
+		for pk, e := range found {
+			prev, ok := records[pk]
+			if !ok || !bytes.Equal(prev.cmp, e.cmp) {
+				return false, nil
+			}
+
+			if e.exact && !prev.exact {
+				records[pk] = e
+			}
+		}
+	}
+
+	if records == nil {
+		// only partial indices: the primary storage can only be complete if the table is empty
+		for _, info := range t.indices {
+			if ib := tx.Bucket(info.bucket); ib != nil {
+				if k, _ := ib.Cursor().First(); k != nil {
+					return false, nil
+				}
+			}
+		}
+
+		return true, nil
+	}
+
+	if len(records) == 0 {
+		return true, nil
+	}
+
+	data, err := b.CreateBucketIfNotExists(dataName)
+	if err != nil {
+		return false, err
+	}
+
+	for pk, e := range records {
+		pv, err := t.sealValue(e.value)
+		if err != nil {
+			return false, err
+		}
+
+		if err := data.Put([]byte(pk), pv); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+//
+// convert a non-negative integer value to uint64
+//
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := normalizeKey(v).(type) {
+	case uint64:
+		return n, true
+	case int64:
+		if n >= 0 {
+			return uint64(n), true
+		}
+	}
+
+	return 0, false
+}
+
+//
+// A Table is a container for the table name and indices
+//
+type Table struct {
+	name    string
+	indices map[string]indexinfo
+	version int
+	migrate func(old int, fields []interface{}) []interface{}
+	times   atomic.Value   // positions of the time.Time fields (map[int]bool)
+	blobs   map[int]bool   // positions of the external fields (see SetExternalField)
+	fields  map[string]int // positions of the named fields (see SetFields)
+	strict  bool           // validate the records before writing them (see Strict)
+
+	compression Compression
+	maxValue    int // the maximum size of the encoded values (0 for no limit)
+
+	d *DataStore
+}
+
+//
+// Implement the Stringer interface
+//
+func (t *Table) String() string {
+	return fmt.Sprintf("Table{name: %q, indices: %v}", t.name, t.indices)
+}
+
+type indexinfo struct {
+	nilFirst bool
+	numeric  bool
+	partial  bool
+	pred     func(DataRecord) bool
+	iplist   []indexpos
+	bucket   []byte
+	counter  []uint64 // the group fields for GroupCount (nil if not set)
+	desc     []bool   // the key fields (by key position) sorted in descending order (nil if all ascending)
+	floats   bool     // the float key fields are stored in sort order (see floatKey)
+	hash     bool     // the keys are hashes of the key fields (see CreateHashIndex)
+	include  []uint64 // the non-key fields stored in the values (nil for all, see CreateCoveringIndex)
+	distinct []uint64 // the trailing key fields that keep apart the records with the same key (nil if unique, see SetIndexUnique)
+}
+
+//
+// return true if the index entries contain the full records
+// (the entries of covering indices only contain the key fields and the included fields)
+//
+func (info indexinfo) complete() bool {
+	return info.include == nil
+}
+
+//
+// return true if the value of a non-key field is stored in the index entries
+//
+func (info indexinfo) stores(field uint64) bool {
+	if info.include == nil {
+		return true
+	}
+
+	for _, pos := range info.include {
+		if pos == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// store the index options in the table metadata
+//
+func (info indexinfo) saveOptions(b *bolt.Bucket, index string) error {
+	if info.numeric {
+		if err := putMeta(b, indexOption(index, "numeric"), true); err != nil {
+			return err
+		}
+	}
+
+	if info.partial {
+		if err := putMeta(b, indexOption(index, "partial"), true); err != nil {
+			return err
+		}
+	}
+
+	if info.floats {
+		if err := putMeta(b, indexOption(index, "floats"), true); err != nil {
+			return err
+		}
+	}
+
+	if info.hash {
+		if err := putMeta(b, indexOption(index, "hash"), true); err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(info.bucket, indices(index)) {
+		if err := putMeta(b, indexOption(index, "bucket"), info.bucket); err != nil {
+			return err
+		}
+	}
+
+	if info.include != nil {
+		if err := putMeta(b, indexOption(index, "include"), info.include); err != nil {
+			return err
+		}
+	}
+
+	if info.distinct != nil {
+		if err := putMeta(b, indexOption(index, "distinct"), info.distinct); err != nil {
+			return err
+		}
+	}
+
+	if info.counter != nil {
+		if err := putMeta(b, indexOption(index, "counter"), info.counter); err != nil {
+			return err
+		}
+	}
+
+	if info.desc != nil {
+		var desc []uint64
+
+		for pos, d := range info.desc {
+			if d {
+				desc = append(desc, uint64(pos))
+			}
+		}
+
+		if err := putMeta(b, indexOption(index, "desc"), desc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// load the index options from the table metadata
+//
+func (info *indexinfo) loadOptions(b *bolt.Bucket, index string) {
+	info.numeric = getMeta(b, indexOption(index, "numeric")) == true
+	info.partial = getMeta(b, indexOption(index, "partial")) == true
+	info.floats = getMeta(b, indexOption(index, "floats")) == true
+	info.hash = getMeta(b, indexOption(index, "hash")) == true
+
+	if bucket, ok := getMeta(b, indexOption(index, "bucket")).([]byte); ok {
+		info.bucket = bucket
+	} else {
+		info.bucket = indices(index)
+	}
+
+	if counter, ok := getMeta(b, indexOption(index, "counter")).([]uint64); ok {
+		info.counter = counter
+	}
+
+	if include, ok := getMeta(b, indexOption(index, "include")).([]uint64); ok {
+		info.include = include
+	}
+
+	if distinct, ok := getMeta(b, indexOption(index, "distinct")).([]uint64); ok {
+		info.distinct = distinct
+	}
+
+	if desc, ok := getMeta(b, indexOption(index, "desc")).([]uint64); ok && len(desc) > 0 {
+		info.desc = make([]bool, desc[len(desc)-1]+1)
+
+		for _, pos := range desc {
+			info.desc[pos] = true
+		}
+	}
+}
+
+//
+// return the bucket for the index (nil if the index doesn't exist)
+//
+func (t *Table) indexBucket(tx *bolt.Tx, index string) *bolt.Bucket {
+	info, ok := t.indices[index]
+	if !ok {
+		return nil
+	}
+
+	return tx.Bucket(info.bucket)
+}
+
+type indexpos struct {
+	field uint
+	pos   uint
+}
+
+type iplist []indexpos
+
+func makeIndexPos(fields []uint64) iplist {
+	ip := make(iplist, len(fields))
+
+	for i, f := range fields {
+		ip[i].field = uint(f)
+		ip[i].pos = uint(i)
+	}
+
+	sort.Sort(ip)
+	return ip
+}
+
+func (ip iplist) Len() int {
+	return len(ip)
+}
+
+func (ip iplist) Less(i, j int) bool {
+	return ip[i].field < ip[j].field
+}
+
+func (ip iplist) Swap(i, j int) {
+	ip[i], ip[j] = ip[j], ip[i]
+}
+
+//
+// Create table if doesn't exist
+//
+func (d *DataStore) CreateTable(name string) (*Table, error) {
+	db := d.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := createSchema(tx, name)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		return &Table{name: name, indices: map[string]indexinfo{}, d: d}, nil
+	} else {
+		return nil, err
+	}
+}
+
+//
+// The compression algorithm used for the record values (see TableOptions)
+//
+type Compression int
+
+const (
+	NoCompression   Compression = iota
+	GzipCompression             // compress the values with gzip
+)
+
+//
+// TableOptions are the options that can be specified when creating a table (see CreateTableOpts)
+//
+// Compression is the algorithm used to compress the record values (the keys are never compressed,
+// so the indices still sort correctly). This trades CPU for disk space, and is useful for tables with
+// large text fields. Records are marked as compressed, so the compression can be changed without
+// rewriting the existing records.
+//
+// MaxValueSize is the maximum size (in bytes) of the encoded value of a record (the non-key fields),
+// checked before compression: Put returns VALUE_TOO_LARGE for larger records. This is a safety valve
+// for services that store user input. The default (0) is no limit. External fields (see SetExternalField)
+// are stored separately and are not limited.
+//
+type TableOptions struct {
+	Compression  Compression
+	MaxValueSize int
+}
+
+//
+// Create a new table with the specified options (see TableOptions), that are stored with the table
+//
+func (d *DataStore) CreateTableOpts(name string, opts TableOptions) (*Table, error) {
+	db := d.db
+
+	if opts.Compression < NoCompression || opts.Compression > GzipCompression || opts.MaxValueSize < 0 {
+		return nil, BAD_VALUES
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := createSchema(tx, name)
+		if err != nil {
+			return err
+		}
+
+		if opts.Compression != NoCompression {
+			if err := putMeta(b, "compression", int64(opts.Compression)); err != nil {
+				return err
+			}
+		}
+
+		if opts.MaxValueSize > 0 {
+			return putMeta(b, "maxvalue", int64(opts.MaxValueSize))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Table{name: name, indices: map[string]indexinfo{}, compression: opts.Compression, maxValue: opts.MaxValueSize, d: d}, nil
+}
+
+//
+// Get existing Table
+//
+func (d *DataStore) GetTable(name string) (*Table, error) {
+	db := d.db
+
+	var table *Table
+
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		table, err = d.loadTable(tx, name)
+		return
+	})
+
+	if err == nil {
+		return table, nil
+	} else {
+		return nil, err
+	}
+}
+
+//
+// Return true if the table exists (without creating it or loading its definition)
+//
+func (d *DataStore) TableExists(name string) (bool, error) {
+	db := d.db
+
+	var exists bool
+
+	err := db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(schema(name)) != nil
+		return nil
+	})
+
+	return exists, err
+}
+
+//
+// load the table definition (indices and options) from the schema bucket
+//
+func (d *DataStore) loadTable(tx *bolt.Tx, name string) (*Table, error) {
+	table := Table{name: name, indices: map[string]indexinfo{}, d: d}
+
+	b := tx.Bucket(schema(name))
+	if b == nil {
+		return nil, NO_TABLE
+	}
+
+	if v, ok := getMeta(b, "version").(int64); ok {
+		table.version = int(v)
+	}
+
+	if v, ok := getMeta(b, "compression").(int64); ok {
+		table.compression = Compression(v)
+	}
+
+	if v, ok := getMeta(b, "maxvalue").(int64); ok {
+		table.maxValue = int(v)
+	}
+
+	table.loadTimeFields(b)
+	table.loadBlobFields(b)
+	table.loadFields(b)
+
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			// nested bucket (table metadata)
+			return nil
+		}
+
+		name := string(k)
+
+		nilFirst, rest, err := typedbuffer.Decode(v)
+		if err != nil {
+			return SCHEMA_CORRUPTED
+		}
+		fields, err := typedbuffer.DecodeUintArray(rest)
+		if err != nil {
+			return SCHEMA_CORRUPTED
+		}
+
+		info := indexinfo{
+			nilFirst: nilFirst.(bool),
+			iplist:   makeIndexPos(fields),
+		}
+
+		info.loadOptions(b, name)
+		table.indices[name] = info
+		return nil
+	})
+
+	return &table, nil
+}
+
+//
+// Return the current schema version of the table (0 if never set)
+//
+func (t *Table) SchemaVersion() int {
+	return t.version
+}
+
+//
+// Set (and persist) the schema version of the table.
+//
+// Records written after this call are tagged with the new version, so that records written
+// with an older version can be upgraded on read (see SetMigration)
+//
+func (t *Table) SetSchemaVersion(v int) (err error) {
+	defer t.wrapError("SetSchemaVersion", "", &err)
+
+	db := t.d.db
+
+	if v < 0 {
+		return BAD_VALUES
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		return putMeta(b, "version", int64(v))
+	})
+
+	if err == nil {
+		t.version = v
+	}
+
+	return err
+}
+
+//
+// Register a migration function, called by Get, Scan, etc. when decoding a record written with a schema version
+// older than the current one. The function receives the record version and fields and should return
+// the fields in the current layout.
+//
+// Note that the migration function is not persisted and should be registered again after GetTable
+//
+func (t *Table) SetMigration(migrate func(old int, fields []interface{}) []interface{}) {
+	t.migrate = migrate
+}
+
+//
+// Create a new table (dst) with the same indices and options of an existing table (src)
+// and copy all the records.
+//
+// The index buckets of the new table are named after the table, so the new indices have the same names
+// as the original ones. Returns ALREADY_EXISTS if dst exists.
+//
+// Each copied record advances the change sequence and, if the change log is enabled, is recorded
+// as a put in the new table (see Changes).
+//
+func (d *DataStore) CopyTable(src, dst string) (err error) {
+	if m := d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		st, err := d.loadTable(tx, src)
+		if err != nil {
+			return err
+		}
+
+		sb := tx.Bucket(schema(src))
+
+		b, err := createSchema(tx, dst)
+		if err != nil {
+			return err
+		}
+
+		if err := b.SetSequence(sb.Sequence()); err != nil {
+			return err
+		}
+
+		if m := sb.Bucket(metaName); m != nil {
+			dm, err := b.CreateBucket(metaName)
+			if err != nil {
+				return err
+			}
+
+			if err := m.ForEach(dm.Put); err != nil {
+				return err
+			}
+		}
+
+		if bb := sb.Bucket(blobName); bb != nil {
+			// the records only contain the length of the external fields
+			dbb, err := b.CreateBucket(blobName)
+			if err != nil {
+				return err
+			}
+
+			if err := copyBucket(bb, dbb); err != nil {
+				return err
+			}
+		}
+
+		dt := &Table{name: dst, indices: map[string]indexinfo{}, version: st.version, compression: st.compression, d: d}
+
+		for index, info := range st.indices {
+			if err := b.Put([]byte(index), sb.Get([]byte(index))); err != nil {
+				return err
+			}
+
+			info.bucket = tableIndices(dst, index)
+
+			if _, err := tx.CreateBucket(info.bucket); err != nil {
+				return err
+			}
+
+			if err := info.saveOptions(b, index); err != nil {
+				return err
+			}
+
+			if info.partial {
+				// the predicate is not available here, but the index entries
+				// don't depend on the table and can be copied as they are
+				if err := copyBucket(tx.Bucket(st.indices[index].bucket), tx.Bucket(info.bucket)); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			info.counter = nil // the group counts are copied with the metadata
+			dt.indices[index] = info
+		}
+
+		primary, err := primaryIndex(b)
+		if err != nil {
+			return err
+		}
+
+		return st.forEachRecord(tx, "", func(fields []interface{}) error {
+			if primary != nil {
+				if _, err := dt.putPrimary(tx, b, *primary, fields); err != nil {
+					return err
+				}
+			}
+
+			if err := dt.putEntries(tx, fields); err != nil {
+				return err
+			}
+
+			// the copied records are new records of the destination table (i.e. for the change log)
+			return dt.changed(tx, ChangePut, fields)
+		})
+	})
+}
+
+//
+// Rename a table, moving its schema bucket (and the index buckets named after the table) to the new name.
+//
+// Since bolt doesn't support renaming buckets, the content of the buckets is copied and the original buckets
+// are deleted, in a single transaction.
+//
+// Note that existing Table handles for the old name are not valid anymore (see Table.Rename)
+//
+func (d *DataStore) RenameTable(oldname, newname string) (err error) {
+	if m := d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		d.invalidate(tx)
+
+		t, err := d.loadTable(tx, oldname)
+		if err != nil {
+			return err
+		}
+
+		b, err := createSchema(tx, newname)
+		if err != nil {
+			return err
+		}
+
+		if err := copyBucket(tx.Bucket(schema(oldname)), b); err != nil {
+			return err
+		}
+
+		for index, info := range t.indices {
+			if !bytes.Equal(info.bucket, tableIndices(oldname, index)) {
+				continue
+			}
+
+			info.bucket = tableIndices(newname, index)
+
+			if err := moveBucket(tx, tableIndices(oldname, index), info.bucket); err != nil {
+				return err
+			}
+
+			if err := info.saveOptions(b, index); err != nil {
+				return err
+			}
+		}
+
+		return tx.DeleteBucket(schema(oldname))
+	})
+}
+
+//
+// Rename the table (see DataStore.RenameTable), updating the table handle
+//
+func (t *Table) Rename(name string) (err error) {
+	defer t.wrapError("Rename", "", &err)
+
+	if err := t.d.RenameTable(t.name, name); err != nil {
+		return err
+	}
+
+	nt, err := t.d.GetTable(name)
+	if err != nil {
+		return err
+	}
+
+	t.name = nt.name
+	t.indices = nt.indices
+	return nil
+}
+
+//
+// copy all the keys (and nested buckets) from src to dst
+//
+func copyBucket(src, dst *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		// v is also nil for the empty values written by older versions (see marshalKeyValue)
+		sb := src.Bucket(k)
+		if sb == nil {
+			return dst.Put(k, v)
+		}
+
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+
+		return copyBucket(sb, nb)
+	})
+}
+
+//
+// move (copy and delete) a top level bucket
+//
+func moveBucket(tx *bolt.Tx, src, dst []byte) error {
+	sb := tx.Bucket(src)
+	if sb == nil {
+		return NO_INDEX
+	}
+
+	db, err := tx.CreateBucket(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := copyBucket(sb, db); err != nil {
+		return err
+	}
+
+	return tx.DeleteBucket(src)
+}
+
+//
+// Return the current value of the table sequence (the last value assigned to an AUTOINCREMENT field).
+//
+// The sequence is stored in the table bucket, so it persists when the database is closed and reopened
+//
+func (t *Table) CurrentSequence() (seq uint64, err error) {
+	defer t.wrapError("CurrentSequence", "", &err)
+
+	db := t.d.db
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		seq = b.Sequence()
+		return nil
+	})
+
+	return seq, err
+}
+
+//
+// Set the table sequence, so that the next AUTOINCREMENT field gets the value seq+1.
+//
+// This is useful after importing records with pre-assigned ids. Note that setting the sequence to a value
+// lower than an existing id will cause the following Put to overwrite existing records.
+//
+func (t *Table) SetSequence(seq uint64) (err error) {
+	defer t.wrapError("SetSequence", "", &err)
+
+	db := t.d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		return b.SetSequence(seq)
+	})
+}
+
+//
+// Create an index given the name (index) and a list of field positions
+// used to create a composite key.
+//
+// nilFirst specifies if nil values should sort first (lowest possible value) or last (highest possible value)
+//
+// The field position should corrispond to the entries in DataRecord ToFieldList() and FromFieldList()
+//
+// Key fields should be scalar values (numbers, strings, []byte, bool or nil): since the ordering
+// of nested values (lists, maps or structs) would not be well defined, Put returns NESTED_KEY
+// if a key field contains one.
+//
+func (t *Table) CreateIndex(index string, nilFirst bool, fields ...uint64) (err error) {
+	defer t.wrapError("CreateIndex", index, &err)
+
+	return t.createIndex(index, indexinfo{nilFirst: nilFirst}, fields)
+}
+
+//
+// Create an index (as CreateIndex) where all the numeric key fields are normalized,
+// so that the same logical value produces the same key independently of its type
+// (i.e. int, int64 or uint64) and numbers of different types sort correctly.
+//
+// Integer key values are stored as int64 (or uint64 if too large to fit), and are returned as such by Get and Scan.
+// Floating point values are not normalized.
+//
+func (t *Table) CreateNumericIndex(index string, nilFirst bool, fields ...uint64) (err error) {
+	defer t.wrapError("CreateNumericIndex", index, &err)
+
+	return t.createIndex(index, indexinfo{nilFirst: nilFirst, numeric: true}, fields)
+}
+
+//
+// Create a hash index, where the key is the SHA-256 hash of the key fields (encoded as in the other indices)
+// so that records with the same content (in the key fields) map to the same entry, whatever their size.
+// This is useful for deduplication, to check if a record was seen before (with Get, that hashes the key fields of the query record).
+//
+// The entries contain all the fields of the records, so Get and Scan return the full records,
+// but the entries are sorted by hash: prefix and range scans are not meaningful and Keys and ScanKeys return the hashes.
+//
+func (t *Table) CreateHashIndex(index string, fields ...uint64) (err error) {
+	defer t.wrapError("CreateHashIndex", index, &err)
+
+	return t.createIndex(index, indexinfo{nilFirst: true, hash: true}, fields)
+}
+
+//
+// A FieldSpec is a key field of an index created with CreateIndexSpec: the position of the field
+// and the sort order of its values (ascending or descending)
+//
+type FieldSpec struct {
+	Field uint64
+	Desc  bool
+}
+
+//
+// Create an index (as CreateIndex) where each key field can be sorted in ascending or descending order
+// (i.e. ascending by name and descending by date, so that a prefix scan on a name returns the most recent records first).
+//
+// The descending fields are stored with all the bits of their encoded values inverted, so that the keys still sort
+// as byte strings. For a descending field nil values sort at the opposite end than specified by nilFirst.
+//
+func (t *Table) CreateIndexSpec(index string, nilFirst bool, specs ...FieldSpec) (err error) {
+	defer t.wrapError("CreateIndexSpec", index, &err)
+
+	info, fields := specInfo(indexinfo{nilFirst: nilFirst}, specs)
+	return t.createIndex(index, info, fields)
+}
+
+//
+// return the key fields of an index as a list of FieldSpec
+//
+func (info indexinfo) specs() []FieldSpec {
+	fields := info.keyFields()
+	specs := make([]FieldSpec, len(fields))
+
+	for pos, field := range fields {
+		specs[pos] = FieldSpec{Field: field, Desc: info.isDesc(pos)}
+	}
+
+	return specs
+}
+
+//
+// set the key fields of an index (and their sort order) from a list of FieldSpec,
+// returning the updated index and the list of key fields
+//
+func specInfo(info indexinfo, specs []FieldSpec) (indexinfo, []uint64) {
+	fields := make([]uint64, len(specs))
+	info.desc = nil
+
+	for i, spec := range specs {
+		fields[i] = spec.Field
+
+		if spec.Desc {
+			if info.desc == nil {
+				info.desc = make([]bool, len(specs))
+			}
+
+			info.desc[i] = true
+		}
+	}
+
+	info.iplist = makeIndexPos(fields)
+	return info, fields
+}
+
+//
+// Create a partial index, that only contains the records for which pred returns true
+// (i.e. only the records with status "active").
+//
+// Put (and BulkLoad) call the predicate for each record and only add it to the index if it returns true,
+// removing the index entry if the record doesn't match anymore.
+// The predicate receives a record with the fields as passed to Put (with AUTOINCREMENT fields resolved).
+//
+// Note that only the fact that the index is partial is persisted, not the predicate: it should be registered again
+// with SetPredicate after GetTable, or writing to the table will return NO_PREDICATE
+//
+func (t *Table) CreatePartialIndex(index string, nilFirst bool, pred func(DataRecord) bool, fields ...uint64) (err error) {
+	defer t.wrapError("CreatePartialIndex", index, &err)
+
+	if pred == nil {
+		return BAD_VALUES
+	}
+
+	return t.createIndex(index, indexinfo{nilFirst: nilFirst, partial: true, pred: pred}, fields)
+}
+
+//
+// Create an index on keyFields (as CreateIndex) that "covers" includeFields: the index entries only contain
+// the key fields and the included fields, so scanning the index returns records with just those fields
+// (the others are nil) without reading the primary storage.
+//
+// Since the entries don't contain the full records, a covering index can't be used to delete or update records
+// (Delete, DeletePrefix, IncrField and Upsert return BAD_VALUES) and it's never used as the source
+// of the records of the table (i.e. to rebuild the other indices).
+//
+// Returns BAD_VALUES if there are no included fields, if an included field is also a key field
+// or if it's an external field (see SetExternalField)
+//
+func (t *Table) CreateCoveringIndex(index string, nilFirst bool, keyFields []uint64, includeFields []uint64) (err error) {
+	defer t.wrapError("CreateCoveringIndex", index, &err)
+
+	if len(includeFields) == 0 {
+		return BAD_VALUES
+	}
+
+	include := append([]uint64{}, includeFields...)
+	sort.Slice(include, func(i, j int) bool { return include[i] < include[j] })
+
+	for i, inc := range include {
+		if i > 0 && inc == include[i-1] {
+			return BAD_VALUES
+		}
+
+		if t.blobs[int(inc)] {
+			return BAD_VALUES
+		}
+
+		for _, key := range keyFields {
+			if inc == key {
+				return BAD_VALUES
+			}
+		}
+	}
+
+	return t.createIndex(index, indexinfo{nilFirst: nilFirst, include: include}, keyFields)
+}
+
+//
+// Set the predicate for a partial index (see CreatePartialIndex)
+//
+// Returns NO_INDEX if the index doesn't exist and BAD_VALUES if it's not a partial index
+//
+func (t *Table) SetPredicate(index string, pred func(DataRecord) bool) (err error) {
+	defer t.wrapError("SetPredicate", index, &err)
+
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	if !info.partial || pred == nil {
+		return BAD_VALUES
+	}
+
+	info.pred = pred
+	t.indices[index] = info
+	return nil
+}
+
+//
+// a DataRecord wrapping a list of fields, used to call partial index predicates
+//
+type fieldList []interface{}
+
+func (l *fieldList) ToFieldList() []interface{} {
+	return *l
+}
+
+func (l *fieldList) FromFieldList(fields []interface{}) {
+	*l = fields
+}
+
+//
+// return true if the record should be added to the index (always true, if the index is not partial)
+//
+func (info indexinfo) includes(fields []interface{}) (bool, error) {
+	if !info.partial {
+		return true, nil
+	}
+
+	if info.pred == nil {
+		return false, NO_PREDICATE
+	}
+
+	rec := fieldList(fields)
+	return info.pred(&rec), nil
+}
+
+func (t *Table) createIndex(index string, info indexinfo, fields []uint64) error {
+	db := t.d.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		enc, err := indexDefinition(info.nilFirst, fields)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte(index), enc); err != nil {
+			return err
+		}
+
+		if info.bucket == nil {
+			info.bucket = indices(index)
+		}
+
+		if _, err := tx.CreateBucket(info.bucket); err != nil {
+			return err
+		}
+
+		// the indices created by older versions store the float keys as they are (see floatKey)
+		info.floats = true
+
+		return info.saveOptions(b, index)
+	})
+
+	if err == nil {
+		info.iplist = makeIndexPos(fields)
+		t.indices[index] = info
+	}
+
+	return err
+}
+
+//
+// Write the definitions of the indices of the Table (key fields and options) to the table schema,
+// so that the persisted schema matches the one in memory (i.e. after changing the index options programmatically).
+//
+// The index entries are not modified (RebuildIndex should be called if the key fields changed) and the indices
+// that are in the schema but not in the Table are left as they are.
+//
+func (t *Table) SaveSchema() (err error) {
+	defer t.wrapError("SaveSchema", "", &err)
+
+	db := t.d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		for index, info := range t.indices {
+			enc, err := indexDefinition(info.nilFirst, info.keyFields())
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put([]byte(index), enc); err != nil {
+				return err
+			}
+
+			if _, err := tx.CreateBucketIfNotExists(info.bucket); err != nil {
+				return err
+			}
+
+			if err := clearOptions(b, index); err != nil {
+				return err
+			}
+
+			if err := info.saveOptions(b, index); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//
+// return the positions of the key fields of the index, in key order
+//
+func (info indexinfo) keyFields() []uint64 {
+	fields := make([]uint64, len(info.iplist))
+	for _, ip := range info.iplist {
+		fields[ip.pos] = uint64(ip.field)
+	}
+
+	return fields
+}
+
+//
+// encode the definition of an index, as stored in the table schema
+//
+func indexDefinition(nilFirst bool, fields []uint64) ([]byte, error) {
+	b1, err := typedbuffer.Encode(nilFirst)
+	if err != nil {
+		return nil, BAD_VALUES
+	}
+	b2, err := typedbuffer.Encode(fields)
+	if err != nil {
+		return nil, BAD_VALUES
+	}
+
+	return append(b1, b2...), nil
+}
+
+//
+// remove the options of an index from the table metadata (but not the group counts, that are data)
+//
+func clearOptions(b *bolt.Bucket, index string) error {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return nil
+	}
+
+	prefix := []byte(indexOption(index, ""))
+	counts := []byte(indexOption(index, countOption))
+
+	var keys [][]byte
+
+	c := m.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if !bytes.HasPrefix(k, counts) {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Return true if the index is defined for the table.
+//
+// The index is looked up in the Table and, if not found, in the table schema, so indices created
+// by other Table handles (or other processes) after the table was loaded are also reported
+// (note that GetTable should be called again to use them)
+//
+func (t *Table) IndexExists(index string) bool {
+	if _, ok := t.indices[index]; ok {
+		return true
+	}
+
+	db := t.d.db
+
+	exists := false
+
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(schema(t.name)); b != nil {
+			exists = b.Get([]byte(index)) != nil
+		}
+
+		return nil
+	})
+
+	return exists
+}
+
+//
+// Rebuild an index, replacing its entries with the ones computed from the table records
+// (read from the primary storage or, for tables without primary storage, from another index).
+//
+// This is useful to fix an index that is corrupted or out of sync. The other indices are not modified.
+//
+// Returns NO_INDEX if the index doesn't exist
+//
+func (t *Table) RebuildIndex(index string) (err error) {
+	defer t.wrapError("RebuildIndex", index, &err)
+
+	db := t.d.db
+
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		t.d.invalidate(tx)
+
+		if tx.Bucket(info.bucket) == nil {
+			return NO_INDEX
+		}
+
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		return t.rebuildIndex(tx, b, index, info, false)
+	})
+}
+
+//
+// replace the entries of an index with the ones computed from the table records, with the key fields of info
+// (that can be different from the ones of the current index, stored in the bucket of info).
+//
+// If unique is true, DUPLICATE_KEY is returned if two records have the same key
+//
+func (t *Table) rebuildIndex(tx *bolt.Tx, b *bolt.Bucket, index string, info indexinfo, unique bool) error {
+	// the group counts are recomputed with the new entries
+	if err := clearCounts(b, index); err != nil {
+		return err
+	}
+
+	// build the new index in a temporary bucket (since the records may be read from the index itself)
+	// and replace the old one when done
+
+	tmp := append(append([]byte{}, info.bucket...), "~rebuild"...)
+
+	tb, err := tx.CreateBucket(tmp)
+	if err != nil {
+		return err
+	}
+
+	rinfo := info
+	rinfo.bucket = tmp
+
+	rt := &Table{name: t.name, indices: map[string]indexinfo{index: rinfo}, version: t.version, compression: t.compression, d: t.d}
+
+	if err := t.forEachRecord(tx, index, func(fields []interface{}) error {
+		if unique {
+			if ok, err := rinfo.includes(fields); err != nil {
+				return err
+			} else if ok {
+				k, _, err := rinfo.marshalKeyValue(fields)
+				if err != nil {
+					return err
+				}
+
+				if k != nil && tb.Get(k) != nil {
+					return DUPLICATE_KEY
+				}
+			}
+		}
+
+		return rt.putEntries(tx, fields)
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.DeleteBucket(info.bucket); err != nil {
+		return err
+	}
+
+	return moveBucket(tx, tmp, info.bucket)
+}
+
+//
+// Change the uniqueness of an index. In a unique index each key identifies a single record
+// (a Put with the same key replaces the entry), while a non-unique index has some "distinct" key fields
+// after the ones it was created with, to keep the records with the same values of those fields apart.
+// For tables with primary storage the distinct field is the primary key, for the other tables they are
+// all the fields of the records that are not in the key (external fields and fields with nested values excluded),
+// so that only the records that are the same in all those fields share an entry.
+//
+// The index entries are rewritten with the new keys and the index definition (with the distinct fields)
+// is updated in the schema. Making an index non-unique is always safe, making it unique fails with DUPLICATE_KEY
+// (and the index is not modified) if some records have the same key. Setting the current uniqueness does nothing.
+//
+// Returns BAD_VALUES for covering indices of tables without primary storage (since the entries don't contain
+// the fields that are not in the key) and NO_INDEX if the index doesn't exist
+//
+func (t *Table) SetIndexUnique(index string, unique bool) (err error) {
+	defer t.wrapError("SetIndexUnique", index, &err)
+
+	db := t.d.db
+
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	ninfo := info
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		t.d.invalidate(tx)
+
+		if tx.Bucket(info.bucket) == nil {
+			return NO_INDEX
+		}
+
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		specs := info.specs()
+
+		if unique {
+			n, err := distinctCount(b, info)
+			if err != nil || n == 0 {
+				return err
+			}
+
+			specs = specs[:len(specs)-n]
+			ninfo.distinct = nil
+		} else {
+			if info.distinct != nil {
+				return nil
+			}
+
+			distinct, err := t.distinctFields(tx, b, info)
+			if err != nil || len(distinct) == 0 {
+				return err
+			}
+
+			for _, field := range distinct {
+				specs = append(specs, FieldSpec{Field: field})
+			}
+
+			ninfo.distinct = distinct
+		}
+
+		var fields []uint64
+		ninfo, fields = specInfo(ninfo, specs)
+
+		if err := t.rebuildIndex(tx, b, index, ninfo, unique); err != nil {
+			return err
+		}
+
+		enc, err := indexDefinition(ninfo.nilFirst, fields)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte(index), enc); err != nil {
+			return err
+		}
+
+		if err := clearOptions(b, index); err != nil {
+			return err
+		}
+
+		return ninfo.saveOptions(b, index)
+	})
+
+	if err == nil {
+		t.indices[index] = ninfo
+	}
+
+	return err
+}
+
+//
+// return the number of trailing key fields of a non-unique index (0 if the index is unique, see SetIndexUnique).
+//
+// The indices created with the primary key as the last key field (but not as the only one) are non-unique,
+// even if they weren't made non-unique by SetIndexUnique
+//
+func distinctCount(b *bolt.Bucket, info indexinfo) (int, error) {
+	fields := info.keyFields()
+
+	if info.distinct != nil {
+		if len(info.distinct) >= len(fields) {
+			return 0, nil
+		}
+
+		return len(info.distinct), nil
+	}
+
+	primary, err := primaryIndex(b)
+	if err != nil || primary == nil {
+		return 0, err
+	}
+
+	if n := len(fields); n > 1 && fields[n-1] == uint64(primary.iplist[0].field) {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+//
+// return the fields to add to the key of an index to make it non-unique (see SetIndexUnique),
+// or nil if the key already identifies a single record
+//
+func (t *Table) distinctFields(tx *bolt.Tx, b *bolt.Bucket, info indexinfo) ([]uint64, error) {
+	primary, err := primaryIndex(b)
+	if err != nil {
+		return nil, err
+	}
+
+	key := map[uint64]bool{}
+
+	for _, field := range info.keyFields() {
+		key[field] = true
+	}
+
+	if primary != nil {
+		if id := uint64(primary.iplist[0].field); !key[id] {
+			return []uint64{id}, nil
+		}
+
+		return nil, nil
+	}
+
+	if !info.complete() {
+		return nil, BAD_VALUES
+	}
+
+	// the fields of the records that can be key fields
+	width := 0
+	nested := map[int]bool{}
+
+	if err := t.forEachRecord(tx, "", func(fields []interface{}) error {
+		if len(fields) > width {
+			width = len(fields)
+		}
+
+		for i, v := range fields {
+			if isNested(v) {
+				nested[i] = true
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var distinct []uint64
+
+	for i := 0; i < width; i++ {
+		if !key[uint64(i)] && !nested[i] && !t.blobs[i] {
+			distinct = append(distinct, uint64(i))
+		}
+	}
+
+	return distinct, nil
+}
+
+//
+// Rename an index, moving the index bucket and options to the new name.
+//
+// Returns NO_INDEX if the index doesn't exist and ALREADY_EXISTS if an index with the new name exists
+//
+func (t *Table) RenameIndex(oldname, newname string) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("RenameIndex", oldname, &err)
+
+	db := t.d.db
+
+	info, ok := t.indices[oldname]
+	if !ok {
+		return NO_INDEX
+	}
+
+	if _, ok := t.indices[newname]; ok {
+		return ALREADY_EXISTS
+	}
+
+	bucket := indices(newname)
+	if !bytes.Equal(info.bucket, indices(oldname)) {
+		bucket = tableIndices(t.name, newname)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		t.d.invalidate(tx)
+
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		def := b.Get([]byte(oldname))
+		if def == nil {
+			return NO_INDEX
+		}
+
+		if b.Get([]byte(newname)) != nil {
+			return ALREADY_EXISTS
+		}
+
+		if err := b.Put([]byte(newname), def); err != nil {
+			return err
+		}
+
+		if err := b.Delete([]byte(oldname)); err != nil {
+			return err
+		}
+
+		if err := moveBucket(tx, info.bucket, bucket); err != nil {
+			return err
+		}
+
+		// move the index options
+		if m := b.Bucket(metaName); m != nil {
+			prefix := []byte(indexOption(oldname, ""))
+
+			var keys [][]byte
+
+			c := m.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+
+			for _, k := range keys {
+				option := string(k[len(prefix):])
+
+				if err := m.Put([]byte(indexOption(newname, option)), m.Get(k)); err != nil {
+					return err
+				}
+
+				if err := m.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		info.bucket = bucket
+		return info.saveOptions(b, newname)
+	})
+
+	if err == nil {
+		delete(t.indices, oldname)
+		t.indices[newname] = info
+	}
+
+	return err
+}
+
+//
+// marshal an array of fields into a key and value pair of encoded values
+//
+// the key is a composed key of the fields described in info.iplist (field number and order)
+// the value is a collection of the remaning fields
+//
+func (info indexinfo) marshalKeyValue(fields []interface{}) (key, value []byte, err error) {
+	if len(info.iplist) == 0 {
+		return
+	}
+
+	vkey := make([]interface{}, len(info.iplist))
+	vval := make([]interface{}, 0)
+
+	kk, lk := 0, len(info.iplist)
+
+	for fi, fv := range fields {
+		if kk < lk && uint(fi) == info.iplist[kk].field {
+			if isNested(fv) {
+				err = NESTED_KEY
+				return
+			}
+
+			if info.numeric {
+				fv = numericKey(fv)
+			} else {
+				fv = normalizeKey(fv)
+			}
+
+			vkey[info.iplist[kk].pos] = fv
+			kk += 1
+
+			// the key fields can't be decoded from a hash
+			if info.hash {
+				vval = append(vval, normalizeKey(fields[fi]))
+			}
+		} else if info.stores(uint64(fi)) {
+			vval = append(vval, normalizeKey(fv))
+		}
+	}
+
+	if len(vkey) > 0 {
+		if key, err = info.encodeKey(vkey); err != nil {
+			return
+		}
+	}
+
+	if len(vval) > 0 {
+		value, err = typedbuffer.EncodeNils(info.nilFirst, vval...)
+	} else {
+		// bolt reports a nil value as a nested bucket (and fails to delete the index bucket)
+		value = []byte{}
+	}
+
+	return
+}
+
+//
+// encode the leading key fields found in the input list (up to the first missing or nil one)
+// into a prefix of the keys of all the records with the same values.
+//
+// Returns a nil prefix if the first key field is missing
+//
+func (info indexinfo) marshalPrefix(fields []interface{}) ([]byte, error) {
+	// a hash has no prefixes, only the full key can be looked up
+	if info.hash {
+		k, _, err := info.marshalKeyValue(fields)
+		return k, err
+	}
+
+	vkey := make([]interface{}, len(info.iplist))
+
+	for _, ip := range info.iplist {
+		if ip.field < uint(len(fields)) {
+			vkey[ip.pos] = fields[ip.field]
+		}
+	}
+
+	n := 0
+
+	for ; n < len(vkey) && vkey[n] != nil; n++ {
+		if isNested(vkey[n]) {
+			return nil, NESTED_KEY
+		}
+
+		if info.numeric {
+			vkey[n] = numericKey(vkey[n])
+		} else {
+			vkey[n] = normalizeKey(vkey[n])
+		}
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
+	return info.encodeKey(vkey[:n])
+}
+
+//
+// encode a list of key values (in key order), inverting the descending fields.
+//
+// No separator is needed between the fields: typedbuffer encodes each value with its type and, for strings
+// and byte slices, delimits its end, so a value is never a prefix of a longer value of the same type
+// and the fields of a composite key can't collide (i.e. ("a", "bc") and ("ab", "c") are different keys,
+// and the prefix for "a" doesn't match the keys starting with "ab")
+//
+func (info indexinfo) encodeKey(values []interface{}) ([]byte, error) {
+	if info.floats {
+		fvalues := make([]interface{}, len(values))
+
+		for i, v := range values {
+			fvalues[i] = floatKey(v)
+		}
+
+		values = fvalues
+	}
+
+	if info.hash {
+		enc, err := typedbuffer.EncodeNils(info.nilFirst, values...)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(enc)
+		return sum[:], nil
+	}
+
+	if info.desc == nil {
+		return typedbuffer.EncodeNils(info.nilFirst, values...)
+	}
+
+	var key []byte
+
+	for pos, v := range values {
+		enc, err := typedbuffer.EncodeNils(info.nilFirst, v)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.isDesc(pos) {
+			invert(enc)
+		}
+
+		key = append(key, enc...)
+	}
+
+	return key, nil
+}
+
+//
+// decode a key into the list of key values (in key order), as encoded by encodeKey
+// (for hash indices, the only value is the hash)
+//
+func (info indexinfo) decodeKey(k []byte) (values []interface{}, err error) {
+	if info.hash {
+		return []interface{}{append([]byte{}, k...)}, nil
+	}
+
+	if info.floats {
+		defer func() {
+			for i, v := range values {
+				values[i] = floatValue(v)
+			}
+		}()
+	}
+
+	if info.desc == nil {
+		return typedbuffer.DecodeAll(info.nilFirst, k)
+	}
+
+	for pos := 0; len(k) > 0; pos++ {
+		enc := k
+
+		if info.isDesc(pos) {
+			enc = append([]byte{}, k...)
+			invert(enc)
+		}
+
+		v, rest, err := typedbuffer.Decode(enc)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+		k = k[len(k)-len(rest):]
+	}
+
+	return values, nil
+}
+
+//
+// Floats are encoded with their IEEE 754 bits, that don't sort as numbers for negative values.
+// In keys they are replaced by floats with the bits of an order preserving transform of the value:
+// the sign bit is flipped for positive values and all the bits are inverted for negative values.
+//
+func floatKey(v interface{}) interface{} {
+	var f float64
+
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	default:
+		return v
+	}
+
+	bits := math.Float64bits(f)
+
+	if bits>>63 == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+//
+// reverse the transform of floatKey
+//
+func floatValue(v interface{}) interface{} {
+	f, ok := v.(float64)
+	if !ok {
+		return v
+	}
+
+	bits := math.Float64bits(f)
+
+	if bits>>63 == 1 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+//
+// return true if the key field at position pos (in key order) is sorted in descending order
+//
+func (info indexinfo) isDesc(pos int) bool {
+	return pos < len(info.desc) && info.desc[pos]
+}
+
+//
+// invert (in place) all the bits of an encoded value, to reverse its sort order
+//
+func invert(b []byte) {
+	for i := range b {
+		b[i] = ^b[i]
+	}
+}
+
+//
+// return true if the record is nil (or a nil pointer), to return BAD_VALUES instead of panicking
+//
+func isNil(rec DataRecord) bool {
+	if rec == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(rec)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+//
+// return true if the value is a list, map or struct (not valid as a key field).
+// time.Time is not considered a struct, since it's converted to int64
+//
+func isNested(v interface{}) bool {
+	switch v.(type) {
+	case nil, []byte, time.Time:
+		return false
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		return true
+	}
+
+	return false
+}
+
+//
+// normalize an integer value so that all signed types are converted to int64
+// and all unsigned types to uint64 (i.e. the same value always produces the same key).
+// time.Time values are converted to int64 (see TimeKey)
+//
+// Named types (i.e. enums like "type Status int") are converted to their underlying type
+// (int64, uint64, float64, string or bool), so they are stored as the underlying values
+// and are returned as such by Get and Scan.
+//
+func normalizeKey(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint:
+		return uint64(n)
+	case uint8:
+		return uint64(n)
+	case uint16:
+		return uint64(n)
+	case uint32:
+		return uint64(n)
+	case time.Time:
+		return TimeKey(n)
+	case nil:
+		return nil
+	}
+
+	if rv := reflect.ValueOf(v); rv.Type().PkgPath() != "" {
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return rv.Uint()
+		case reflect.Float32, reflect.Float64:
+			return rv.Float()
+		case reflect.String:
+			return rv.String()
+		case reflect.Bool:
+			return rv.Bool()
+		}
+	}
+
+	return v
+}
+
+//
+// normalize an integer value to int64 (or uint64, if it doesn't fit)
+//
+func numericKey(v interface{}) interface{} {
+	v = normalizeKey(v)
+
+	if n, ok := v.(uint64); ok && n <= math.MaxInt64 {
+		return int64(n)
+	}
+
+	return v
+}
+
+//
+// unmarshal key, value into a list of decoded fields
+//
+func (info indexinfo) unmarshalKeyValue(k, v []byte) ([]interface{}, error) {
+	return info.unmarshalInto(nil, k, v)
+}
+
+//
+// the buffers used to decode the records in the "reuse" scans (see ScanFieldsReuse)
+//
+var decodePool = sync.Pool{
+	New: func() interface{} {
+		return new([]interface{})
+	},
+}
+
+//
+// unmarshal a key and value pair as unmarshalKeyValue, appending the fields to fields[:0]
+// (so that the fields buffer can be reused)
+//
+func (info indexinfo) unmarshalInto(fields []interface{}, k, v []byte) ([]interface{}, error) {
+	// the values of hash indices contain all the fields
+	if info.hash {
+		vval, err := typedbuffer.DecodeAll(info.nilFirst, v)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(fields[:0], vval...), nil
+	}
+
+	vkey, err := info.decodeKey(k)
+	if err != nil {
+		return nil, err
+	}
+
+	vval, err := typedbuffer.DecodeAll(info.nilFirst, v)
+	if err != nil {
+		return nil, err
+	}
+
+	// the values of covering indices only contain the included fields (in field order):
+	// the other fields are set to nil
+	if !info.complete() {
+		n := 0
+
+		for _, ip := range info.iplist {
+			if int(ip.field) >= n {
+				n = int(ip.field) + 1
+			}
+		}
+
+		for i, pos := range info.include {
+			if i < len(vval) && int(pos) >= n {
+				n = int(pos) + 1
+			}
+		}
+
+		fields = append(fields[:0], make([]interface{}, n)...)
+
+		for _, ip := range info.iplist {
+			fields[ip.field] = vkey[ip.pos]
+		}
+
+		for i, pos := range info.include {
+			if i < len(vval) {
+				fields[pos] = vval[i]
+			}
+		}
+
+		return fields, nil
+	}
+
+	lkey := len(vkey)
+	lval := len(vval)
+
+	fields = fields[:0]
+
+	var ival interface{}
+
+	kk, lk := 0, len(info.iplist)
+
+	for i := 0; i < lkey+lval; i++ {
+		if kk < lk && uint(i) == info.iplist[kk].field {
+			ival = vkey[info.iplist[kk].pos]
+			kk += 1
+		} else {
+			ival = vval[0]
+			vval = vval[1:]
+		}
+
+		fields = append(fields, ival)
+	}
+
+	return fields, nil
+}
+
+//
+// call fn with the fields of every record in the table, read from the primary storage
+// or (for tables without primary storage) from one of the indices that contain the full records
+// (all but the covering indices).
+//
+// The index specified in skip is only used if there are no other indices
+//
+func (t *Table) forEachRecord(tx *bolt.Tx, skip string, fn func(fields []interface{}) error) error {
+	b := tx.Bucket(schema(t.name))
+	if b == nil {
+		return NO_TABLE
+	}
+
+	primary, err := primaryIndex(b)
+	if err != nil {
+		return err
+	}
+
+	var source *bolt.Bucket
+	var info indexinfo
+
+	if data := b.Bucket(dataName); primary != nil && data != nil {
+		source, info = data, *primary
+	} else {
+		names := make([]string, 0, len(t.indices))
+		for index, info := range t.indices {
+			if index != skip && info.complete() {
+				names = append(names, index)
+			}
+		}
+
+		if len(names) == 0 {
+			if info, ok := t.indices[skip]; !ok || !info.complete() {
+				return nil
+			}
+
+			names = append(names, skip)
+		}
+
+		sort.Strings(names)
+
+		info = t.indices[names[0]]
+		source = tx.Bucket(info.bucket)
+	}
+
+	if source == nil {
+		return nil
+	}
+
+	return source.ForEach(func(k, v []byte) error {
+		fields, err := t.decode(info, k, v)
+		if err != nil {
+			return err
+		}
+
+		return fn(fields)
+	})
+}
+
+//
+// Add a record to the table, updating all indices.
 // If a record with the same key exists, it's updated.
 //
-func (t *Table) Put(rec DataRecord) (uint64, error) {
-	db := (*bolt.DB)(t.d)
+// The AUTOINCREMENT values are assigned in the same transaction that writes the primary storage and the indices:
+// if any of the writes fails the transaction is rolled back, with the sequences, so no value is consumed.
+//
+// The AUTOINCREMENT values are also written back to the list returned by ToFieldList,
+// so records backed by a slice get the assigned values.
+//
+// Returns the value assigned to the first AUTOINCREMENT field (or 0 if there are none)
+//
+func (t *Table) Put(rec DataRecord) (uint64, error) {
+	return t.PutContext(context.Background(), rec)
+}
+
+//
+// Add a record to the table, as Put, starting the span of the operation (see WithTracer) from ctx
+//
+func (t *Table) PutContext(ctx context.Context, rec DataRecord) (key uint64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("Put", "", &err)
+
+	if isNil(rec) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpanContext(ctx, "Put")
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		key, err = t.put(tx, rec)
+		return
+	})
+
+	endSpan(span, 1, err)
+
+	return key, err
+}
+
+//
+// ConflictPolicy specifies what PutWith does when a record with the same key already exists
+// (with the same primary key, or the same key in any index)
+//
+type ConflictPolicy int
+
+const (
+	Replace ConflictPolicy = iota // replace the existing record (as Put)
+	Ignore                        // keep the existing record and don't add the new one
+	Fail                          // return DUPLICATE_KEY
+)
+
+//
+// Add a record to the table, as Put, applying the conflict policy if a record with the same key already exists.
+//
+// With the Ignore policy nothing is written (no AUTOINCREMENT value is consumed) if the record exists,
+// and the returned key is the primary key of the existing record (0 for tables without primary storage)
+//
+func (t *Table) PutWith(rec DataRecord, policy ConflictPolicy) (key uint64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("PutWith", "", &err)
+
+	if isNil(rec) || policy < Replace || policy > Fail {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Put")
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		key, err = t.putWith(tx, rec, policy)
+		return
+	})
+
+	if err == errRollback {
+		err = nil
+	}
+
+	endSpan(span, 1, err)
+
+	return key, err
+}
+
+//
+// Add or update a record, given a unique index on a natural key of the record (i.e. an email).
+//
+// If a record with the same natural key exists, the AUTOINCREMENT fields of rec are replaced with the values
+// of the existing record, so that the existing record is updated and keeps its id. Otherwise rec is added as by Put.
+//
+// Returns the value of the first AUTOINCREMENT field (the existing one if the record was updated)
+//
+func (t *Table) Upsert(naturalIndex string, rec DataRecord) (key uint64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("Upsert", naturalIndex, &err)
+
+	if isNil(rec) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Put")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, naturalIndex)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[naturalIndex]
+		if !info.complete() {
+			return BAD_VALUES
+		}
+
+		fields := fieldList(append([]interface{}{}, rec.ToFieldList()...))
+
+		// only the key fields are encoded (the other fields may be AUTOINCREMENT)
+		k, err := info.marshalPrefix(fields)
+		if err != nil {
+			return err
+		}
+
+		if v := b.Get(k); k != nil && v != nil {
+			existing, err := t.decode(info, k, v)
+			if err != nil {
+				return err
+			}
+
+			for i, f := range fields {
+				if !isAutoIncrement(f) || i >= len(existing) {
+					continue
+				}
+
+				if key == 0 {
+					key, _ = toUint64(existing[i])
+				}
+
+				fields[i] = existing[i]
+			}
+		}
+
+		id, err := t.put(tx, &fields)
+		if key == 0 {
+			key = id
+		}
+
+		return err
+	})
+
+	endSpan(span, 1, err)
+
+	return key, err
+}
+
+//
+// Get the record with the specified key (as Get) or, if it doesn't exist, add rec (as Put), in a single transaction:
+// when called concurrently with the same key, only one of the callers adds the record.
+//
+// If the record exists it's returned in res and created is false, otherwise res is not modified and created is true
+//
+func (t *Table) GetOrPut(index string, key, rec, res DataRecord) (created bool, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetOrPut", index, &err)
+
+	if isNil(key) || isNil(rec) || isNil(res) {
+		return false, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Put")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := t.get(tx, index, key, res); err != NO_KEY {
+			return err
+		}
+
+		if _, err := t.put(tx, rec); err != nil {
+			return err
+		}
+
+		created = true
+		return nil
+	})
+
+	if err != nil {
+		created = false
+	}
+
+	endSpan(span, 1, err)
+	return created, err
+}
+
+//
+// Add a record to the table, as Put, but using bolt Batch() so that concurrent callers
+// can be coalesced into a single transaction (and a single fsync).
+//
+// Note that Batch may run the same operation more than once (if any operation in the batch fails
+// the others are retried) so AUTOINCREMENT fields are always resolved from a copy of the original record
+// (that, unlike Put, doesn't get the assigned values) and the returned value is the one assigned
+// in the transaction that was finally committed.
+//
+func (t *Table) BatchPut(rec DataRecord) (key uint64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("BatchPut", "", &err)
+
+	if isNil(rec) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("BatchPut")
+
+	err = db.Batch(func(tx *bolt.Tx) (err error) {
+		fields := fieldList(append([]interface{}{}, rec.ToFieldList()...))
+
+		key, err = t.put(tx, &fields)
+		return
+	})
+
+	endSpan(span, 1, err)
+
+	return key, err
+}
+
+//
+// Return, for each index, the key that Put would write for the record, without writing anything.
+//
+// AUTOINCREMENT fields are resolved to the values that Put would assign if called now.
+//
+// This is useful to debug key encoding issues (i.e. a Get that doesn't find a record because
+// a key field is a []byte instead of a string, or an int instead of an uint)
+//
+func (t *Table) ExplainPut(rec DataRecord) (keys map[string][]byte, err error) {
+	defer t.wrapError("ExplainPut", "", &err)
+
+	if isNil(rec) {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	keys = map[string][]byte{}
+
+	// resolving AUTOINCREMENT fields requires a writable transaction,
+	// that is rolled back by returning errRollback
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		// resolve a copy, so that the AUTOINCREMENT values are not written back to the record
+		copied := fieldList(append([]interface{}{}, rec.ToFieldList()...))
+
+		fields, _, primary, err := t.resolve(b, &copied, false)
+		if err != nil {
+			return err
+		}
+
+		if primary != nil {
+			if _, err := primary.primaryID(fields); err != nil {
+				return err
+			}
+		}
+
+		for index, info := range t.indices {
+			k, _, err := info.marshalKeyValue(fields)
+			if err != nil {
+				return err
+			}
+
+			if k == nil {
+				continue
+			}
+
+			if ok, err := info.includes(fields); err != nil {
+				return err
+			} else if ok {
+				keys[index] = k
+			}
+		}
+
+		return errRollback
+	})
+
+	if err != errRollback {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+//
+// Return, for each index, the key of the record if it's in the index, or nil if the index doesn't contain it
+// (or, for a partial index, if the record doesn't match the predicate).
+//
+// The keys are computed from the record as by ExplainPut (but AUTOINCREMENT fields are not resolved,
+// so the record should contain the actual keys). This is useful to find why a record can be found
+// with one index but not with another (i.e. after an interrupted write or a Delete with a bad key)
+//
+func (t *Table) IndicesFor(rec DataRecord) (keys map[string][]byte, err error) {
+	defer t.wrapError("IndicesFor", "", &err)
+
+	if isNil(rec) {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	fields := rec.ToFieldList()
+
+	keys = map[string][]byte{}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for index, info := range t.indices {
+			keys[index] = nil
+
+			k, _, err := info.marshalKeyValue(fields)
+			if err != nil {
+				return err
+			}
+
+			if k == nil {
+				continue
+			}
+
+			if ok, err := info.includes(fields); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+
+			b := tx.Bucket(info.bucket)
+			if b == nil {
+				return NO_INDEX
+			}
+
+			if ik, _ := b.Cursor().Seek(k); bytes.Equal(ik, k) {
+				keys[index] = k
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+//
+// put the record in all indices, within the specified transaction.
+//
+// AUTOINCREMENT fields are resolved on a copy of the field list (see resolve), so that the other changes
+// made to store the record don't modify the input record.
+//
+func (t *Table) put(tx *bolt.Tx, rec DataRecord) (uint64, error) {
+	return t.putRecord(tx, rec, Replace, true)
+}
+
+//
+// add a record to the table, applying the conflict policy if a record with the same key exists.
+//
+// For the Ignore policy, errRollback is returned with the key of the existing record
+//
+func (t *Table) putWith(tx *bolt.Tx, rec DataRecord, policy ConflictPolicy) (uint64, error) {
+	return t.putRecord(tx, rec, policy, true)
+}
+
+//
+// put a record copied from another table or database (i.e. by ApplyChanges or ReplicateTo),
+// keeping its last-modified field
+//
+func (t *Table) replay(tx *bolt.Tx, rec DataRecord) (uint64, error) {
+	return t.putRecord(tx, rec, Replace, false)
+}
+
+//
+// add a record to the table, as putWith, setting the last-modified field (if any) if stamp is true
+//
+func (t *Table) putRecord(tx *bolt.Tx, rec DataRecord, policy ConflictPolicy, stamp bool) (uint64, error) {
+	b := tx.Bucket(schema(t.name))
+	if b == nil {
+		return 0, NO_TABLE
+	}
+
+	if t.strict {
+		if err := t.validate(rec); err != nil {
+			return 0, err
+		}
+	}
+
+	fields, key, primary, err := t.resolve(b, rec, stamp)
+	if err != nil {
+		return 0, err
+	}
+
+	if policy != Replace {
+		existing, err := t.existing(tx, b, primary, fields)
+		if err != nil {
+			return 0, err
+		}
+
+		if existing != nil {
+			if policy == Fail {
+				return 0, DUPLICATE_KEY
+			}
+
+			key = 0
+			if primary != nil {
+				key, _ = primary.primaryID(existing)
+			}
+
+			return key, errRollback
+		}
+	}
+
+	if primary != nil {
+		if key, err = t.putPrimary(tx, b, *primary, fields); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := t.putEntries(tx, fields); err != nil {
+		return 0, err
+	}
+
+	return key, t.changed(tx, ChangePut, fields)
+}
+
+//
+// Check that the record has all the fields used by the table indices (i.e. that ToFieldList returns
+// at least as many fields as the highest indexed position).
+//
+// Returns BAD_VALUES if the record is too short
+//
+func (t *Table) ValidateRecord(rec DataRecord) (err error) {
+	defer t.wrapError("ValidateRecord", "", &err)
+
+	return t.validate(rec)
+}
+
+//
+// check the record as ValidateRecord (without wrapping the error, for the methods that add records)
+//
+func (t *Table) validate(rec DataRecord) error {
+	if isNil(rec) {
+		return BAD_VALUES
+	}
+
+	n := uint(len(rec.ToFieldList()))
+
+	for _, info := range t.indices {
+		for _, ip := range info.iplist {
+			if ip.field >= n {
+				return BAD_VALUES
+			}
+		}
+	}
+
+	return nil
+}
+
+//
+// Enable or disable strict mode: in strict mode, Put (and the other methods that add records)
+// validate the records with ValidateRecord, so that records with missing indexed fields are rejected
+// instead of being indexed with nil keys.
+//
+// Strict mode also checks the records read from the indices before updating the other indices
+// (i.e. in Delete, for records written before strict mode was enabled): a record without some of the key fields
+// of an index returns BAD_VALUES (with the position of the missing field) instead of removing the wrong entry.
+//
+// This should be called before the Table is used, since it's not synchronized with running operations.
+//
+func (t *Table) Strict(on bool) {
+	t.strict = on
+}
+
+//
+// check that the fields include all the key fields of the index
+// (returns BAD_VALUES, with the position of the first missing field, if they don't)
+//
+func (info indexinfo) checkFields(fields []interface{}) error {
+	for _, ip := range info.iplist {
+		if ip.field >= uint(len(fields)) {
+			return fmt.Errorf("%w: missing key field %v", BAD_VALUES, ip.field)
+		}
+	}
+
+	return nil
+}
+
+//
+// return the existing record with the same primary key or the same key in any index as the input fields
+// (nil if there is none)
+//
+func (t *Table) existing(tx *bolt.Tx, b *bolt.Bucket, primary *indexinfo, fields []interface{}) ([]interface{}, error) {
+	if primary != nil {
+		if data := b.Bucket(dataName); data != nil {
+			k, _, err := primary.marshalKeyValue(fields)
+			if err != nil {
+				return nil, err
+			}
+
+			if v := data.Get(k); v != nil {
+				return t.decode(*primary, k, v)
+			}
+		}
+	}
+
+	for _, info := range t.indices {
+		ib := tx.Bucket(info.bucket)
+		if ib == nil || !info.complete() {
+			continue
+		}
+
+		k, _, err := info.marshalKeyValue(fields)
+		if err != nil {
+			return nil, err
+		}
+
+		if k == nil {
+			continue
+		}
+
+		if v := ib.Get(k); v != nil {
+			return t.decode(info, k, v)
+		}
+	}
+
+	return nil, nil
+}
+
+//
+// the sequences of the AUTOINCREMENT fields after the first one are stored in the table metadata
+// as "_seq/<position>"
+//
+const seqMeta = "_seq/"
+
+//
+// return the next value for an AUTOINCREMENT field: the first AUTOINCREMENT field of a record uses
+// the table sequence (see CurrentSequence) and the others have independent sequences, one per field position
+//
+func nextSequence(b *bolt.Bucket, pos int, first bool) (uint64, error) {
+	if first {
+		return b.NextSequence()
+	}
+
+	key := fmt.Sprintf("%v%v", seqMeta, pos)
+
+	seq, _ := getMeta(b, key).(uint64)
+	seq++
+
+	return seq, putMeta(b, key, seq)
+}
+
+//
+// raise the table sequence to seq, if it's lower (i.e. after copying records with their primary keys,
+// so that the next AUTOINCREMENT values don't reuse them)
+//
+func raiseSequence(b *bolt.Bucket, seq uint64) error {
+	if b.Sequence() >= seq {
+		return nil
+	}
+
+	return b.SetSequence(seq)
+}
+
+//
+// return a copy of the record fields with the AUTOINCREMENT fields resolved,
+// the value of the first AUTOINCREMENT field and the primary storage info (nil if the table has no primary storage).
+// If stamp is true the last-modified field (see SetUpdatedField) is set to the current time.
+//
+// The AUTOINCREMENT values are also written back to the record fields (see Put), while the other changes
+// (i.e. the time and external fields) are only made to the copy
+//
+// The sequences are advanced in the transaction, so they are restored if the put fails and the transaction is rolled back
+//
+func (t *Table) resolve(b *bolt.Bucket, rec DataRecord, stamp bool) (fields []interface{}, key uint64, primary *indexinfo, err error) {
+	orig := rec.ToFieldList()
+	fields = append([]interface{}{}, orig...)
+
+	auto := -1
+
+	for i := range fields {
+		if isAutoIncrement(fields[i]) {
+			seq, err := nextSequence(b, i, auto < 0)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+
+			if key == 0 {
+				key = seq
+				auto = i
+			}
+
+			fields[i] = seq
+			orig[i] = seq
+		}
+	}
+
+	if stamp {
+		stampUpdated(b, fields)
+	}
+
+	if err := t.storeTimeFields(b, fields); err != nil {
+		return nil, 0, nil, err
+	}
+
+	for _, info := range t.indices {
+		for _, ip := range info.iplist {
+			if ip.field < uint(len(fields)) && isNested(fields[ip.field]) {
+				return nil, 0, nil, NESTED_KEY
+			}
+		}
+	}
+
+	if primary, err = t.enablePrimary(b, auto); err != nil {
+		return nil, 0, nil, err
+	}
+
+	return fields, key, primary, nil
+}
+
+//
+// add the record entries to all indices
+//
+func (t *Table) putEntries(tx *bolt.Tx, fields []interface{}) error {
+	for index, info := range t.indices {
+		ib := tx.Bucket(info.bucket)
+		if ib == nil {
+			return NO_TABLE
+		}
+
+		if t.strict {
+			if err := info.checkFields(fields); err != nil {
+				return err
+			}
+		}
+
+		k, v, err := info.marshalKeyValue(fields)
+		if err != nil {
+			return err
+		}
+
+		if k == nil {
+			continue
+		}
+
+		// the previous entry with the same key (if any) is replaced
+		if err := t.countEntry(tx, index, info, k, ib.Get(k), -1); err != nil {
+			return err
+		}
+
+		if ok, err := info.includes(fields); err != nil {
+			return err
+		} else if !ok {
+			// remove the entry, in case the record was in the index before this update
+			if err := ib.Delete(k); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if t.maxValue > 0 && len(v) > t.maxValue {
+			return VALUE_TOO_LARGE
+		}
+
+		if v, err = t.sealValue(v); err != nil {
+			return err
+		}
+
+		if err := ib.Put(k, v); err != nil {
+			return err
+		}
+
+		if err := t.countFields(tx, index, info, fields, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// store the full record in the primary bucket, keyed by its primary key.
+//
+// If a record with the same primary key already exists, its index entries are removed
+// (so that an update that changes the indexed fields doesn't leave stale entries).
+//
+// The primary key field is converted to uint64, as returned by AUTOINCREMENT
+//
+func (t *Table) putPrimary(tx *bolt.Tx, b *bolt.Bucket, primary indexinfo, fields []interface{}) (uint64, error) {
+	id, err := primary.primaryID(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := t.storeBlobs(b, id, fields); err != nil {
+		return 0, err
+	}
+
+	data, err := b.CreateBucketIfNotExists(dataName)
+	if err != nil {
+		return 0, err
+	}
+
+	k, v, err := primary.marshalKeyValue(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.maxValue > 0 && len(v) > t.maxValue {
+		return 0, VALUE_TOO_LARGE
+	}
+
+	if prev := data.Get(k); prev != nil {
+		pfields, err := t.decode(primary, k, prev)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := t.deleteEntries(tx, pfields, ""); err != nil {
+			return 0, err
+		}
+	}
+
+	if v, err = t.sealValue(v); err != nil {
+		return 0, err
+	}
+
+	return id, data.Put(k, v)
+}
+
+//
+// convert the primary key field (in place) to uint64 and return its value
+//
+func (primary indexinfo) primaryID(fields []interface{}) (uint64, error) {
+	pos := primary.iplist[0].field
+	if pos >= uint(len(fields)) {
+		return 0, BAD_VALUES
+	}
+
+	id, ok := toUint64(fields[pos])
+	if !ok {
+		return 0, BAD_VALUES
+	}
+
+	fields[pos] = id
+	return id, nil
+}
+
+//
+// remove the record entries from all indices (except the one specified in skip)
+//
+func (t *Table) deleteEntries(tx *bolt.Tx, fields []interface{}, skip string) error {
+	for index, info := range t.indices {
+		if index == skip {
+			continue
+		}
+
+		b := tx.Bucket(info.bucket)
+		if b == nil {
+			continue
+		}
+
+		if t.strict {
+			if err := info.checkFields(fields); err != nil {
+				return err
+			}
+		}
+
+		dkey, _, err := info.marshalKeyValue(fields)
+		if err != nil {
+			return err
+		}
+
+		if dkey == nil {
+			continue
+		}
+
+		if err := t.countEntry(tx, index, info, dkey, b.Get(dkey), -1); err != nil {
+			return err
+		}
+
+		if err := b.Delete(dkey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// remove the record from the primary bucket (if the table has primary storage)
+//
+func deletePrimary(b *bolt.Bucket, fields []interface{}) error {
+	if b == nil {
+		return nil
+	}
+
+	primary, err := primaryIndex(b)
+	if primary == nil || err != nil {
+		return err
+	}
+
+	data := b.Bucket(dataName)
+	if data == nil {
+		return nil
+	}
+
+	pos := primary.iplist[0].field
+	if pos >= uint(len(fields)) {
+		return nil
+	}
+
+	id, ok := toUint64(fields[pos])
+	if !ok {
+		return nil
+	}
+
+	if err := deleteBlobs(b, id); err != nil {
+		return err
+	}
+
+	return data.Delete(primaryKey(id))
+}
+
+//
+// Replace all the records of the table with the input records, in a single transaction,
+// so that readers see either the old or the new records, never a partially loaded table.
+//
+// All the indices (and the primary storage) are emptied and the new records are added as by Put.
+// The table sequence is not reset, so the new AUTOINCREMENT values don't reuse the old ones.
+//
+func (t *Table) ReplaceAll(recs []DataRecord) (err error) {
+	defer t.wrapError("ReplaceAll", "", &err)
+
+	db := t.d.db
+
+	for _, rec := range recs {
+		if isNil(rec) {
+			return BAD_VALUES
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		if err := t.clear(tx, b); err != nil {
+			return err
+		}
+
+		// removing the old records is also a change
+		if err := t.changed(tx, ChangeClear, nil); err != nil {
+			return err
+		}
+
+		for _, rec := range recs {
+			if _, err := t.put(tx, rec); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//
+// remove all the records of the table: the primary storage (and external fields) and the index entries
+//
+func (t *Table) clear(tx *bolt.Tx, b *bolt.Bucket) error {
+	for _, name := range [][]byte{dataName, blobName} {
+		if b.Bucket(name) != nil {
+			if err := b.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for index, info := range t.indices {
+		if err := tx.DeleteBucket(info.bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		if _, err := tx.CreateBucket(info.bucket); err != nil {
+			return err
+		}
+
+		if err := clearCounts(b, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Reassign the primary keys of a table with primary storage, so that they are contiguous (from 1)
+// after some records were deleted, keeping the records in the same order.
+//
+// This is a maintenance operation that rewrites the whole table (primary storage and all indices)
+// in a single transaction, so it can take some time and memory for large tables.
+// The table sequence is set to the number of records, so that the next AUTOINCREMENT value follows the last key.
+//
+// Returns the mapping from the old to the new keys (for all the records), so that the callers can
+// fix the external references, or BAD_VALUES if the table has no primary storage
+//
+func (t *Table) RenumberKeys() (keys map[uint64]uint64, err error) {
+	defer t.wrapError("RenumberKeys", "", &err)
+
+	db := t.d.db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(b)
+		if err != nil {
+			return err
+		}
+
+		if primary == nil {
+			return BAD_VALUES
+		}
+
+		var records [][]interface{}
+
+		// the external fields are keyed by primary key, so they are moved to the new keys
+		blobs := map[uint64]map[int][]byte{}
+
+		if data := b.Bucket(dataName); data != nil {
+			if err := data.ForEach(func(k, v []byte) error {
+				fields, err := t.decode(*primary, k, v)
+				if err != nil {
+					return err
+				}
+
+				records = append(records, fields)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if bb := b.Bucket(blobName); bb != nil {
+			for _, fields := range records {
+				id, err := primary.primaryID(fields)
+				if err != nil {
+					return err
+				}
+
+				for pos := range t.blobs {
+					if v := bb.Get(blobKey(id, pos)); v != nil {
+						if blobs[id] == nil {
+							blobs[id] = map[int][]byte{}
+						}
+
+						blobs[id][pos] = append([]byte{}, v...)
+					}
+				}
+			}
+		}
+
+		if err := t.clear(tx, b); err != nil {
+			return err
+		}
+
+		if err := t.changed(tx, ChangeClear, nil); err != nil {
+			return err
+		}
+
+		keys = make(map[uint64]uint64, len(records))
+
+		pos := primary.iplist[0].field
+
+		for i, fields := range records {
+			old, err := primary.primaryID(fields)
+			if err != nil {
+				return err
+			}
+
+			id := uint64(i + 1)
+			keys[old] = id
+			fields[pos] = id
+
+			if err := t.storeTimeFields(b, fields); err != nil {
+				return err
+			}
+
+			if _, err := t.putPrimary(tx, b, *primary, fields); err != nil {
+				return err
+			}
+
+			if err := t.putEntries(tx, fields); err != nil {
+				return err
+			}
+
+			if err := t.changed(tx, ChangePut, fields); err != nil {
+				return err
+			}
+
+			if len(blobs[old]) > 0 {
+				bb, err := b.CreateBucketIfNotExists(blobName)
+				if err != nil {
+					return err
+				}
+
+				for pos, v := range blobs[old] {
+					if err := bb.Put(blobKey(id, pos), v); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return b.SetSequence(uint64(len(records)))
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// number of records written in a single transaction by BulkLoad
+const bulkChunk = 1000
+
+//
+// Load all the records from the input channel, until the channel is closed.
+//
+// The records are read in chunks and each chunk is written to the primary storage only, in a single transaction.
+// The indices are rebuilt at the end, in a single pass over the primary storage. This is faster than calling Put
+// for each record, but the new records are not available via the indices until the load is complete.
+//
+// The load is not atomic: if it fails, the chunks already committed stay in the table (and are indexed
+// before returning) and the returned count is the number of records they contain, so that the load
+// can be resumed from the next record. The channel is not drained: the caller must stop the producer.
+//
+// Only tables with primary storage (i.e. with an AUTOINCREMENT field) can be bulk loaded.
+//
+// Returns the number of records loaded
+//
+func (t *Table) BulkLoad(recs <-chan DataRecord) (loaded int, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("BulkLoad", "", &err)
+
+	db := t.d.db
+
+	span := t.startSpan("BulkLoad")
+
+	for done := false; !done && err == nil; {
+		var chunk []DataRecord
+
+		for len(chunk) < bulkChunk {
+			rec, ok := <-recs
+			if !ok {
+				done = true
+				break
+			}
+
+			if isNil(rec) {
+				err = BAD_VALUES
+				break
+			}
+
+			chunk = append(chunk, rec)
+		}
+
+		if err != nil || len(chunk) == 0 {
+			break
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(schema(t.name))
+			if b == nil {
+				return NO_TABLE
+			}
+
+			for _, rec := range chunk {
+				if t.strict {
+					if err := t.validate(rec); err != nil {
+						return err
+					}
+				}
+
+				fields, _, primary, err := t.resolve(b, rec, true)
+				if err != nil {
+					return err
+				}
+
+				if primary == nil {
+					return BAD_VALUES
+				}
+
+				// the entries of a replaced record are removed by putPrimary
+				if _, err := t.putPrimary(tx, b, *primary, fields); err != nil {
+					return err
+				}
+
+				if err := t.changed(tx, ChangePut, fields); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			loaded += len(chunk)
+		}
+	}
+
+	if loaded > 0 {
+		// index the committed records (the load error, if any, takes precedence)
+		ierr := db.Update(func(tx *bolt.Tx) error {
+			t.d.invalidate(tx)
+
+			b := tx.Bucket(schema(t.name))
+			if b == nil {
+				return NO_TABLE
+			}
+
+			for index, info := range t.indices {
+				if err := t.rebuildIndex(tx, b, index, info, false); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			err = ierr
+		}
+	}
+
+	endSpan(span, loaded, err)
+
+	return loaded, err
+}
+
+//
+// Get a record from the table, given its primary key (the value returned by Put for tables with an AUTOINCREMENT field)
+//
+// Returns NO_KEY if the record doesn't exist
+//
+func (t *Table) GetKey(key uint64, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetKey", "", &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Get")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(b)
+		if err != nil {
+			return err
+		}
+
+		data := b.Bucket(dataName)
+		if primary == nil || data == nil {
+			return NO_KEY
+		}
+
+		k := primaryKey(key)
+
+		v := data.Get(k)
+		if v == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decodeRecord(tx, *primary, k, v)
+		if err != nil {
+			return err
+		}
+
+		res.FromFieldList(fields)
+		n = 1
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get many records from the table, given their primary keys (i.e. the ids returned by a search), in a single transaction.
+//
+// The records are returned in the same order as the keys, with nil for the keys that don't exist.
+// Each record is allocated by calling newRecord, so the returned records don't share any data
+//
+func (t *Table) GetKeys(keys []uint64, newRecord func() DataRecord) (recs []DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetKeys", "", &err)
+
+	if newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Get")
+	n := 0
+
+	recs = make([]DataRecord, len(keys))
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(b)
+		if err != nil {
+			return err
+		}
+
+		data := b.Bucket(dataName)
+		if primary == nil || data == nil {
+			return nil
+		}
+
+		for i, key := range keys {
+			k := primaryKey(key)
+
+			v := data.Get(k)
+			if v == nil {
+				continue
+			}
+
+			fields, err := t.decodeRecord(tx, *primary, k, v)
+			if err != nil {
+				return err
+			}
+
+			recs[i] = newRecord()
+			recs[i].FromFieldList(fields)
+			n++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		recs = nil
+	}
+
+	endSpan(span, n, err)
+	return recs, err
+}
+
+//
+// Delete a record from the table, given its primary key (the value returned by Put for tables with an AUTOINCREMENT field).
+// The record is removed from the primary storage and from all indices.
+//
+// Returns NO_KEY if the record doesn't exist
+//
+func (t *Table) DeleteKey(key uint64) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveDelete, time.Now(), &err)
+	}
+
+	defer t.wrapError("DeleteKey", "", &err)
+
+	db := t.d.db
+
+	span := t.startSpan("Delete")
+	n := 0
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(b)
+		if err != nil {
+			return err
+		}
+
+		data := b.Bucket(dataName)
+		if primary == nil || data == nil {
+			return NO_KEY
+		}
+
+		k := primaryKey(key)
+
+		v := data.Get(k)
+		if v == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decode(*primary, k, v)
+		if err != nil {
+			return err
+		}
+
+		if err := t.deleteEntries(tx, fields, ""); err != nil {
+			return err
+		}
+
+		if err := data.Delete(k); err != nil {
+			return err
+		}
+
+		if err := deleteBlobs(b, key); err != nil {
+			return err
+		}
+
+		n = 1
+		return t.changed(tx, ChangeDelete, fields)
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get a record from the table, given the index and the key
+//
+func (t *Table) Get(index string, key, res DataRecord) error {
+	return t.GetContext(context.Background(), index, key, res)
+}
+
+//
+// Get a record from the table, as Get, starting the span of the operation (see WithTracer) from ctx
+//
+func (t *Table) GetContext(ctx context.Context, index string, key, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("Get", index, &err)
+
+	if isNil(key) || isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpanContext(ctx, "Get")
+	n := 0
+
+	if c := t.d.loadCache(); c != nil && len(t.blobs) == 0 {
+		err = t.cachedGet(c, index, key, res)
+	} else {
+		err = db.View(func(tx *bolt.Tx) error {
+			return t.get(tx, index, key, res)
+		})
+	}
+
+	if err == nil {
+		n = 1
+	}
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// get a record given the index and the key, in the transaction
+//
+func (t *Table) get(tx *bolt.Tx, index string, key, res DataRecord) error {
+	b := t.indexBucket(tx, index)
+	if b == nil {
+		return NO_INDEX
+	}
+
+	c := b.Cursor()
+
+	info := t.indices[index]
+
+	sk, _, err := info.marshalKeyValue(key.ToFieldList())
+	if err != nil {
+		return err
+	}
+
+	if sk == nil {
+		return NO_KEY
+	}
+
+	resk, resv := c.Seek(sk)
+	if !bytes.Equal(sk, resk) {
+		return NO_KEY
+	}
+
+	fields, err := t.decodeRecord(tx, info, resk, resv)
+	if err != nil {
+		return err
+	}
+
+	res.FromFieldList(fields)
+	return nil
+}
+
+//
+// Get a record from the table given the index and the key, as Get, but reading the full record from
+// the primary storage (using the primary key found in the index entry), for tables with an AUTOINCREMENT field.
+//
+// The index entries currently contain the full records, so this is the same as Get for tables without
+// primary storage, but it always returns the authoritative version of the record (the primary storage one)
+// and keeps working if the indices are changed to only store the key fields and the primary key.
+//
+// Returns NO_KEY if the key is not in the index (or the record is not in the primary storage)
+//
+func (t *Table) GetViaIndex(index string, key, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetViaIndex", index, &err)
+
+	if isNil(key) || isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Get")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		sk, _, err := info.marshalKeyValue(key.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if sk == nil {
+			return NO_KEY
+		}
+
+		v := b.Get(sk)
+		if v == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decode(info, sk, v)
+		if err != nil {
+			return err
+		}
+
+		sb := tx.Bucket(schema(t.name))
+		if sb == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(sb)
+		if err != nil {
+			return err
+		}
+
+		if data := sb.Bucket(dataName); primary != nil && data != nil {
+			id, err := primary.primaryID(fields)
+			if err != nil {
+				return err
+			}
+
+			k := primaryKey(id)
+
+			v := data.Get(k)
+			if v == nil {
+				return NO_KEY
+			}
+
+			if fields, err = t.decode(*primary, k, v); err != nil {
+				return err
+			}
+		}
+
+		if err := t.loadBlobs(tx, fields); err != nil {
+			return err
+		}
+
+		res.FromFieldList(fields)
+		n = 1
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get the first record (in index order) matching a partial key, where only the leading key fields are set
+// (i.e. given an index on user and date, the first record for a user).
+//
+// Returns NO_KEY if there are no matching records, or BAD_VALUES if the first key field is not set
+//
+func (t *Table) GetBy(index string, partialKey, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetBy", index, &err)
+
+	if isNil(partialKey) || isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Get")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		pk, err := info.marshalPrefix(partialKey.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if pk == nil {
+			return BAD_VALUES
+		}
+
+		// since the prefix sorts before all the keys that start with it,
+		// Seek returns the first matching record (if any)
+
+		k, v := b.Cursor().Seek(pk)
+		if k == nil || !bytes.HasPrefix(k, pk) {
+			return NO_KEY
+		}
+
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return err
+		}
+
+		res.FromFieldList(fields)
+		n = 1
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get the record with the nearest key in the specified direction:
+// if direction < 0 the record with the greatest key less than or equal to the input key,
+// if direction > 0 the record with the lowest key greater than or equal to the input key.
+//
+// Returns NO_KEY if there are no records in the requested direction
+//
+func (t *Table) GetNearest(index string, key, res DataRecord, direction int) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetNearest", index, &err)
+
+	if isNil(key) || isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	if direction == 0 {
+		return BAD_VALUES
+	}
+
+	span := t.startSpan("Get")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		sk, _, err := info.marshalKeyValue(key.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if sk == nil {
+			return NO_KEY
+		}
+
+		c := b.Cursor()
+
+		k, v := c.Seek(sk)
+
+		if direction < 0 && !bytes.Equal(sk, k) {
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		if k == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return err
+		}
+
+		res.FromFieldList(fields)
+		n = 1
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get the first record in the index (the one with the lowest key).
+// Returns NO_KEY if the index is empty
+//
+func (t *Table) First(index string, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("First", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	return t.edge(index, false, res)
+}
+
+//
+// Get the last record in the index (the one with the highest key).
+// Returns NO_KEY if the index is empty
+//
+func (t *Table) Last(index string, res DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("Last", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	return t.edge(index, true, res)
+}
+
+//
+// Return the record with the lowest key in the index (as First), allocated by calling newRecord
+// (i.e. for the earliest timestamp, in an index on time).
+// Returns NO_KEY if the index is empty
+//
+func (t *Table) MinKey(index string, newRecord func() DataRecord) (rec DataRecord, err error) {
+	return t.edgeRecord("MinKey", index, false, newRecord)
+}
+
+//
+// Return the record with the highest key in the index (as Last), allocated by calling newRecord.
+// Returns NO_KEY if the index is empty
+//
+func (t *Table) MaxKey(index string, newRecord func() DataRecord) (rec DataRecord, err error) {
+	return t.edgeRecord("MaxKey", index, true, newRecord)
+}
+
+func (t *Table) edgeRecord(op, index string, last bool, newRecord func() DataRecord) (rec DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError(op, index, &err)
+
+	if newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	rec = newRecord()
+
+	if err := t.edge(index, last, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (t *Table) edge(index string, last bool, res DataRecord) error {
+	db := t.d.db
+
+	span := t.startSpan("Get")
+	n := 0
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		var k, v []byte
+
+		if last {
+			k, v = b.Cursor().Last()
+		} else {
+			k, v = b.Cursor().First()
+		}
+
+		if k == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decodeRecord(tx, t.indices[index], k, v)
+		if err != nil {
+			return err
+		}
+
+		res.FromFieldList(fields)
+		n = 1
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Update a record from the table, given the index and the key
+//
+/*
+func (t *Table) Update(index string, key, value DataRecord) error {
+	db := t.d.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		sk, _, err := info.marshalKeyValue(key.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if sk == nil {
+			return NO_KEY
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek(sk)
+
+		// Seek will return the next key if there is no match
+		// so make sure we check we got the right record
+
+		if bytes.Equal(sk, k) {
+                        updateIndex := func(index string) error {
+                            b := tx.Bucket(indices(index))
+                            if b == nil {
+                                    return NO_INDEX
+                            }
+
+                            info := t.indices[index]
+
+                            vk, vv, err := info.marshalKeyValue(value.ToFieldList())
+                            if err != nil {
+                                    return err
+                            }
+
+                            if vk != nil && !bytes.Equal(vk, sk) {
+                                 if err := c.Delete(); err != nil {
+                                    return err
+                                 }
+                            }
+
+                            if err := b.Put(vk, vv); err != nil {
+                                return err
+                            }
+                        }
+
+                        if err := updateIndex(index); err != nil {
+                            return err
+                        }
+
+			fields, err := info.unmarshalKeyValue(k, v)
+			if err != nil {
+				return err
+			}
+
+			for i, info := range t.indices {
+				if i == index {
+					// already done
+					continue
+				}
+
+				b := tx.Bucket(indices(i))
+				if b == nil {
+					continue
+				}
+
+                                if err := updateIndex(b, indices(i)); err != nil {
+                                    return err
+                                }
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+*/
+
+//
+// Atomically add delta to a numeric field of a record, given the index and the key, and return the new value.
+//
+// The record is read and written back (to all the indices and to the primary storage) in a single transaction,
+// so concurrent increments of the same field are never lost.
+//
+// Returns NO_KEY if the record doesn't exist and BAD_VALUES if the field is missing or is not a signed integer
+//
+func (t *Table) IncrField(index string, key DataRecord, field uint, delta int64) (value int64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
+
+	defer t.wrapError("IncrField", index, &err)
+
+	if isNil(key) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Put")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+		if !info.complete() {
+			return BAD_VALUES
+		}
+
+		sk, _, err := info.marshalKeyValue(key.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if sk == nil {
+			return NO_KEY
+		}
+
+		v := b.Get(sk)
+		if v == nil {
+			return NO_KEY
+		}
+
+		fields, err := t.decode(info, sk, v)
+		if err != nil {
+			return err
+		}
+
+		if field >= uint(len(fields)) {
+			return BAD_VALUES
+		}
+
+		switch n := fields[field].(type) {
+		case int, int8, int16, int32, int64:
+			value = normalizeKey(n).(int64) + delta
+		default:
+			return BAD_VALUES
+		}
+
+		// the field may be indexed, so the old entries are removed before adding the updated record
+		if err := t.deleteEntries(tx, fields, ""); err != nil {
+			return err
+		}
+
+		updated := fieldList(fields)
+		updated[field] = value
+
+		_, err = t.put(tx, &updated)
+		return err
+	})
+
+	if err != nil {
+		value = 0
+	}
+
+	endSpan(span, 1, err)
+	return value, err
+}
+
+//
+// Delete a record from the table, given the index and the key
+//
+func (t *Table) Delete(index string, key DataRecord) error {
+	return t.DeleteContext(context.Background(), index, key)
+}
+
+//
+// Delete a record from the table, as Delete, starting the span of the operation (see WithTracer) from ctx
+//
+func (t *Table) DeleteContext(ctx context.Context, index string, key DataRecord) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveDelete, time.Now(), &err)
+	}
+
+	defer t.wrapError("Delete", index, &err)
+
+	if isNil(key) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpanContext(ctx, "Delete")
+	n := 0
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		n, err = t.delete(tx, index, key)
+		return
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// delete the record with the specified key in the transaction (see Delete).
+//
+// Returns the number of deleted records (0 or 1)
+//
+func (t *Table) delete(tx *bolt.Tx, index string, key DataRecord) (int, error) {
+	b := t.indexBucket(tx, index)
+	if b == nil {
+		return 0, NO_INDEX
+	}
+
+	info := t.indices[index]
+	if !info.complete() {
+		return 0, BAD_VALUES
+	}
+
+	sk, _, err := info.marshalKeyValue(key.ToFieldList())
+	if err != nil {
+		return 0, err
+	}
+
+	if sk == nil {
+		return 0, NO_KEY
+	}
+
+	c := b.Cursor()
+	k, v := c.Seek(sk)
+
+	// Seek will return the next key if there is no match
+	// so make sure we check we got the right record
+
+	if !bytes.Equal(sk, k) {
+		return 0, nil
+	}
+
+	fields, err := t.decode(info, k, v)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Delete(); err != nil {
+		return 0, err
+	}
+
+	if err := t.countFields(tx, index, info, fields, -1); err != nil {
+		return 0, err
+	}
+
+	key.FromFieldList(fields) // update key with full record
+
+	if err := t.deleteEntries(tx, fields, index); err != nil {
+		return 0, err
+	}
+
+	if err := deletePrimary(tx.Bucket(schema(t.name)), fields); err != nil {
+		return 0, err
+	}
+
+	return 1, t.changed(tx, ChangeDelete, fields)
+}
+
+//
+// Delete all the records with a key starting with the specified prefix, given as a record
+// where only the leading key fields are set (i.e. all records for a tenant, in an index on tenant and id).
+// The records are also removed from all other indices and from the primary storage.
+//
+// Returns the number of deleted records, or BAD_VALUES if the first key field is not set
+//
+func (t *Table) DeletePrefix(index string, prefix DataRecord) (count int, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveDelete, time.Now(), &err)
+	}
+
+	defer t.wrapError("DeletePrefix", index, &err)
+
+	if isNil(prefix) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Delete")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+		if !info.complete() {
+			return BAD_VALUES
+		}
+
+		pk, err := info.marshalPrefix(prefix.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if pk == nil {
+			return BAD_VALUES
+		}
+
+		// collect the matching records first, since deleting while iterating
+		// with a bolt cursor may skip entries
+
+		var keys [][]byte
+		var records [][]interface{}
+
+		c := b.Cursor()
+
+		for k, v := c.Seek(pk); k != nil && bytes.HasPrefix(k, pk); k, v = c.Next() {
+			fields, err := t.decode(info, k, v)
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, append([]byte{}, k...))
+			records = append(records, fields)
+		}
+
+		sb := tx.Bucket(schema(t.name))
+
+		for i, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+
+			if err := t.countFields(tx, index, info, records[i], -1); err != nil {
+				return err
+			}
+
+			if err := t.deleteEntries(tx, records[i], index); err != nil {
+				return err
+			}
+
+			if err := deletePrimary(sb, records[i]); err != nil {
+				return err
+			}
+
+			if err := t.changed(tx, ChangeDelete, records[i]); err != nil {
+				return err
+			}
+		}
+
+		count = len(keys)
+		return nil
+	})
+
+	if err != nil {
+		count = 0
+	}
+
+	endSpan(span, count, err)
+	return count, err
+}
+
+//
+// Get all records sorted by index keys (ascending or descending)
+// Call user function with record content or error
+//
+func (t *Table) Scan(index string, ascending bool, start, res DataRecord, callback func(DataRecord, error) bool) error {
+	return t.ScanContext(context.Background(), index, ascending, start, res, callback)
+}
+
+//
+// Get all records sorted by index keys, as Scan, starting the span of the operation (see WithTracer) from ctx
+//
+func (t *Table) ScanContext(ctx context.Context, index string, ascending bool, start, res DataRecord, callback func(DataRecord, error) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Scan", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	return t.iterateContext(ctx, index, ascending, start, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		res.FromFieldList(fields)
+		return callback(res, nil), nil
+	})
+}
+
+// number of records visited between two calls to the progress function of ScanProgress
+const progressRows = 1000
+
+//
+// Get all records sorted by index keys (ascending or descending) as Scan, also calling onProgress (if not nil)
+// with the number of records visited so far, every 1000 records and once more at the end of the scan.
+//
+func (t *Table) ScanProgress(index string, ascending bool, start, res DataRecord, onRow func(DataRecord, error) bool, onProgress func(seen int)) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanProgress", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	seen := 0
+
+	err = t.iterate(index, ascending, start, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		seen++
+
+		res.FromFieldList(fields)
+		cont := onRow(res, nil)
+
+		if onProgress != nil && seen%progressRows == 0 {
+			onProgress(seen)
+		}
+
+		return cont, nil
+	})
+
+	if err == nil && onProgress != nil && seen%progressRows != 0 {
+		onProgress(seen)
+	}
+
+	return err
+}
+
+//
+// Get all records sorted by index keys (ascending or descending), as Scan, but calling the user function
+// with the list of decoded fields instead of filling a DataRecord.
+//
+// Each call receives a newly allocated list, that the callback can retain.
+//
+func (t *Table) ScanFields(index string, ascending bool, start DataRecord, callback func(fields []interface{}, err error) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanFields", index, &err)
+
+	return t.iterate(index, ascending, start, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decode(info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		return callback(fields, nil), nil
+	})
+}
+
+//
+// Scan all records sorted by index keys (ascending or descending) as ScanFields, but reusing the same
+// list of fields for all the records (and for other scans, via a pool of buffers).
+//
+// This avoids allocating a new list for each record (for records with 20 fields, Benchmark_ScanFieldsReuse
+// allocates about 25% less memory than Benchmark_ScanFields), but the list is only valid until the callback
+// returns: a callback that needs to keep the fields should copy them.
+//
+func (t *Table) ScanFieldsReuse(index string, ascending bool, start DataRecord, callback func(fields []interface{}) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanFieldsReuse", index, &err)
+
+	buf := decodePool.Get().(*[]interface{})
+
+	defer func() {
+		// don't keep references to the decoded values
+		clear(*buf)
+		decodePool.Put(buf)
+	}()
+
+	return t.iterate(index, ascending, start, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeInto(*buf, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		*buf = fields
+		return callback(fields), nil
+	})
+}
+
+//
+// Scan all the keys of an index (ascending or descending), calling the user function with the decoded key fields
+// (in the order specified when creating the index).
+//
+// Values are not decoded, so this is faster than Scan when only the indexed fields are needed
+//
+func (t *Table) ScanKeys(index string, ascending bool, callback func(key []interface{}) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanKeys", index, &err)
+
+	return t.iterate(index, ascending, nil, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		key, err := info.decodeKey(k)
+		if err != nil {
+			return false, err
+		}
+
+		return callback(key), nil
+	})
+}
+
+//
+// Return all the keys of an index (in ascending order), each decoded into the list of key fields
+// (in the order specified when creating the index).
+//
+// All the keys are loaded in memory, so for large indices ScanKeys should be used instead
+// (to process the keys one at a time).
+//
+func (t *Table) Keys(index string) (keys [][]interface{}, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Keys", index, &err)
+
+	err = t.iterate(index, true, nil, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		key, err := info.decodeKey(k)
+		if err != nil {
+			return false, err
+		}
+
+		keys = append(keys, key)
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+//
+// Return up to n records sorted by index keys (ascending or descending), starting from start (if not nil) as Scan.
+//
+// Each record is allocated by calling newRecord, so the returned records don't share any data
+//
+func (t *Table) Take(index string, ascending bool, start DataRecord, n int, newRecord func() DataRecord) (recs []DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Take", index, &err)
+
+	if n < 0 || newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
+	err = t.iterate(index, ascending, start, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		rec := newRecord()
+		rec.FromFieldList(fields)
+
+		recs = append(recs, rec)
+		return len(recs) < n, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+//
+// Return all the records in the index, sorted by index keys (ascending).
+//
+// Each record is allocated by calling newRecord, so the returned records don't share any data.
+//
+// All the records are loaded in memory, so this should only be used for small tables
+// (Scan or Take process the records without loading the whole table)
+//
+func (t *Table) GetAll(index string, newRecord func() DataRecord) (recs []DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetAll", index, &err)
+
+	if newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	err = t.iterate(index, true, nil, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		rec := newRecord()
+		rec.FromFieldList(fields)
+
+		recs = append(recs, rec)
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+//
+// Scan all the records of an index in ascending key order, collecting the consecutive records with the same value
+// of groupField (usually the leading key field) in a group, and call onGroup with the group value and the records
+// of each group (when the value changes, and at the end of the scan).
+//
+// Only one group is kept in memory at a time. Each record is allocated by calling newRecord,
+// so the records of a group don't share any data and can be retained by onGroup.
+//
+func (t *Table) ScanGrouped(index string, groupField uint, newRecord func() DataRecord, onGroup func(groupKey interface{}, members []DataRecord)) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanGrouped", index, &err)
+
+	if newRecord == nil || onGroup == nil {
+		return BAD_VALUES
+	}
+
+	var group interface{}
+	var members []DataRecord
+
+	err = t.iterate(index, true, nil, func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error) {
+		fields, err := t.decodeRecord(tx, info, k, v)
+		if err != nil {
+			return false, err
+		}
+
+		var value interface{}
+		if groupField < uint(len(fields)) {
+			value = fields[groupField]
+		}
+
+		if len(members) > 0 && !reflect.DeepEqual(value, group) {
+			onGroup(group, members)
+			members = nil
+		}
+
+		rec := newRecord()
+		rec.FromFieldList(fields)
+
+		group = value
+		members = append(members, rec)
+		return true, nil
+	})
+
+	if err == nil && len(members) > 0 {
+		onGroup(group, members)
+	}
+
+	return err
+}
+
+//
+// Return all the records with a key starting with the specified prefix, given as a record
+// where only the leading key fields are set (i.e. all the orders of a customer, in an index on customer and date),
+// sorted by index keys.
+//
+// Each record is allocated by calling newRecord, so the returned records don't share any data.
+//
+// Returns BAD_VALUES if the first key field is not set
+//
+func (t *Table) GetPrefix(index string, prefix DataRecord, newRecord func() DataRecord) (recs []DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetPrefix", index, &err)
+
+	if isNil(prefix) || newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		pk, err := info.marshalPrefix(prefix.ToFieldList())
+		if err != nil {
+			return err
+		}
+
+		if pk == nil {
+			return BAD_VALUES
+		}
+
+		c := b.Cursor()
+
+		for k, v := c.Seek(pk); k != nil && bytes.HasPrefix(k, pk); k, v = c.Next() {
+			fields, err := t.decodeRecord(tx, info, k, v)
+			if err != nil {
+				return err
+			}
+
+			rec := newRecord()
+			rec.FromFieldList(fields)
+
+			recs = append(recs, rec)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		recs = nil
+	}
+
+	endSpan(span, len(recs), err)
+	return recs, err
+}
+
+//
+// Call the user function for each record with a key starting with any of the prefixes (given as records
+// where only the leading key fields are set, as for GetPrefix), until it returns false.
+// This is useful to read the records of a set of values (i.e. the orders of some customers) in a single scan.
+//
+// The records are visited once (also if the prefixes overlap) in ascending key order, across all the prefixes.
+// The record passed to the user function is res, filled with the record fields.
+//
+// Returns BAD_VALUES if the first key field of a prefix is not set
+//
+func (t *Table) ScanPrefixes(index string, prefixes []DataRecord, res DataRecord, callback func(DataRecord) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanPrefixes", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		keys := make([][]byte, 0, len(prefixes))
+
+		for _, prefix := range prefixes {
+			if isNil(prefix) {
+				return BAD_VALUES
+			}
+
+			pk, err := info.marshalPrefix(prefix.ToFieldList())
+			if err != nil {
+				return err
+			}
+
+			if pk == nil {
+				return BAD_VALUES
+			}
+
+			keys = append(keys, pk)
+		}
+
+		// in key order, a prefix that starts with another prefix only selects records
+		// that are also selected by the shorter one (so it can be skipped)
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+
+		c := b.Cursor()
+
+		var last []byte
+
+		for _, pk := range keys {
+			if last != nil && bytes.HasPrefix(pk, last) {
+				continue
+			}
+
+			last = pk
+
+			for k, v := c.Seek(pk); k != nil && bytes.HasPrefix(k, pk); k, v = c.Next() {
+				fields, err := t.decodeRecord(tx, info, k, v)
+				if err != nil {
+					return err
+				}
+
+				res.FromFieldList(fields)
+				n++
+
+				if !callback(res) {
+					return nil
+				}
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get the records with keys between start and end (inclusive), sorted by index keys, ascending
+// (from start up to end) or descending (from start down to end). A nil start or end means no bound
+// on that side (i.e. from the first or to the last record, in scan order).
+//
+// start and end are records where only the leading key fields need to be set, and all the keys that start
+// with the specified fields are considered in range (i.e. with an index on year and month, start={2020} and end={2021}
+// select all the records for 2020 and 2021, in either direction).
+//
+// Call user function with record content or error, until it returns false
+//
+func (t *Table) Range(index string, ascending bool, start, end, res DataRecord, callback func(DataRecord, error) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Range", index, &err)
+
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		var sk, ek []byte
+		var err error
+
+		if !isNil(start) {
+			if sk, err = info.marshalPrefix(start.ToFieldList()); err != nil {
+				return err
+			}
+		}
+
+		if !isNil(end) {
+			if ek, err = info.marshalPrefix(end.ToFieldList()); err != nil {
+				return err
+			}
+		}
+
+		c := b.Cursor()
+
+		var k, v []byte
+		var next func() ([]byte, []byte)
+		var inRange func(k []byte) bool
+
+		if ascending {
+			if sk == nil {
+				k, v = c.First()
+			} else {
+				k, v = c.Seek(sk)
+			}
+
+			next = c.Next
+			inRange = func(k []byte) bool {
+				return ek == nil || bytes.Compare(k, ek) <= 0 || bytes.HasPrefix(k, ek)
+			}
+		} else {
+			// start from the last key starting with sk: the one before the first key greater than all of them
+			// (or the last key, if there are none)
+
+			if sk == nil {
+				k, v = c.Last()
+			} else if pe := prefixEnd(sk); pe == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(pe); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+
+			next = c.Prev
+			inRange = func(k []byte) bool {
+				// the prefix sorts before all the keys that start with it
+				return ek == nil || bytes.Compare(k, ek) >= 0
+			}
+		}
+
+		for ; k != nil && inRange(k); k, v = next() {
+			n++
+
+			fields, err := t.decodeRecord(tx, info, k, v)
+			if err != nil {
+				return err
+			}
+
+			res.FromFieldList(fields)
+
+			if !callback(res, nil) {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// iterate over the index entries (ascending or descending) starting from the start key (if not nil),
+// calling fn with the raw key and value until it returns false or an error
+//
+func (t *Table) iterate(index string, ascending bool, start DataRecord, fn func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error)) error {
+	return t.iterateContext(context.Background(), index, ascending, start, fn)
+}
+
+//
+// iterate the index, as iterate, starting the span of the scan from ctx
+//
+func (t *Table) iterateContext(ctx context.Context, index string, ascending bool, start DataRecord, fn func(tx *bolt.Tx, info indexinfo, k, v []byte) (bool, error)) error {
+	db := t.d.db
+
+	span := t.startSpanContext(ctx, "Scan")
+	n := 0
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		c := b.Cursor()
+
+		info := t.indices[index]
+
+		var k, v []byte
+
+		positioned := false
+
+		if !isNil(start) {
+			key, _, err := info.marshalKeyValue(start.ToFieldList())
+			if err != nil {
+				return err
+			}
+
+			if key != nil {
+				positioned = true
+
+				k, v = c.Seek(key)
+				if !ascending && !bytes.Equal(key, k) {
+					// if descending and keys don't match we want to start from the first key
+					// in range (previous), that is the last key if start is greater than all keys.
+					// If start is lower than all keys there are no records in range.
+
+					if k == nil {
+						k, v = c.Last()
+					} else {
+						k, v = c.Prev()
+					}
+				}
+			}
+		}
+
+		if !positioned {
+			if ascending {
+				k, v = c.First()
+			} else {
+				k, v = c.Last()
+			}
+		}
+
+		var next func() (key []byte, value []byte)
+
+		if ascending {
+			next = c.Next
+		} else {
+			next = c.Prev
+		}
+
+		for ; k != nil; k, v = next() {
+			n++
+
+			if cont, err := fn(tx, info, k, v); err != nil {
+				return err
+			} else if !cont {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Get up to limit records sorted by index keys (ascending or descending), starting after the position
+// encoded in token (or from the beginning if token is empty). A limit <= 0 means no limit.
+//
+// Returns an opaque token that can be used to resume the scan after the last record returned
+// or an empty token if there are no more records.
+//
+// Since the token is the last key seen (not an offset) pagination is stable
+// even when records are inserted or deleted between calls.
+//
+func (t *Table) ScanFromToken(index string, ascending bool, token string, limit int, res DataRecord, callback func(DataRecord) bool) (nextToken string, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ScanFromToken", index, &err)
+
+	if isNil(res) {
+		return "", BAD_VALUES
+	}
+
+	db := t.d.db
+
+	var last []byte
+
+	if token != "" {
+		if last, err = base64.RawURLEncoding.DecodeString(token); err != nil || len(last) == 0 {
+			return "", BAD_VALUES
+		}
+	}
+
+	span := t.startSpan("Scan")
+	seen := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		c := b.Cursor()
+
+		info := t.indices[index]
+
+		var k, v []byte
+
+		var next func() (key []byte, value []byte)
+
+		if ascending {
+			next = c.Next
+		} else {
+			next = c.Prev
+		}
 
-	var key uint64
+		switch {
+		case last == nil && ascending:
+			k, v = c.First()
 
-	err := db.Update(func(tx *bolt.Tx) (err error) {
-		b := tx.Bucket([]byte(t.name))
-		if b == nil {
-			return NO_TABLE
-		}
+		case last == nil:
+			k, v = c.Last()
 
-		fields := rec.ToFieldList()
+		case ascending:
+			// skip the last key seen
+			if k, v = c.Seek(last); bytes.Equal(k, last) {
+				k, v = c.Next()
+			}
 
-		for i := range fields {
-			if fields[i] == AUTOINCREMENT {
-				fields[i], err = b.NextSequence()
-				if err != nil {
-					return err
-				}
+		default:
+			// the first key before the last key seen
+			if k, _ = c.Seek(last); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
 			}
 		}
 
-		for index, info := range t.indices {
-			ib := tx.Bucket(indices(index))
-			if ib == nil {
-				return NO_TABLE
+		for n := 0; k != nil; k, v = next() {
+			if limit > 0 && n == limit {
+				// there are more records
+				nextToken = base64.RawURLEncoding.EncodeToString(last)
+				break
 			}
 
-			key, val, err := info.marshalKeyValue(fields)
+			fields, err := t.decodeRecord(tx, info, k, v)
 			if err != nil {
 				return err
 			}
 
-			if key == nil {
-				continue
-			}
+			res.FromFieldList(fields)
 
-			if err := ib.Put(key, val); err != nil {
-				return err
+			last = k
+			n++
+			seen++
+
+			if !callback(res) {
+				nextToken = base64.RawURLEncoding.EncodeToString(last)
+				break
 			}
 		}
 
 		return nil
 	})
 
-	return key, err
+	endSpan(span, seen, err)
+	return nextToken, err
 }
 
 //
-// Get a record from the table, given the index and the key
+// Return an estimate of the space used by an index (or by the primary storage, if index is ""),
+// as the sum of the length of all keys and values (not including the bolt page overhead).
 //
-func (t *Table) Get(index string, key, res DataRecord) error {
-	db := (*bolt.DB)(t.d)
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(indices(index))
-		if b == nil {
-			return NO_INDEX
-		}
+// This scans the whole index, so it's O(n) and should not be called too often
+// (i.e. it's meant for capacity planning, to find which indices are largest)
+//
+func (t *Table) Size(index string) (size int64, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
 
-		c := b.Cursor()
+	defer t.wrapError("Size", index, &err)
 
-		info := t.indices[index]
+	db := t.d.db
 
-		sk, _, err := info.marshalKeyValue(key.ToFieldList())
-		if err != nil {
-			return err
-		}
+	span := t.startSpan("Scan")
+	n := 0
 
-		if sk == nil {
-			return NO_KEY
-		}
+	err = db.View(func(tx *bolt.Tx) error {
+		var b *bolt.Bucket
 
-		resk, resv := c.Seek(sk)
-		if !bytes.Equal(sk, resk) {
-			return NO_KEY
-		}
+		if index == "" {
+			sb := tx.Bucket(schema(t.name))
+			if sb == nil {
+				return NO_TABLE
+			}
 
-		fields, err := info.unmarshalKeyValue(resk, resv)
-		if err != nil {
-			return err
+			if b = sb.Bucket(dataName); b == nil {
+				// no primary storage
+				return nil
+			}
+		} else if b = t.indexBucket(tx, index); b == nil {
+			return NO_INDEX
 		}
 
-		res.FromFieldList(fields)
-		return nil
+		return b.ForEach(func(k, v []byte) error {
+			size += int64(len(k) + len(v))
+			n++
+			return nil
+		})
 	})
 
-	return err
+	endSpan(span, n, err)
+	return size, err
 }
 
 //
-// Update a record from the table, given the index and the key
+// Store an entry in an index, given the encoded key and value (as returned by ForEach or GetRaw), without decoding it.
 //
-/*
-func (t *Table) Update(index string, key, value DataRecord) error {
-	db := (*bolt.DB)(t.d)
+// This is meant for migration and replication tools: the entry is written as is, so the caller is responsible
+// for using an encoding compatible with the index definition (same key fields, nilFirst option and schema version)
+// and for writing the corresponding entries in the other indices of the table.
+//
+// The write advances the change sequence but, since the entry is not decoded, it's not recorded in the change log.
+//
+func (t *Table) PutRaw(index string, k, v []byte) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObservePut, time.Now(), &err)
+	}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(indices(index))
+	defer t.wrapError("PutRaw", index, &err)
+
+	db := t.d.db
+
+	if len(k) == 0 {
+		return BAD_VALUES
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
 		if b == nil {
 			return NO_INDEX
 		}
 
-		info := t.indices[index]
-
-		sk, _, err := info.marshalKeyValue(key.ToFieldList())
-		if err != nil {
+		if err := b.Put(k, v); err != nil {
 			return err
 		}
 
-		if sk == nil {
-			return NO_KEY
-		}
+		return t.d.changed(tx, 1)
+	})
+}
 
-		c := b.Cursor()
-		k, v := c.Seek(sk)
+//
+// Get the encoded value of an index entry, given the encoded key (as returned by ForEach), without decoding it.
+//
+// Returns NO_KEY if the entry doesn't exist
+//
+func (t *Table) GetRaw(index string, k []byte) (v []byte, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
 
-		// Seek will return the next key if there is no match
-		// so make sure we check we got the right record
+	defer t.wrapError("GetRaw", index, &err)
 
-		if bytes.Equal(sk, k) {
-                        updateIndex := func(index string) error {
-                            b := tx.Bucket(indices(index))
-                            if b == nil {
-                                    return NO_INDEX
-                            }
+	db := t.d.db
 
-                            info := t.indices[index]
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
 
-                            vk, vv, err := info.marshalKeyValue(value.ToFieldList())
-                            if err != nil {
-                                    return err
-                            }
+		// use a cursor, since Bucket.Get doesn't distinguish between a missing key and an empty value
 
-                            if vk != nil && !bytes.Equal(vk, sk) {
-                                 if err := c.Delete(); err != nil {
-                                    return err
-                                 }
-                            }
+		ck, cv := b.Cursor().Seek(k)
+		if ck == nil || !bytes.Equal(k, ck) {
+			return NO_KEY
+		}
 
-                            if err := b.Put(vk, vv); err != nil {
-                                return err
-                            }
-                        }
+		// the value is only valid during the transaction
+		v = append([]byte{}, cv...)
+		return nil
+	})
 
-                        if err := updateIndex(index); err != nil {
-                            return err
-                        }
+	return v, err
+}
 
-			fields, err := info.unmarshalKeyValue(k, v)
-			if err != nil {
-				return err
-			}
+//
+// Scan through all records in an index. Calls specified callback with key and value (as []byte, not decoded)
+//
+func (t *Table) ForEach(index string, callback func(k, v []byte) error) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
 
-			for i, info := range t.indices {
-				if i == index {
-					// already done
-					continue
-				}
+	defer t.wrapError("ForEach", index, &err)
 
-				b := tx.Bucket(indices(i))
-				if b == nil {
-					continue
-				}
+	db := t.d.db
 
-                                if err := updateIndex(b, indices(i)); err != nil {
-                                    return err
-                                }
-			}
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.rawBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
 		}
 
-		return nil
+		return b.ForEach(func(k, v []byte) error {
+			n++
+			return callback(k, v)
+		})
 	})
 
+	endSpan(span, n, err)
 	return err
 }
-*/
 
 //
-// Delete a record from the table, given the index and the key
+// Scan through the raw entries of an index, as ForEach, starting from the entry with the specified raw key
+// (or the nearest one in the scan direction) and going forward or backward (if reverse is true).
 //
-func (t *Table) Delete(index string, key DataRecord) error {
-	db := (*bolt.DB)(t.d)
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(indices(index))
-		if b == nil {
-			return NO_INDEX
-		}
+// A nil start means the first entry (or the last one, in reverse). The iteration stops at the first error
+// returned by the callback, that is returned by ForEachFrom.
+//
+func (t *Table) ForEachFrom(index string, start []byte, reverse bool, callback func(k, v []byte) error) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
 
-		info := t.indices[index]
+	defer t.wrapError("ForEachFrom", index, &err)
 
-		sk, _, err := info.marshalKeyValue(key.ToFieldList())
-		if err != nil {
-			return err
-		}
+	db := t.d.db
 
-		if sk == nil {
-			return NO_KEY
+	return db.View(func(tx *bolt.Tx) error {
+		b := t.rawBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
 		}
 
 		c := b.Cursor()
-		k, v := c.Seek(sk)
-
-		// Seek will return the next key if there is no match
-		// so make sure we check we got the right record
-
-		if bytes.Equal(sk, k) {
-			if err := c.Delete(); err != nil {
-				return err
-			}
-
-			fields, err := info.unmarshalKeyValue(k, v)
-			if err != nil {
-				return err
-			}
 
-			key.FromFieldList(fields) // update key with full record
+		var k, v []byte
 
-			for i, info := range t.indices {
-				if i == index {
-					// already done
-					continue
-				}
+		switch {
+		case start == nil && reverse:
+			k, v = c.Last()
 
-				b := tx.Bucket(indices(i))
-				if b == nil {
-					continue
-				}
+		case start == nil:
+			k, v = c.First()
 
-				// could use marshalKeyValue() instead
+		case reverse:
+			// Seek returns the first key greater or equal to start, so move back if it's greater
+			if k, v = c.Seek(start); k == nil {
+				k, v = c.Last()
+			} else if !bytes.Equal(k, start) {
+				k, v = c.Prev()
+			}
 
-				vkey := make([]interface{}, len(info.iplist))
-				for _, ip := range info.iplist {
-					vkey[ip.pos] = fields[ip.field]
-				}
+		default:
+			k, v = c.Seek(start)
+		}
 
-				dkey, err := typedbuffer.Encode(vkey...)
-				if err != nil {
-					return err
-				}
+		next := c.Next
+		if reverse {
+			next = c.Prev
+		}
 
-				if err := b.Delete(dkey); err != nil {
-					return err
-				}
+		for ; k != nil; k, v = next() {
+			if err := callback(k, v); err != nil {
+				return err
 			}
 		}
 
 		return nil
 	})
-
-	return err
 }
 
 //
-// Get all records sorted by index keys (ascending or descending)
-// Call user function with record content or error
+// Scan through all records in an index, as ForEach, but using a new read transaction every chunk keys
+// (resuming from the last key seen).
 //
-func (t *Table) Scan(index string, ascending bool, start, res DataRecord, callback func(DataRecord, error) bool) error {
-	db := (*bolt.DB)(t.d)
+// This keeps each read transaction short (so that it doesn't hold old pages and block the database from
+// growing for a long time) but it doesn't provide a consistent snapshot: changes committed between chunks
+// are visible to the following chunks.
+//
+func (t *Table) ForEachChunked(index string, chunk int, callback func(k, v []byte) error) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
 
-	return db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(indices(index))
-		if b == nil {
-			return NO_INDEX
-		}
+	defer t.wrapError("ForEachChunked", index, &err)
 
-		c := b.Cursor()
+	db := t.d.db
 
-		info := t.indices[index]
+	if chunk <= 0 {
+		return BAD_VALUES
+	}
 
-		var k, v []byte
+	var last []byte
 
-		if start != nil {
-			key, _, err := info.marshalKeyValue(start.ToFieldList())
-			if err != nil {
-				return err
+	for done := false; !done; {
+		err := db.View(func(tx *bolt.Tx) error {
+			b := t.rawBucket(tx, index)
+			if b == nil {
+				return NO_INDEX
 			}
 
-			if key != nil {
-				k, v = c.Seek(key)
-				if !ascending && !bytes.Equal(key, k) {
-					// if descending and keys don't match we want to start from the first key
-					// in range (previous)
+			c := b.Cursor()
 
-					k, v = c.Prev()
-				}
-			}
-		}
+			var k, v []byte
 
-		if k == nil {
-			if ascending {
+			if last == nil {
 				k, v = c.First()
-			} else {
-				k, v = c.Last()
+			} else if k, v = c.Seek(last); bytes.Equal(k, last) {
+				k, v = c.Next()
 			}
-		}
 
-		var next func() (key []byte, value []byte)
+			for n := 0; n < chunk; n++ {
+				if k == nil {
+					done = true
+					return nil
+				}
 
-		if ascending {
-			next = c.Next
-		} else {
-			next = c.Prev
-		}
+				if err := callback(k, v); err != nil {
+					return err
+				}
 
-		for ; k != nil; k, v = next() {
-			fields, err := info.unmarshalKeyValue(k, v)
-			if err != nil {
-				return err
+				last = append(last[:0], k...)
+				k, v = c.Next()
 			}
 
-			res.FromFieldList(fields)
+			return nil
+		})
 
-			if !callback(res, err) {
-				break
-			}
+		if err != nil {
+			return err
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
 //
-// Scan through all records in an index. Calls specified callback with key and value (as []byte, not decoded)
+// return the index bucket or the table bucket if index is empty
 //
-func (t *Table) ForEach(index string, callback func(k, v []byte) error) error {
-	db := (*bolt.DB)(t.d)
-
-	return db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(t.name))
-		if len(index) > 0 {
-			b = tx.Bucket(indices(index))
-		}
-
-		if b == nil {
-			return NO_INDEX
-		}
+func (t *Table) rawBucket(tx *bolt.Tx, index string) *bolt.Bucket {
+	if len(index) > 0 {
+		return t.indexBucket(tx, index)
+	}
 
-		return b.ForEach(callback)
-	})
+	return tx.Bucket(schema(t.name))
 }
@@ -1,15 +1,30 @@
 package boltql
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/gobs/typedbuffer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 const (
-	DB_FILE    = "test.db"
 	TABLE_NAME = "table"
 	INDEX_1    = "index1"
 	INDEX_2    = "index2"
@@ -48,36 +63,68 @@ func getTable(t *testing.T) *Table {
 	return table
 }
 
+//
+// create a table with an index on fields and add the records, in d or (if d is nil)
+// in a new in-memory store, closed at the end of the test
+//
+func testTable(t *testing.T, d *DataStore, name, index string, fields []uint64, recs ...DataRecord) (*DataStore, *Table) {
+	t.Helper()
+
+	if d == nil {
+		var err error
+
+		if d, err = OpenMemory(); err != nil {
+			t.Fatal("open:", err)
+		}
+
+		t.Cleanup(func() { d.Close() })
+	}
+
+	tbl, err := d.CreateTable(name)
+	if err == nil {
+		err = tbl.CreateIndex(index, true, fields...)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range recs {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	return d, tbl
+}
+
 func TestMain(m *testing.M) {
+	// os.Exit doesn't run deferred functions, so all the setup and cleanup is done in runTests
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
 	//
 	// open db
 	//
-	if _db, err := Open(DB_FILE); err != nil {
+	if _db, err := OpenMemory(); err != nil {
 		panic("cannot open database")
 	} else {
 		db = _db
 	}
 
 	//
-	// run tests
-	//
-	ret := m.Run()
-
-	//
-	// close db
-	// (not sure of why a defer f() here is not called)
+	// close db (this also removes the temporary file)
 	//
-	if db != nil {
+	defer func() {
 		if err := db.Close(); err != nil {
 			fmt.Println("close db:", err)
 		}
-	}
+	}()
 
-	if err := os.Remove(DB_FILE); err != nil {
-		fmt.Println("remove db:", err)
-	}
-
-	os.Exit(ret)
+	//
+	// run tests
+	//
+	return m.Run()
 }
 
 func Test_01_CreateTable(t *testing.T) {
@@ -238,7 +285,7 @@ func Test_08_Delete(t *testing.T) {
 	}
 }
 
-func Test_99_ForEach(t *testing.T) {
+func Test_09_ForEach(t *testing.T) {
 	indices := []string{
 		"", // note that this contains the table description (info about indices)
 		INDEX_1,
@@ -269,3 +316,6526 @@ func Test_99_ForEach(t *testing.T) {
 		t.Log("  total", n, "records")
 	}
 }
+
+func Test_10_BatchPut(t *testing.T) {
+	tbl, err := db.CreateTable("batch")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("batch_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	const n = 20
+
+	ids := make(chan uint64, n)
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			id, err := tbl.BatchPut(&TestRecord{AUTOINCREMENT, i})
+			ids <- id
+			errs <- err
+		}(i)
+	}
+
+	seen := map[uint64]bool{}
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error("batch put:", err)
+		}
+
+		id := <-ids
+		if id == 0 || seen[id] {
+			t.Error("unexpected id", id)
+		}
+
+		seen[id] = true
+	}
+
+	var rec TestRecord
+
+	for id := range seen {
+		if err := tbl.Get("batch_id", &TestRecord{id}, &rec); err != nil {
+			t.Error("get", id, err)
+		}
+	}
+
+	// Put writes the AUTOINCREMENT value back to a slice record, BatchPut doesn't (it may be retried)
+	rec = TestRecord{AUTOINCREMENT, "put"}
+
+	if id, err := tbl.Put(&rec); err != nil || rec[0] != id {
+		t.Error("expected the assigned id in the record, got", rec, id, err)
+	}
+
+	rec = TestRecord{AUTOINCREMENT, "batch"}
+
+	if _, err := tbl.BatchPut(&rec); err != nil || !isAutoIncrement(rec[0]) {
+		t.Error("expected the record unchanged, got", rec, err)
+	}
+}
+
+func Test_11_Bulk_Sync(t *testing.T) {
+	bdb, err := Open(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer bdb.Close()
+
+	tbl, err := bdb.CreateTable("bulk")
+	if err == nil {
+		err = tbl.CreateIndex("bulk_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	bdb.SetBulk(true)
+
+	if !bdb.Bolt().NoSync {
+		t.Error("expected NoSync in bulk mode")
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, i}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	bdb.SetBulk(false)
+
+	if bdb.Bolt().NoSync {
+		t.Error("expected sync after every transaction")
+	}
+
+	if err := bdb.Sync(); err != nil {
+		t.Error("sync:", err)
+	}
+
+	n := 0
+
+	if err := tbl.ForEach("bulk_id", func(k, v []byte) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Error("foreach:", err)
+	}
+
+	if n != 100 {
+		t.Error("expected 100 records, got", n)
+	}
+}
+
+func Test_12_Numeric_Index(t *testing.T) {
+	tbl, err := db.CreateTable("numeric")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateNumericIndex("numeric_n", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{uint64(5), "uint64"},
+		{int8(-3), "int8"},
+		{int(10), "int"},
+		{int64(7), "int64"},
+		{uint32(1), "uint32"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// reload, to check that the index options are persisted
+	if tbl, err = db.GetTable("numeric"); err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	for _, key := range []interface{}{int(5), int64(5), uint64(5), uint8(5)} {
+		if err := tbl.Get("numeric_n", &TestRecord{key}, &rec); err != nil {
+			t.Errorf("get %T: %v", key, err)
+		} else if string(rec[1].([]byte)) != "uint64" {
+			t.Errorf("get %T: unexpected record %v", key, rec)
+		}
+	}
+
+	var prev int64 = math.MinInt64
+
+	if err := tbl.Scan("numeric_n", true, nil, &rec, func(rec DataRecord, err error) bool {
+		trec := rec.(*TestRecord)
+
+		if key, ok := (*trec)[0].(int64); !ok {
+			t.Errorf("key not a int64: %q", *trec)
+			return false
+		} else if key < prev {
+			t.Error("key", key, "prev", prev)
+			return false
+		} else {
+			prev = key
+		}
+
+		return true
+	}); err != nil {
+		t.Error("scan index:", err)
+	}
+}
+
+func Test_13_Integer_Keys(t *testing.T) {
+	tbl := getTable(t)
+
+	if _, err := tbl.Put(&TestRecord{"int32_", int32(99), "int32 key", int16(100)}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	var rec TestRecord
+
+	// (field 3 is the primary key, always stored as uint64)
+	if err := tbl.Get(INDEX_2, &TestRecord{nil, int64(99), nil, uint64(100)}, &rec); err != nil {
+		t.Error("get:", err)
+	} else if string(rec[2].([]byte)) != "int32 key" {
+		t.Error("unexpected record", rec)
+	}
+
+	if err := tbl.Get(INDEX_2, &TestRecord{nil, int8(99), nil, uint64(100)}, &rec); err != nil {
+		t.Error("get:", err)
+	}
+}
+
+func Test_14_Seek(t *testing.T) {
+	var recs []DataRecord
+
+	for i := 0; i < 10; i++ {
+		recs = append(recs, &TestRecord{i * 10, i})
+	}
+
+	_, tbl := testTable(t, db, "seek", "seek_n", []uint64{0}, recs...)
+
+	cursor, err := tbl.Seek("seek_n", &TestRecord{45})
+	if err != nil {
+		t.Fatal("seek:", err)
+	}
+
+	defer cursor.Close()
+
+	var rec TestRecord
+
+	expect := func(v int64) {
+		if err := cursor.Record(&rec); err != nil {
+			t.Error("record:", err)
+		} else if rec[0] != v {
+			t.Error("expected", v, "got", rec[0])
+		}
+	}
+
+	expect(50)
+
+	if !cursor.Prev() || !cursor.Prev() {
+		t.Fatal("prev: unexpected end")
+	}
+
+	expect(30)
+
+	for cursor.Next() {
+	}
+
+	if err := cursor.Record(&rec); err != NO_KEY {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	if !cursor.Prev() {
+		t.Fatal("prev: unexpected end")
+	}
+
+	expect(90)
+}
+
+func Test_15_ScanFromToken(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	for _, ascending := range []bool{true, false} {
+		var rec TestRecord
+		var keys []int64
+
+		// a key in the range already visited
+		added := -10
+		if !ascending {
+			added = 100
+		}
+
+		token := ""
+
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("too many pages")
+			}
+
+			token, err = tbl.ScanFromToken("seek_n", ascending, token, 3, &rec, func(rec DataRecord) bool {
+				keys = append(keys, (*rec.(*TestRecord))[0].(int64))
+				return true
+			})
+
+			if err != nil {
+				t.Fatal("scan:", err)
+			}
+
+			if token == "" {
+				break
+			}
+
+			if pages == 0 {
+				// a new record shouldn't affect the following pages
+				if _, err := tbl.Put(&TestRecord{added, -1}); err != nil {
+					t.Fatal("put:", err)
+				}
+			}
+		}
+
+		if len(keys) != 10 {
+			t.Error("expected 10 records, got", keys)
+		}
+
+		for i := 1; i < len(keys); i++ {
+			if ascending && keys[i] <= keys[i-1] || !ascending && keys[i] >= keys[i-1] {
+				t.Error("unexpected order", keys)
+				break
+			}
+		}
+
+		if err := tbl.Delete("seek_n", &TestRecord{added}); err != nil {
+			t.Error("delete:", err)
+		}
+	}
+}
+
+func Test_16_SchemaVersion(t *testing.T) {
+	tbl, err := db.CreateTable("versioned")
+	if err == nil {
+		err = tbl.CreateIndex("versioned_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "old"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.SetSchemaVersion(1); err != nil {
+		t.Fatal("set schema version:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{2, "new", "value"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if tbl, err = db.GetTable("versioned"); err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if v := tbl.SchemaVersion(); v != 1 {
+		t.Error("expected version 1, got", v)
+	}
+
+	tbl.SetMigration(func(old int, fields []interface{}) []interface{} {
+		if old != 0 {
+			t.Error("unexpected migration from version", old)
+		}
+
+		return append(fields, "default")
+	})
+
+	var rec TestRecord
+
+	if err := tbl.Get("versioned_id", &TestRecord{1}, &rec); err != nil {
+		t.Error("get:", err)
+	} else if len(rec) != 3 || rec[2] != "default" {
+		t.Error("record not migrated:", rec)
+	}
+
+	if err := tbl.Get("versioned_id", &TestRecord{2}, &rec); err != nil {
+		t.Error("get:", err)
+	} else if len(rec) != 3 || string(rec[2].([]byte)) != "value" {
+		t.Error("unexpected record:", rec)
+	}
+}
+
+func Test_17_DeleteKey(t *testing.T) {
+	tbl, err := db.CreateTable("primary")
+	if err == nil {
+		err = tbl.CreateIndex("primary_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var ids []uint64
+
+	for _, name := range []string{"one", "two", "three"} {
+		id, err := tbl.Put(&TestRecord{AUTOINCREMENT, name})
+		if err != nil {
+			t.Fatal("put:", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	// update (same primary key) should replace the old index entries
+	if id, err := tbl.Put(&TestRecord{ids[1], "deux"}); err != nil {
+		t.Fatal("put:", err)
+	} else if id != ids[1] {
+		t.Error("expected id", ids[1], "got", id)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("primary_name", &TestRecord{nil, "two"}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY for old entry, got", err, rec)
+	}
+
+	if err := tbl.DeleteKey(ids[1]); err != nil {
+		t.Error("delete key:", err)
+	}
+
+	if err := tbl.Get("primary_name", &TestRecord{nil, "deux"}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err, rec)
+	}
+
+	if err := tbl.Get("primary_name", &TestRecord{nil, "three"}, &rec); err != nil {
+		t.Error("get:", err)
+	}
+
+	if err := tbl.DeleteKey(ids[1]); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+}
+
+func Test_18_GetKey(t *testing.T) {
+	tbl, err := db.GetTable("primary")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	id, err := tbl.Put(&TestRecord{AUTOINCREMENT, "four", 4})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.GetKey(id, &rec); err != nil {
+		t.Error("get key:", err)
+	} else if len(rec) != 3 || rec[0] != id || string(rec[1].([]byte)) != "four" || rec[2] != int64(4) {
+		t.Error("unexpected record", rec)
+	}
+
+	if err := tbl.GetKey(id+100, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+}
+
+func Test_19_BulkLoad(t *testing.T) {
+	tbl, err := db.CreateTable("bulkload")
+	if err == nil {
+		err = tbl.CreateIndex("bulkload_n", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	const n = 2500
+
+	recs := make(chan DataRecord)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			recs <- &TestRecord{AUTOINCREMENT, n - i}
+		}
+
+		close(recs)
+	}()
+
+	if count, err := tbl.BulkLoad(recs); err != nil {
+		t.Fatal("bulk load:", err)
+	} else if count != n {
+		t.Error("expected", n, "records, got", count)
+	}
+
+	var rec TestRecord
+
+	count := 0
+	prev := int64(0)
+
+	if err := tbl.Scan("bulkload_n", true, nil, &rec, func(rec DataRecord, err error) bool {
+		v := (*rec.(*TestRecord))[1].(int64)
+		if v <= prev {
+			t.Error("unexpected order", v, "after", prev)
+			return false
+		}
+
+		prev = v
+		count++
+		return true
+	}); err != nil {
+		t.Error("scan:", err)
+	}
+
+	if count != n {
+		t.Error("expected", n, "indexed records, got", count)
+	}
+}
+
+func Test_20_Close(t *testing.T) {
+	const dbfile = "test_close.db"
+
+	defer os.Remove(dbfile)
+
+	cdb, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	if cdb.DB() == nil {
+		t.Error("nil bolt database")
+	}
+
+	if err := cdb.Close(); err != nil {
+		t.Error("close:", err)
+	}
+
+	if err := cdb.Close(); err != nil {
+		t.Error("second close:", err)
+	}
+}
+
+func Test_21_Bolt(t *testing.T) {
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("custom"))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("key"), []byte("value"))
+	}); err != nil {
+		t.Error("update:", err)
+	}
+
+	if err := db.Bolt().View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("custom")).Get([]byte("key")); string(v) != "value" {
+			t.Errorf("unexpected value %q", v)
+		}
+
+		return nil
+	}); err != nil {
+		t.Error("view:", err)
+	}
+}
+
+func Test_22_CopyTable(t *testing.T) {
+	if err := db.CopyTable("primary", "primary_copy"); err != nil {
+		t.Fatal("copy table:", err)
+	}
+
+	if err := db.CopyTable("primary", "primary_copy"); err != ALREADY_EXISTS {
+		t.Error("expected ALREADY_EXISTS, got", err)
+	}
+
+	src, err := db.GetTable("primary")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	dst, err := db.GetTable("primary_copy")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	scan := func(tbl *Table) (res []string) {
+		var rec TestRecord
+
+		if err := tbl.Scan("primary_name", true, nil, &rec, func(rec DataRecord, err error) bool {
+			res = append(res, fmt.Sprint(*rec.(*TestRecord)))
+			return true
+		}); err != nil {
+			t.Error("scan:", err)
+		}
+
+		return
+	}
+
+	srecs, drecs := scan(src), scan(dst)
+
+	if len(srecs) == 0 || fmt.Sprint(srecs) != fmt.Sprint(drecs) {
+		t.Error("scans don't match:", srecs, drecs)
+	}
+
+	// the copy is independent from the original table
+	if err := dst.Delete("primary_name", &TestRecord{nil, "one"}); err != nil {
+		t.Error("delete:", err)
+	}
+
+	if len(scan(src)) != len(srecs) || len(scan(dst)) != len(srecs)-1 {
+		t.Error("unexpected scan length after delete")
+	}
+}
+
+func Test_23_RenameTable(t *testing.T) {
+	if err := db.RenameTable("primary_copy", "primary_renamed"); err != nil {
+		t.Fatal("rename table:", err)
+	}
+
+	if _, err := db.GetTable("primary_copy"); err != NO_TABLE {
+		t.Error("expected NO_TABLE, got", err)
+	}
+
+	tbl, err := db.GetTable("primary_renamed")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("primary_name", &TestRecord{nil, "three"}, &rec); err != nil {
+		t.Error("get:", err)
+	} else if err := tbl.GetKey(rec[0].(uint64), &rec); err != nil {
+		t.Error("get key:", err)
+	}
+
+	if err := tbl.Rename("primary_copy"); err != nil {
+		t.Fatal("rename:", err)
+	}
+
+	if err := tbl.Get("primary_name", &TestRecord{nil, "three"}, &rec); err != nil {
+		t.Error("get after rename:", err)
+	}
+
+	if err := db.RenameTable("primary_copy", "primary"); err != ALREADY_EXISTS {
+		t.Error("expected ALREADY_EXISTS, got", err)
+	}
+}
+
+func Test_24_RenameIndex(t *testing.T) {
+	tbl, err := db.GetTable("numeric")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := tbl.RenameIndex("missing", "numeric_x"); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	if err := tbl.RenameIndex("numeric_n", "numeric_n"); !errors.Is(err, ALREADY_EXISTS) {
+		t.Error("expected ALREADY_EXISTS, got", err)
+	}
+
+	if err := tbl.RenameIndex("numeric_n", "numeric_x"); err != nil {
+		t.Fatal("rename index:", err)
+	}
+
+	if tbl, err = db.GetTable("numeric"); err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if _, ok := tbl.indices["numeric_n"]; ok {
+		t.Error("old index still defined")
+	}
+
+	if !tbl.indices["numeric_x"].numeric {
+		t.Error("index options not moved")
+	}
+
+	var rec TestRecord
+
+	n := 0
+
+	if err := tbl.Scan("numeric_x", true, nil, &rec, func(rec DataRecord, err error) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Error("scan:", err)
+	}
+
+	if n != 5 {
+		t.Error("expected 5 records, got", n)
+	}
+
+	if err := tbl.Scan("numeric_n", true, nil, &rec, func(rec DataRecord, err error) bool {
+		return true
+	}); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_25_Nested_Keys(t *testing.T) {
+	tbl := getTable(t)
+
+	for _, key := range []interface{}{
+		[]interface{}{"a", 1},
+		[]string{"a", "b"},
+		map[string]int{"a": 1},
+		struct{ A int }{1},
+	} {
+		if _, err := tbl.Put(&TestRecord{key, 1, "nested", AUTOINCREMENT}); !errors.Is(err, NESTED_KEY) {
+			t.Errorf("%T: expected NESTED_KEY, got %v", key, err)
+		}
+	}
+
+	// nothing should have been written (in any index)
+	var rec TestRecord
+
+	if err := tbl.Scan(INDEX_2, true, &TestRecord{nil, 1}, &rec, func(rec DataRecord, err error) bool {
+		if trec := *rec.(*TestRecord); trec[1] == int64(1) && string(trec[2].([]byte)) == "nested" {
+			t.Error("unexpected record", trec)
+		}
+
+		return true
+	}); err != nil {
+		t.Error("scan:", err)
+	}
+}
+
+func Test_26_First_Last(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.First("seek_n", &rec); err != nil {
+		t.Error("first:", err)
+	} else if rec[0] != int64(0) {
+		t.Error("first: unexpected record", rec)
+	}
+
+	if err := tbl.Last("seek_n", &rec); err != nil {
+		t.Error("last:", err)
+	} else if rec[0] != int64(90) {
+		t.Error("last: unexpected record", rec)
+	}
+
+	empty, err := db.CreateTable("empty")
+	if err == nil {
+		err = empty.CreateIndex("empty_n", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := empty.First("empty_n", &rec); !errors.Is(err, NO_KEY) {
+		t.Error("first: expected NO_KEY, got", err)
+	}
+
+	if err := empty.Last("empty_n", &rec); !errors.Is(err, NO_KEY) {
+		t.Error("last: expected NO_KEY, got", err)
+	}
+}
+
+func Test_27_ScanFields(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rows [][]interface{}
+
+	if err := tbl.ScanFields("seek_n", true, &TestRecord{50}, func(fields []interface{}, err error) bool {
+		if err != nil {
+			t.Error("callback", err)
+		}
+
+		rows = append(rows, fields)
+		return true
+	}); err != nil {
+		t.Error("scan fields:", err)
+	}
+
+	if len(rows) != 5 {
+		t.Fatal("expected 5 rows, got", len(rows))
+	}
+
+	// each row should be distinct (not a reused slice)
+	for i, row := range rows {
+		if row[0] != int64(50+i*10) {
+			t.Error("unexpected row", i, row)
+		}
+	}
+}
+
+func Test_28_ScanKeys(t *testing.T) {
+	var prev string
+
+	n := 0
+
+	if err := getTable(t).ScanKeys(INDEX_1, true, func(key []interface{}) bool {
+		if len(key) != 2 {
+			t.Error("expected 2 key fields, got", key)
+			return false
+		}
+
+		if s := string(key[0].([]byte)); s < prev {
+			t.Error("key", s, "prev", prev)
+		} else {
+			prev = s
+		}
+
+		n++
+		return true
+	}); err != nil {
+		t.Error("scan keys:", err)
+	}
+
+	if n == 0 {
+		t.Error("no keys")
+	}
+}
+
+func Test_29_Sequence(t *testing.T) {
+	const dbfile = "test_sequence.db"
+
+	defer os.Remove(dbfile)
+
+	sdb, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	tbl, err := sdb.CreateTable("sequence")
+	if err == nil {
+		err = tbl.CreateIndex("sequence_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	id1, err := tbl.Put(&TestRecord{AUTOINCREMENT, "first"})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	sdb.Close()
+
+	if sdb, err = Open(dbfile); err != nil {
+		t.Fatal("reopen:", err)
+	}
+
+	defer sdb.Close()
+
+	if tbl, err = sdb.GetTable("sequence"); err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if seq, err := tbl.CurrentSequence(); err != nil || seq != id1 {
+		t.Error("expected sequence", id1, "got", seq, err)
+	}
+
+	id2, err := tbl.Put(&TestRecord{AUTOINCREMENT, "second"})
+	if err != nil {
+		t.Fatal("put:", err)
+	} else if id2 != id1+1 {
+		t.Error("expected id", id1+1, "got", id2)
+	}
+
+	// import a record with an explicit id, then move the sequence past it
+	if _, err := tbl.Put(&TestRecord{uint64(100), "imported"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.SetSequence(100); err != nil {
+		t.Fatal("set sequence:", err)
+	}
+
+	if id, err := tbl.Put(&TestRecord{AUTOINCREMENT, "third"}); err != nil {
+		t.Fatal("put:", err)
+	} else if id != 101 {
+		t.Error("expected id 101, got", id)
+	}
+}
+
+func Test_30_GetNearest(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	tests := []struct {
+		key       int
+		direction int
+		expected  interface{} // nil for NO_KEY
+	}{
+		{45, 1, int64(50)},
+		{45, -1, int64(40)},
+		{50, 1, int64(50)},
+		{50, -1, int64(50)},
+		{95, 1, nil},
+		{95, -1, int64(90)},
+		{-5, 1, int64(0)},
+		{-5, -1, nil},
+	}
+
+	var rec TestRecord
+
+	for _, test := range tests {
+		err := tbl.GetNearest("seek_n", &TestRecord{test.key}, &rec, test.direction)
+
+		if test.expected == nil {
+			if !errors.Is(err, NO_KEY) {
+				t.Error(test, "expected NO_KEY, got", err, rec)
+			}
+		} else if err != nil {
+			t.Error(test, "get nearest:", err)
+		} else if rec[0] != test.expected {
+			t.Error(test, "unexpected record", rec)
+		}
+	}
+}
+
+func Test_31_ForEachChunked(t *testing.T) {
+	tbl, err := db.GetTable("bulkload")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var all, chunked []string
+
+	if err := tbl.ForEach("bulkload_n", func(k, v []byte) error {
+		all = append(all, string(k))
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	for _, chunk := range []int{1, 7, 1000, len(all), len(all) + 1} {
+		chunked = chunked[:0]
+
+		if err := tbl.ForEachChunked("bulkload_n", chunk, func(k, v []byte) error {
+			chunked = append(chunked, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal("foreach chunked:", err)
+		}
+
+		if len(chunked) != len(all) {
+			t.Error("chunk", chunk, "expected", len(all), "keys, got", len(chunked))
+			continue
+		}
+
+		for i := range all {
+			if all[i] != chunked[i] {
+				t.Error("chunk", chunk, "key mismatch at", i)
+				break
+			}
+		}
+	}
+}
+
+type countMetrics struct {
+	puts, gets, scans, deletes, errors int
+}
+
+func (m *countMetrics) count(n *int, err error) {
+	*n++
+	if err != nil {
+		m.errors++
+	}
+}
+
+func (m *countMetrics) ObservePut(dur time.Duration, err error)    { m.count(&m.puts, err) }
+func (m *countMetrics) ObserveGet(dur time.Duration, err error)    { m.count(&m.gets, err) }
+func (m *countMetrics) ObserveScan(dur time.Duration, err error)   { m.count(&m.scans, err) }
+func (m *countMetrics) ObserveDelete(dur time.Duration, err error) { m.count(&m.deletes, err) }
+
+func Test_32_Metrics(t *testing.T) {
+	tbl, err := db.CreateTable("metrics")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("metrics_n", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	var m countMetrics
+
+	db.SetMetrics(&m)
+	defer db.SetMetrics(nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := tbl.Put(&TestRecord{i, "value"}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var res TestRecord
+
+	if err := tbl.Get("metrics_n", &TestRecord{1}, &res); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if err := tbl.Get("metrics_n", &TestRecord{10}, &res); !errors.Is(err, NO_KEY) {
+		t.Fatal("expected NO_KEY, got", err)
+	}
+
+	if err := tbl.Scan("metrics_n", true, nil, &res, func(rec DataRecord, err error) bool {
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if err := tbl.Delete("metrics_n", &TestRecord{2}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if m.puts != 3 || m.gets != 2 || m.scans != 1 || m.deletes != 1 || m.errors != 1 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+
+	// the raw and maintenance operations
+	m = countMetrics{}
+
+	var raw [2][]byte
+
+	if err := tbl.ForEach("metrics_n", func(k, v []byte) error {
+		raw = [2][]byte{append([]byte{}, k...), append([]byte{}, v...)}
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	if err := tbl.ForEachFrom("metrics_n", nil, false, func(k, v []byte) error { return nil }); err != nil {
+		t.Fatal("for each from:", err)
+	}
+
+	if err := tbl.ForEachChunked("metrics_n", 1, func(k, v []byte) error { return nil }); err != nil {
+		t.Fatal("for each chunked:", err)
+	}
+
+	if _, err := tbl.Size("metrics_n"); err != nil {
+		t.Fatal("size:", err)
+	}
+
+	if _, err := tbl.GetRaw("metrics_n", raw[0]); err != nil {
+		t.Fatal("get raw:", err)
+	}
+
+	if err := tbl.PutRaw("metrics_n", raw[0], raw[1]); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	if err := tbl.RenameIndex("metrics_n", "metrics_num"); err != nil {
+		t.Fatal("rename index:", err)
+	}
+
+	if err := db.CopyTable("metrics", "metrics_copy"); err != nil {
+		t.Fatal("copy table:", err)
+	}
+
+	if err := db.RenameTable("metrics_copy", "metrics_renamed"); err != nil {
+		t.Fatal("rename table:", err)
+	}
+
+	if m.puts != 4 || m.gets != 1 || m.scans != 4 || m.deletes != 0 || m.errors != 0 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+
+	// the collector and the cache can be changed while the DataStore is used
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			db.SetMetrics(nopMetrics{})
+			db.EnableCache(10)
+			db.SetMetrics(nil)
+			db.EnableCache(0)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := tbl.Get("metrics_num", &TestRecord{1}, &res); err != nil {
+			t.Fatal("get:", err)
+		}
+	}
+
+	wg.Wait()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObservePut(dur time.Duration, err error)    {}
+func (nopMetrics) ObserveGet(dur time.Duration, err error)    {}
+func (nopMetrics) ObserveScan(dur time.Duration, err error)   {}
+func (nopMetrics) ObserveDelete(dur time.Duration, err error) {}
+
+type testSpan struct {
+	noop.Span
+
+	name  string
+	keys  int64
+	err   error
+	ended bool
+
+	ctx context.Context // the parent context
+}
+
+func (s *testSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		if a.Key == "boltql.keys" {
+			s.keys = a.Value.AsInt64()
+		}
+	}
+}
+
+func (s *testSpan) RecordError(err error, opts ...trace.EventOption) { s.err = err }
+func (s *testSpan) End(opts ...trace.SpanEndOption)                  { s.ended = true }
+
+type testTracer struct {
+	noop.Tracer
+
+	spans []*testSpan
+}
+
+func (tt *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &testSpan{name: name, ctx: ctx}
+	tt.spans = append(tt.spans, span)
+	return ctx, span
+}
+
+func Test_33_Tracing(t *testing.T) {
+	tbl, err := db.CreateTable("traced")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("traced_n", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	var tracer testTracer
+
+	db.WithTracer(&tracer)
+	defer db.WithTracer(nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := tbl.Put(&TestRecord{i, "value"}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var res TestRecord
+
+	if err := tbl.Get("traced_n", &TestRecord{10}, &res); !errors.Is(err, NO_KEY) {
+		t.Fatal("expected NO_KEY, got", err)
+	}
+
+	if err := tbl.Scan("traced_n", true, nil, &res, func(rec DataRecord, err error) bool {
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if err := tbl.Delete("traced_n", &TestRecord{1}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	// the other reads are traced as Get or Scan
+	if err := tbl.GetNearest("traced_n", &TestRecord{1}, &res, 1); err != nil {
+		t.Fatal("get nearest:", err)
+	}
+
+	if err := tbl.First("traced_n", &res); err != nil {
+		t.Fatal("first:", err)
+	}
+
+	if err := tbl.Last("traced_n", &res); err != nil {
+		t.Fatal("last:", err)
+	}
+
+	if _, err := tbl.ScanFromToken("traced_n", true, "", 0, &res, func(DataRecord) bool { return true }); err != nil {
+		t.Fatal("scan from token:", err)
+	}
+
+	if _, err := tbl.Size("traced_n"); err != nil {
+		t.Fatal("size:", err)
+	}
+
+	if err := tbl.ForEach("traced_n", func(k, v []byte) error { return nil }); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	expected := []struct {
+		name string
+		keys int64
+		err  error
+	}{
+		{"Put traced", 1, nil},
+		{"Put traced", 1, nil},
+		{"Put traced", 1, nil},
+		{"Get traced", 0, NO_KEY},
+		{"Scan traced", 3, nil},
+		{"Delete traced", 1, nil},
+		{"Get traced", 1, nil},
+		{"Get traced", 1, nil},
+		{"Get traced", 1, nil},
+		{"Scan traced", 2, nil},
+		{"Scan traced", 2, nil},
+		{"Scan traced", 2, nil},
+	}
+
+	if len(tracer.spans) != len(expected) {
+		t.Fatal("expected", len(expected), "spans, got", len(tracer.spans))
+	}
+
+	for i, e := range expected {
+		span := tracer.spans[i]
+
+		if span.name != e.name || span.keys != e.keys || span.err != e.err || !span.ended {
+			t.Errorf("span %d: expected %v, got %+v", i, e, *span)
+		}
+	}
+
+	// the spans of the context variants are started from the caller context
+	type ctxKey struct{}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "parent")
+
+	tracer.spans = nil
+
+	if _, err := tbl.PutContext(ctx, &TestRecord{5, "value"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.GetContext(ctx, "traced_n", &TestRecord{5}, &res); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if err := tbl.ScanContext(ctx, "traced_n", true, nil, &res, func(rec DataRecord, err error) bool {
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if err := tbl.DeleteContext(ctx, "traced_n", &TestRecord{5}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if len(tracer.spans) != 4 {
+		t.Fatal("expected 4 spans, got", len(tracer.spans))
+	}
+
+	for _, span := range tracer.spans {
+		if span.ctx.Value(ctxKey{}) != "parent" {
+			t.Error("span", span.name, "not started from the caller context")
+		}
+	}
+}
+
+func Test_34_OpenMemory(t *testing.T) {
+	mdb, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open memory:", err)
+	}
+
+	dbfile := mdb.Bolt().Path()
+
+	tbl, err := mdb.CreateTable("memory")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("memory_n", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "one"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	var res TestRecord
+
+	if err := tbl.Get("memory_n", &TestRecord{1}, &res); err != nil {
+		t.Fatal("get:", err)
+	} else if string(res[1].([]byte)) != "one" {
+		t.Error("unexpected record", res)
+	}
+
+	if err := mdb.Close(); err != nil {
+		t.Fatal("close:", err)
+	}
+
+	if _, err := os.Stat(dbfile); !os.IsNotExist(err) {
+		t.Error("temporary file not removed:", dbfile)
+	}
+
+	if err := mdb.Close(); err != nil {
+		t.Error("second close:", err)
+	}
+}
+
+func Test_35_ExplainPut(t *testing.T) {
+	tbl, err := db.CreateTable("explain")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("explain_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("explain_name", false, 1, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	rec := TestRecord{AUTOINCREMENT, "name"}
+
+	keys, err := tbl.ExplainPut(&rec)
+	if err != nil {
+		t.Fatal("explain put:", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatal("expected keys for 2 indices, got", keys)
+	}
+
+	// ExplainPut doesn't write anything, not even the sequence
+	if seq, err := tbl.CurrentSequence(); err != nil || seq != 0 {
+		t.Fatal("expected sequence 0, got", seq, err)
+	}
+
+	if _, err := tbl.Put(&rec); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	for index, key := range keys {
+		var found [][]byte
+
+		if err := tbl.ForEach(index, func(k, v []byte) error {
+			found = append(found, k)
+			return nil
+		}); err != nil {
+			t.Fatal("foreach:", err)
+		}
+
+		if len(found) != 1 || string(found[0]) != string(key) {
+			t.Errorf("index %v: expected key %q, got %q", index, key, found)
+		}
+	}
+
+	// invalid records return the same error as Put
+	if _, err := tbl.ExplainPut(&TestRecord{AUTOINCREMENT, []int{1, 2}}); !errors.Is(err, NESTED_KEY) {
+		t.Error("expected NESTED_KEY, got", err)
+	}
+}
+
+func Test_36_Errors(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	err = tbl.Get("seek_n", &TestRecord{5}, &rec)
+	if !errors.Is(err, NO_KEY) {
+		t.Fatal("expected NO_KEY, got", err)
+	}
+
+	var e *Error
+
+	if !errors.As(err, &e) {
+		t.Fatalf("expected *Error, got %T", err)
+	}
+
+	if e.Op != "Get" || e.Table != "seek" || e.Index != "seek_n" || e.Err != NO_KEY {
+		t.Errorf("unexpected error context %+v", *e)
+	}
+
+	if errors.Unwrap(err) != NO_KEY {
+		t.Error("expected NO_KEY from Unwrap, got", errors.Unwrap(err))
+	}
+
+	if err := tbl.Get("seek_n", &TestRecord{10}, &rec); err != nil {
+		t.Error("expected nil error, got", err)
+	}
+}
+
+func Test_37_DeletePrefix(t *testing.T) {
+	tbl, err := db.CreateTable("tenants")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("tenants_id", true, 0, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("tenants_name", true, 2); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{1, 1, "a1"}, {1, 2, "a2"}, {1, 3, "a3"},
+		{2, 1, "b1"}, {2, 2, "b2"},
+		{10, 1, "c1"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	if _, err := tbl.DeletePrefix("tenants_id", &TestRecord{}); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if n, err := tbl.DeletePrefix("tenants_id", &TestRecord{1}); err != nil {
+		t.Fatal("delete prefix:", err)
+	} else if n != 3 {
+		t.Error("expected 3 deleted records, got", n)
+	}
+
+	if n, err := tbl.DeletePrefix("tenants_id", &TestRecord{1}); err != nil || n != 0 {
+		t.Error("expected no deleted records, got", n, err)
+	}
+
+	var names []string
+
+	if err := tbl.ScanKeys("tenants_name", true, func(key []interface{}) bool {
+		names = append(names, string(key[0].([]byte)))
+		return true
+	}); err != nil {
+		t.Fatal("scan keys:", err)
+	}
+
+	if fmt.Sprint(names) != "[b1 b2 c1]" {
+		t.Error("unexpected entries in other index:", names)
+	}
+
+	count := 0
+
+	if err := tbl.ForEach("tenants_id", func(k, v []byte) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	if count != 3 {
+		t.Error("expected 3 entries, got", count)
+	}
+}
+
+func Test_38_PutRaw_GetRaw(t *testing.T) {
+	src, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	rdb, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open memory:", err)
+	}
+
+	defer rdb.Close()
+
+	dst, err := rdb.CreateTable("seek")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := dst.CreateIndex("seek_n", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	count := 0
+
+	if err := src.ForEach("seek_n", func(k, v []byte) error {
+		count++
+		return dst.PutRaw("seek_n", k, v)
+	}); err != nil {
+		t.Fatal("copy raw:", err)
+	}
+
+	if err := src.ForEach("seek_n", func(k, v []byte) error {
+		if dv, err := dst.GetRaw("seek_n", k); err != nil {
+			return err
+		} else if string(dv) != string(v) {
+			t.Errorf("value mismatch for key %q: %q != %q", k, dv, v)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("get raw:", err)
+	}
+
+	var srec, drec TestRecord
+
+	if err := src.Get("seek_n", &TestRecord{40}, &srec); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if err := dst.Get("seek_n", &TestRecord{40}, &drec); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if fmt.Sprint(srec) != fmt.Sprint(drec) {
+		t.Error("record mismatch", srec, drec)
+	}
+
+	if _, err := dst.GetRaw("seek_n", []byte("missing")); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	if count == 0 {
+		t.Error("no entries copied")
+	}
+}
+
+func Test_39_PartialIndex(t *testing.T) {
+	tbl, err := db.CreateTable("partial")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	active := func(rec DataRecord) bool {
+		fields := rec.ToFieldList()
+		return len(fields) > 1 && fields[1] == "active"
+	}
+
+	if err := tbl.CreateIndex("partial_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreatePartialIndex("partial_active", true, active, 0); err != nil {
+		t.Fatal("create partial index:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{1, "active"}, {2, "inactive"}, {3, "active"}, {4, "active"},
+		{3, "inactive"}, // update: removed from the partial index
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	keys := func(tbl *Table, index string) string {
+		var keys []interface{}
+
+		if err := tbl.ScanKeys(index, true, func(key []interface{}) bool {
+			keys = append(keys, key[0])
+			return true
+		}); err != nil {
+			t.Fatal("scan keys:", err)
+		}
+
+		return fmt.Sprint(keys)
+	}
+
+	if k := keys(tbl, "partial_id"); k != "[1 2 3 4]" {
+		t.Error("unexpected keys in full index:", k)
+	}
+
+	if k := keys(tbl, "partial_active"); k != "[1 4]" {
+		t.Error("unexpected keys in partial index:", k)
+	}
+
+	// the predicate is not persisted
+
+	ptbl, err := db.GetTable("partial")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if _, err := ptbl.Put(&TestRecord{5, "active"}); !errors.Is(err, NO_PREDICATE) {
+		t.Fatal("expected NO_PREDICATE, got", err)
+	}
+
+	if err := ptbl.SetPredicate("partial_id", active); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if err := ptbl.SetPredicate("partial_active", active); err != nil {
+		t.Fatal("set predicate:", err)
+	}
+
+	if _, err := ptbl.Put(&TestRecord{5, "active"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if _, err := ptbl.Put(&TestRecord{1, "inactive"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if k := keys(ptbl, "partial_active"); k != "[4 5]" {
+		t.Error("unexpected keys in partial index:", k)
+	}
+}
+
+func Test_40_GetBy(t *testing.T) {
+	tbl, err := db.CreateTable("getby")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("getby_user_date", true, 0, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("getby_last", false, 0, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{"bob", 20, "b20"}, {"alice", 30, "a30"}, {"bob", 10, "b10"},
+		{"alice", 20, "a20"}, {"carl", nil, "c-nil"}, {"carl", 5, "c5"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	for _, test := range []struct {
+		index    string
+		key      TestRecord
+		expected string
+	}{
+		{"getby_user_date", TestRecord{"alice"}, "a20"},
+		{"getby_user_date", TestRecord{"bob"}, "b10"},
+		{"getby_user_date", TestRecord{"carl"}, "c-nil"}, // nil first
+		{"getby_last", TestRecord{"carl"}, "c5"},         // nil last
+		{"getby_user_date", TestRecord{"bob", 20}, "b20"},
+	} {
+		var rec TestRecord
+
+		if err := tbl.GetBy(test.index, &test.key, &rec); err != nil {
+			t.Error(test.key, "get by:", err)
+		} else if s := string(rec[2].([]byte)); s != test.expected {
+			t.Error(test.key, "expected", test.expected, "got", s)
+		}
+	}
+
+	var rec TestRecord
+
+	if err := tbl.GetBy("getby_user_date", &TestRecord{"bo"}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	if err := tbl.GetBy("getby_user_date", &TestRecord{nil, 10}, &rec); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_41_Query(t *testing.T) {
+	tbl, err := db.CreateTable("query")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("query_cat_n", true, 0, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for _, cat := range []string{"b", "a"} {
+		for n := 1; n <= 5; n++ {
+			if _, err := tbl.Put(&TestRecord{cat, n}); err != nil {
+				t.Fatal("put:", err)
+			}
+		}
+	}
+
+	even := func(rec DataRecord) bool {
+		return rec.ToFieldList()[1].(int64)%2 == 0
+	}
+
+	for _, test := range []struct {
+		name     string
+		q        Query
+		expected string
+	}{
+		{"all", Query{}, "a1 a2 a3 a4 a5 b1 b2 b3 b4 b5"},
+		{"descending", Query{Descending: true}, "b5 b4 b3 b2 b1 a5 a4 a3 a2 a1"},
+		{"prefix", Query{Prefix: &TestRecord{"a"}}, "a1 a2 a3 a4 a5"},
+		{"prefix descending", Query{Prefix: &TestRecord{"a"}, Descending: true}, "a5 a4 a3 a2 a1"},
+		{"start", Query{Start: &TestRecord{"a", 4}}, "a4 a5 b1 b2 b3 b4 b5"},
+		{"end", Query{End: &TestRecord{"b"}}, "a1 a2 a3 a4 a5"},
+		{"start end", Query{Start: &TestRecord{"a", 4}, End: &TestRecord{"b", 2}}, "a4 a5 b1"},
+		{"start end descending", Query{Start: &TestRecord{"a", 4}, End: &TestRecord{"b", 2}, Descending: true}, "b1 a5 a4"},
+		{"prefix start end", Query{Prefix: &TestRecord{"a"}, Start: &TestRecord{"a", 2}, End: &TestRecord{"a", 4}}, "a2 a3"},
+		{"prefix wide end", Query{Prefix: &TestRecord{"a"}, End: &TestRecord{"c"}, Descending: true}, "a5 a4 a3 a2 a1"},
+		{"filter", Query{Filter: even}, "a2 a4 b2 b4"},
+		{"offset limit", Query{Offset: 2, Limit: 3}, "a3 a4 a5"},
+		{"limit descending", Query{Limit: 2, Descending: true}, "b5 b4"},
+		{"all options", Query{Prefix: &TestRecord{"b"}, Filter: even, Descending: true, Offset: 1, Limit: 5}, "b2"},
+		{"empty prefix", Query{Prefix: &TestRecord{"c"}}, ""},
+	} {
+		var res TestRecord
+		var got []string
+
+		test.q.Index = "query_cat_n"
+
+		if err := tbl.Query(test.q, &res, func(rec DataRecord) bool {
+			got = append(got, fmt.Sprintf("%s%v", res[0], res[1]))
+			return true
+		}); err != nil {
+			t.Error(test.name, "query:", err)
+			continue
+		}
+
+		if s := strings.Join(got, " "); s != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.name, test.expected, s)
+		}
+	}
+
+	var res TestRecord
+	count := 0
+
+	if err := tbl.Query(Query{Index: "query_cat_n"}, &res, func(rec DataRecord) bool {
+		count++
+		return count < 3
+	}); err != nil || count != 3 {
+		t.Error("expected to stop after 3 records, got", count, err)
+	}
+
+	if err := tbl.Query(Query{Index: "query_missing"}, &res, nil); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_42_RebuildIndex(t *testing.T) {
+	tbl, err := db.CreateTable("rebuild")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("rebuild_a", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("rebuild_b", true, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := tbl.Put(&TestRecord{i, fmt.Sprintf("name%v", i)}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	entries := func(index string) string {
+		var l []string
+
+		if err := tbl.ForEach(index, func(k, v []byte) error {
+			l = append(l, fmt.Sprintf("%q=%q", k, v))
+			return nil
+		}); err != nil {
+			t.Fatal("foreach:", err)
+		}
+
+		return strings.Join(l, ",")
+	}
+
+	a, b := entries("rebuild_a"), entries("rebuild_b")
+
+	// corrupt rebuild_b: remove an entry and add a bogus one
+
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		ib := tx.Bucket(indices("rebuild_b"))
+		k, _ := ib.Cursor().First()
+		return ib.Delete(k)
+	}); err != nil {
+		t.Fatal("delete entry:", err)
+	}
+
+	if err := tbl.PutRaw("rebuild_b", []byte("bogus"), []byte("bogus")); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	if entries("rebuild_b") == b {
+		t.Fatal("index not corrupted")
+	}
+
+	if err := tbl.RebuildIndex("rebuild_b"); err != nil {
+		t.Fatal("rebuild index:", err)
+	}
+
+	if entries("rebuild_b") != b {
+		t.Error("rebuild_b not rebuilt")
+	}
+
+	if entries("rebuild_a") != a {
+		t.Error("rebuild_a was modified")
+	}
+
+	if err := tbl.RebuildIndex("rebuild_missing"); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_43_Time_Fields(t *testing.T) {
+	tbl, err := db.CreateTable("times")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("times_t", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	times := []time.Time{
+		base.Add(48 * time.Hour),
+		base.Add(-100 * 365 * 24 * time.Hour), // before the epoch
+		base,
+		base.Add(time.Nanosecond),
+		base.Add(-time.Second),
+	}
+
+	for i, tm := range times {
+		if _, err := tbl.Put(&TestRecord{tm, i}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// a new handle loads the time fields from the table metadata
+	ttbl, err := db.GetTable("times")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	for _, tbl := range []*Table{tbl, ttbl} {
+		var rec TestRecord
+		var scanned []time.Time
+
+		if err := tbl.Scan("times_t", true, nil, &rec, func(r DataRecord, err error) bool {
+			if err != nil {
+				t.Fatal("scan:", err)
+			}
+
+			if tm, ok := rec[0].(time.Time); !ok {
+				t.Errorf("expected time.Time, got %T", rec[0])
+			} else {
+				scanned = append(scanned, tm)
+			}
+
+			return true
+		}); err != nil {
+			t.Fatal("scan:", err)
+		}
+
+		if len(scanned) != len(times) {
+			t.Fatal("expected", len(times), "records, got", len(scanned))
+		}
+
+		for i := 1; i < len(scanned); i++ {
+			if !scanned[i-1].Before(scanned[i]) {
+				t.Error("not in chronological order:", scanned[i-1], scanned[i])
+			}
+		}
+
+		if err := tbl.Get("times_t", &TestRecord{base}, &rec); err != nil {
+			t.Error("get:", err)
+		} else if !rec[0].(time.Time).Equal(base) || rec[1] != int64(2) {
+			t.Error("unexpected record", rec)
+		}
+	}
+}
+
+func Test_44_Nil_Records(t *testing.T) {
+	tbl, err := db.GetTable("seek")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+	var nilrec *TestRecord
+
+	key := &TestRecord{10}
+
+	for name, call := range map[string]func() error{
+		"Put":               func() error { _, err := tbl.Put(nil); return err },
+		"Put nil pointer":   func() error { _, err := tbl.Put(nilrec); return err },
+		"BatchPut":          func() error { _, err := tbl.BatchPut(nil); return err },
+		"ExplainPut":        func() error { _, err := tbl.ExplainPut(nil); return err },
+		"GetKey res":        func() error { return tbl.GetKey(1, nil) },
+		"Get key":           func() error { return tbl.Get("seek_n", nil, &rec) },
+		"Get res":           func() error { return tbl.Get("seek_n", key, nil) },
+		"Get nil pointer":   func() error { return tbl.Get("seek_n", key, nilrec) },
+		"GetBy key":         func() error { return tbl.GetBy("seek_n", nil, &rec) },
+		"GetBy res":         func() error { return tbl.GetBy("seek_n", key, nil) },
+		"GetNearest key":    func() error { return tbl.GetNearest("seek_n", nil, &rec, 1) },
+		"GetNearest res":    func() error { return tbl.GetNearest("seek_n", key, nil, 1) },
+		"First":             func() error { return tbl.First("seek_n", nil) },
+		"Last":              func() error { return tbl.Last("seek_n", nil) },
+		"Delete":            func() error { return tbl.Delete("seek_n", nil) },
+		"DeletePrefix":      func() error { _, err := tbl.DeletePrefix("seek_n", nil); return err },
+		"Scan res":          func() error { return tbl.Scan("seek_n", true, nil, nil, nil) },
+		"ScanFromToken res": func() error { _, err := tbl.ScanFromToken("seek_n", true, "", 0, nil, nil); return err },
+		"Query res":         func() error { return tbl.Query(Query{Index: "seek_n"}, nil, nil) },
+	} {
+		if err := call(); !errors.Is(err, BAD_VALUES) {
+			t.Error(name, "expected BAD_VALUES, got", err)
+		}
+	}
+
+	// a nil start is still valid for Scan
+	count := 0
+
+	if err := tbl.Scan("seek_n", true, nil, &rec, func(r DataRecord, err error) bool {
+		count++
+		return true
+	}); err != nil || count == 0 {
+		t.Error("scan with nil start:", count, err)
+	}
+}
+
+func Test_45_TableExists(t *testing.T) {
+	if exists, err := db.TableExists("exists"); err != nil || exists {
+		t.Fatal("expected table not to exist", exists, err)
+	}
+
+	if _, err := db.CreateTable("exists"); err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if exists, err := db.TableExists("exists"); err != nil || !exists {
+		t.Fatal("expected table to exist", exists, err)
+	}
+}
+
+func Test_46_IndexExists(t *testing.T) {
+	tbl, err := db.CreateTable("index_exists")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("index_exists_a", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if !tbl.IndexExists("index_exists_a") {
+		t.Error("expected index_exists_a to exist")
+	}
+
+	if tbl.IndexExists("index_exists_b") {
+		t.Error("expected index_exists_b not to exist")
+	}
+
+	// reserved names used for the table metadata are not indices
+	if tbl.IndexExists(string(metaName)) || tbl.IndexExists(string(dataName)) {
+		t.Error("metadata buckets reported as indices")
+	}
+
+	// created by another handle, only found in the schema
+	other, err := db.GetTable("index_exists")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := other.CreateIndex("index_exists_b", true, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if !tbl.IndexExists("index_exists_b") {
+		t.Error("expected index_exists_b to exist")
+	}
+}
+
+type jsonRecord struct {
+	ID   AutoIncrement
+	Name string
+}
+
+func Test_47_AutoIncrement_Type(t *testing.T) {
+	tbl, err := db.CreateTable("autotype")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("autotype_name", true, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	// the typed marker survives a serialization round trip
+
+	data, err := json.Marshal(jsonRecord{Name: "replayed"})
+	if err != nil {
+		t.Fatal("marshal:", err)
+	} else if string(data) != `{"ID":"$autoincrement","Name":"replayed"}` {
+		t.Error("unexpected encoding", string(data))
+	}
+
+	var jrec jsonRecord
+
+	if err := json.Unmarshal(data, &jrec); err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"ID":"42"}`), &jrec); err == nil {
+		t.Error("expected an error for a bad marker")
+	}
+
+	var ids []uint64
+
+	for _, rec := range []TestRecord{
+		{AUTOINCREMENT, "pointer"},
+		{jrec.ID, "typed"},
+		{&AutoIncrement{}, "typed pointer"},
+	} {
+		id, err := tbl.Put(&rec)
+		if err != nil {
+			t.Fatal("put:", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Error("unexpected ids", ids)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("autotype_name", &TestRecord{nil, "typed"}, &rec); err != nil {
+		t.Fatal("get:", err)
+	} else if rec[0] != uint64(2) {
+		t.Error("unexpected record", rec)
+	}
+}
+
+func Test_48_AutoIncrement_Sequences(t *testing.T) {
+	tbl, err := db.CreateTable("autoseq")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("autoseq_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{AUTOINCREMENT, AUTOINCREMENT, "a"},
+		{AUTOINCREMENT, AUTOINCREMENT, "b"},
+		{AUTOINCREMENT, 100, "c"}, // only advances the first sequence
+		{AUTOINCREMENT, AUTOINCREMENT, "d"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var got []string
+	var rec TestRecord
+
+	if err := tbl.Scan("autoseq_id", true, nil, &rec, func(r DataRecord, err error) bool {
+		got = append(got, fmt.Sprintf("%v/%v/%s", rec[0], rec[1], rec[2]))
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if s := strings.Join(got, " "); s != "1/1/a 2/2/b 3/100/c 4/3/d" {
+		t.Error("unexpected records", s)
+	}
+
+	if seq, err := tbl.CurrentSequence(); err != nil || seq != 4 {
+		t.Error("expected sequence 4, got", seq, err)
+	}
+}
+
+func Test_49_Vacuum(t *testing.T) {
+	// a previous run, or the tables created by other tests, shouldn't leave orphans
+	if removed, err := db.Vacuum(); err != nil {
+		t.Fatal("vacuum:", err)
+	} else if len(removed) > 0 {
+		t.Error("unexpected orphans", removed)
+	}
+
+	vtbl, err := db.CreateTable("vacuum")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := vtbl.CreateIndex("vacuum_name", true, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	key, err := typedbuffer.Encode("name", uint64(1))
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		// "orphan_idx" and "gone.orphan_idx" could be user buckets (there are no "orphan" or "gone" tables)
+		for _, name := range []string{"orphan_idx", "gone.orphan_idx", "vacuum.copy_idx", "vacuum_stale_idx"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(key, []byte("value")); err != nil {
+				return err
+			}
+		}
+
+		// named as an index of the table, but empty
+		if _, err := tx.CreateBucket([]byte("vacuum_empty_idx")); err != nil {
+			return err
+		}
+
+		// looks like an index bucket, but could be a table
+		b, err := tx.CreateBucket([]byte("nested_idx"))
+		if err != nil {
+			return err
+		}
+
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	}); err != nil {
+		t.Fatal("create buckets:", err)
+	}
+
+	if removed, err := db.Vacuum(); err != nil {
+		t.Fatal("vacuum:", err)
+	} else if fmt.Sprint(removed) != "[vacuum.copy_idx vacuum_stale_idx]" {
+		t.Error("unexpected removed buckets", removed)
+	}
+
+	if err := db.Bolt().View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("vacuum_stale_idx")) != nil {
+			t.Error("orphan not removed")
+		}
+
+		for _, name := range []string{"orphan_idx", "gone.orphan_idx", "vacuum_empty_idx"} {
+			if tx.Bucket([]byte(name)) == nil {
+				t.Error(name, "removed")
+			}
+		}
+
+		if tx.Bucket(indices("vacuum_name")) == nil {
+			t.Error("vacuum_name index removed")
+		}
+
+		if tx.Bucket([]byte("nested_idx")) == nil {
+			t.Error("nested_idx removed")
+		}
+
+		if tx.Bucket(indices("seek_n")) == nil {
+			t.Error("seek_n index removed")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("view:", err)
+	}
+
+	var rec TestRecord
+
+	tbl, err := db.GetTable("primary_copy")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := tbl.First("primary_name", &rec); err != nil {
+		t.Error("copied table index:", err)
+	}
+}
+
+func Test_50_Compression(t *testing.T) {
+	tbl, err := db.CreateTableOpts("compressed", TableOptions{Compression: GzipCompression})
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("compressed_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	text := strings.Repeat("all work and no play makes jack a dull boy. ", 200)
+
+	if _, err := tbl.Put(&TestRecord{1, text}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.ForEach("compressed_id", func(k, v []byte) error {
+		if len(v) >= len(text)/4 {
+			t.Error("value not compressed:", len(v), "bytes")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	// a record written without compression (i.e. before the option was set)
+
+	plain, err := typedbuffer.Encode("plain")
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	key, err := typedbuffer.Encode(int64(2))
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	if err := tbl.PutRaw("compressed_id", key, plain); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	// the option is stored with the table
+	ctbl, err := db.GetTable("compressed")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	if err := ctbl.Get("compressed_id", &TestRecord{1}, &rec); err != nil {
+		t.Fatal("get:", err)
+	} else if string(rec[1].([]byte)) != text {
+		t.Error("value mismatch")
+	}
+
+	if err := ctbl.Get("compressed_id", &TestRecord{2}, &rec); err != nil {
+		t.Fatal("get:", err)
+	} else if string(rec[1].([]byte)) != "plain" {
+		t.Error("value mismatch", rec)
+	}
+
+	if _, err := db.CreateTableOpts("compressed_bad", TableOptions{Compression: 42}); err != BAD_VALUES {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_51_Encryption(t *testing.T) {
+	const dbfile = "test_encrypted.db"
+
+	defer os.Remove(dbfile)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	if _, err := OpenEncrypted(dbfile, []byte("short")); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+
+	edb, err := OpenEncrypted(dbfile, key)
+	if err != nil {
+		t.Fatal("open encrypted:", err)
+	}
+
+	defer edb.Close()
+
+	tbl, err := edb.CreateTable("secret")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("secret_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "top secret"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.ForEach("secret_id", func(k, v []byte) error {
+		if strings.Contains(string(v), "top secret") {
+			t.Errorf("value not encrypted: %q", v)
+		}
+
+		if key, err := typedbuffer.DecodeAll(false, k); err != nil || len(key) != 1 || key[0] != int64(1) {
+			t.Errorf("key not readable: %q", k)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("secret_id", &TestRecord{1}, &rec); err != nil {
+		t.Fatal("get:", err)
+	} else if string(rec[1].([]byte)) != "top secret" {
+		t.Error("unexpected record", rec)
+	}
+
+	// without the key the values can't be read
+
+	if err := edb.Close(); err != nil {
+		t.Fatal("close:", err)
+	}
+
+	pdb, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer pdb.Close()
+
+	ptbl, err := pdb.GetTable("secret")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := ptbl.Get("secret_id", &TestRecord{1}, &rec); !errors.Is(err, ENCRYPTED) {
+		t.Error("expected ENCRYPTED, got", err)
+	}
+}
+
+func Test_52_Size(t *testing.T) {
+	tbl, err := db.CreateTable("size")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("size_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("size_small", true, 1); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if size, err := tbl.Size("size_id"); err != nil || size != 0 {
+		t.Error("expected empty index, got", size, err)
+	}
+
+	if size, err := tbl.Size(""); err != nil || size != 0 {
+		t.Error("expected empty primary storage, got", size, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, i, strings.Repeat("x", 100)}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var expected int64
+
+	if err := tbl.ForEach("size_id", func(k, v []byte) error {
+		expected += int64(len(k) + len(v))
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	if size, err := tbl.Size("size_id"); err != nil || size != expected {
+		t.Error("expected", expected, "got", size, err)
+	}
+
+	if size, err := tbl.Size(""); err != nil || size < 1000 {
+		t.Error("unexpected primary storage size", size, err)
+	}
+
+	if _, err := tbl.Size("size_missing"); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_53_Walk(t *testing.T) {
+	wdb, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open memory:", err)
+	}
+
+	defer wdb.Close()
+
+	for name, n := range map[string]int{"walk_a": 3, "walk_b": 2} {
+		tbl, err := wdb.CreateTable(name)
+		if err != nil {
+			t.Fatal("create table:", err)
+		}
+
+		for _, index := range []string{"_x", "_y"} {
+			if err := tbl.CreateIndex(name+index, true, 1); err != nil {
+				t.Fatal("create index:", err)
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			rec := TestRecord{nil, i}
+
+			if name == "walk_a" {
+				// with primary storage
+				rec[0] = AUTOINCREMENT
+			}
+
+			if _, err := tbl.Put(&rec); err != nil {
+				t.Fatal("put:", err)
+			}
+		}
+	}
+
+	if err := wdb.Bolt().Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("custom"))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("key"), []byte("value"))
+	}); err != nil {
+		t.Fatal("create bucket:", err)
+	}
+
+	counts := map[string]int{}
+	var ids []interface{}
+
+	if err := wdb.Walk(func(table string, k, v []byte) error {
+		counts[table]++
+
+		// the records of the table with primary storage are keyed by the primary key
+		if table == "walk_a" {
+			id, _, err := typedbuffer.Decode(k)
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, id)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("walk:", err)
+	}
+
+	if fmt.Sprint(counts) != "map[walk_a:3 walk_b:2]" {
+		t.Error("unexpected counts", counts)
+	}
+
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Error("unexpected primary keys", ids)
+	}
+}
+
+func Test_54_Range(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	key := func(n int) DataRecord {
+		return &TestRecord{n}
+	}
+
+	for _, test := range []struct {
+		ascending  bool
+		start, end DataRecord
+		expected   string
+	}{
+		{true, nil, nil, "[0 10 20 30 40 50 60 70 80 90]"},
+		{false, nil, nil, "[90 80 70 60 50 40 30 20 10 0]"},
+		{true, key(20), key(50), "[20 30 40 50]"},
+		{true, key(15), key(55), "[20 30 40 50]"},
+		{false, key(50), key(20), "[50 40 30 20]"},
+		{false, key(55), key(15), "[50 40 30 20]"}, // between existing keys
+		{false, key(1000), key(75), "[90 80]"},     // start above all keys
+		{false, key(1000), nil, "[90 80 70 60 50 40 30 20 10 0]"},
+		{false, key(-5), nil, "[]"},                 // start below all keys
+		{false, key(35), key(-100), "[30 20 10 0]"}, // end below all keys
+		{false, key(5), key(-5), "[0]"},
+		{true, key(95), nil, "[]"},
+		{true, key(-100), key(5), "[0]"},
+		{true, key(50), key(20), "[]"},
+		{false, key(20), key(50), "[]"},
+	} {
+		var rec TestRecord
+		var keys []interface{}
+
+		if err := tbl.Range("seek_n", test.ascending, test.start, test.end, &rec, func(r DataRecord, err error) bool {
+			keys = append(keys, rec[0])
+			return err == nil
+		}); err != nil {
+			t.Fatal("range:", err)
+		}
+
+		if s := fmt.Sprint(keys); s != test.expected {
+			t.Errorf("ascending=%v start=%v end=%v: expected %v, got %v", test.ascending, test.start, test.end, test.expected, s)
+		}
+	}
+
+	// a descending Scan starting below all keys doesn't return any record
+	var rec TestRecord
+
+	if err := tbl.Scan("seek_n", false, key(-5), &rec, func(r DataRecord, err error) bool {
+		t.Error("unexpected record", rec)
+		return false
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+}
+
+func Test_55_ReplaceAll(t *testing.T) {
+	tbl, err := db.CreateTable("replace")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("replace_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("replace_gen", true, 1, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	// generation n has 100+n*10 records
+
+	generation := func(gen int) []DataRecord {
+		recs := make([]DataRecord, 100+gen*10)
+		for i := range recs {
+			recs[i] = &TestRecord{AUTOINCREMENT, gen}
+		}
+
+		return recs
+	}
+
+	if err := tbl.ReplaceAll(generation(0)); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	done := make(chan bool)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			var rec TestRecord
+
+			count := 0
+			gens := map[int64]bool{}
+
+			if err := tbl.Scan("replace_id", true, nil, &rec, func(r DataRecord, err error) bool {
+				count++
+				gens[rec[1].(int64)] = true
+				return err == nil
+			}); err != nil {
+				errs <- err
+				return
+			}
+
+			for gen := range gens {
+				if len(gens) != 1 || count != 100+int(gen)*10 {
+					errs <- fmt.Errorf("partial set: %v records, generations %v", count, gens)
+					return
+				}
+			}
+		}
+	}()
+
+	for gen := 1; gen <= 10; gen++ {
+		if err := tbl.ReplaceAll(generation(gen)); err != nil {
+			t.Fatal("replace all:", err)
+		}
+	}
+
+	close(done)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	count := 0
+
+	if err := tbl.ForEach("replace_gen", func(k, v []byte) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal("foreach:", err)
+	}
+
+	if count != 200 {
+		t.Error("expected 200 entries in replace_gen, got", count)
+	}
+
+	if size, err := tbl.Size(""); err != nil || size == 0 {
+		t.Error("expected primary storage", size, err)
+	}
+}
+
+func Test_56_Take(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	newRecord := func() DataRecord {
+		return &TestRecord{}
+	}
+
+	recs, err := tbl.Take("seek_n", false, nil, 3, newRecord)
+	if err != nil {
+		t.Fatal("take:", err)
+	}
+
+	if len(recs) != 3 {
+		t.Fatal("expected 3 records, got", len(recs))
+	}
+
+	for i, expected := range []int64{90, 80, 70} {
+		if rec := *recs[i].(*TestRecord); rec[0] != expected {
+			t.Error("expected key", expected, "got", rec[0])
+		}
+	}
+
+	if recs[0] == recs[1] || recs[1] == recs[2] {
+		t.Error("records are not distinct")
+	}
+
+	if recs, err := tbl.Take("seek_n", true, &TestRecord{85}, 3, newRecord); err != nil || len(recs) != 1 {
+		t.Error("expected 1 record, got", len(recs), err)
+	}
+
+	if recs, err := tbl.Take("seek_n", true, nil, 0, newRecord); err != nil || len(recs) != 0 {
+		t.Error("expected no records, got", len(recs), err)
+	}
+}
+
+func Test_57_GroupCount(t *testing.T) {
+	tbl, err := db.CreateTable("groups")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateIndex("groups_id", true, 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.CreateIndex("groups_name", true, 2); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if err := tbl.SetCounterField("groups_id", 1); err != nil {
+		t.Fatal("set counter field:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{AUTOINCREMENT, "red", "a"},
+		{AUTOINCREMENT, "red", "b"},
+		{AUTOINCREMENT, "blue", "c"},
+		{AUTOINCREMENT, "red", "d"},
+		{AUTOINCREMENT, "green", "e"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// set after the records are added, so the counts are computed from the existing entries
+	if err := tbl.SetCounterField("groups_name", 1); err != nil {
+		t.Fatal("set counter field:", err)
+	}
+
+	check := func(when string, expected map[string]int) {
+		t.Helper()
+
+		for _, index := range []string{"groups_id", "groups_name"} {
+			for color, n := range expected {
+				if count, err := tbl.GroupCount(index, &TestRecord{nil, color}); err != nil || count != n {
+					t.Errorf("%v: expected %v %v records in %v, got %v %v", when, n, color, index, count, err)
+				}
+			}
+		}
+	}
+
+	check("after put", map[string]int{"red": 3, "blue": 1, "green": 1, "white": 0})
+
+	// move "b" from red to blue
+	if _, err := tbl.Put(&TestRecord{uint64(2), "blue", "b"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	check("after update", map[string]int{"red": 2, "blue": 2, "green": 1})
+
+	if err := tbl.Delete("groups_name", &TestRecord{nil, nil, "a"}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := tbl.DeleteKey(5); err != nil {
+		t.Fatal("delete key:", err)
+	}
+
+	check("after delete", map[string]int{"red": 1, "blue": 2, "green": 0})
+
+	if n, err := tbl.DeletePrefix("groups_id", &TestRecord{uint64(3)}); err != nil || n != 1 {
+		t.Fatal("delete prefix:", n, err)
+	}
+
+	check("after delete prefix", map[string]int{"red": 1, "blue": 1})
+
+	// the counter fields are stored in the table metadata
+	reloaded, err := db.GetTable("groups")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if count, err := reloaded.GroupCount("groups_name", &TestRecord{nil, "blue"}); err != nil || count != 1 {
+		t.Error("expected 1 blue record after reload, got", count, err)
+	}
+
+	if _, err := tbl.GroupCount("groups_id", &TestRecord{}); err != nil {
+		t.Error("group count with unset fields:", err)
+	}
+
+	if err := tbl.CreateIndex("groups_other", true, 1, 2); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if _, err := tbl.GroupCount("groups_other", &TestRecord{nil, "red"}); !errors.Is(err, NO_COUNTER) {
+		t.Error("expected NO_COUNTER, got", err)
+	}
+
+	if _, err := tbl.GroupCount("nothing", &TestRecord{nil, "red"}); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	if err := tbl.SetCounterField("groups_id"); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_58_OpenLarge(t *testing.T) {
+	const dbfile = "test_large.db"
+
+	defer os.Remove(dbfile)
+
+	ldb, err := OpenLarge(dbfile, 64)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer ldb.Close()
+
+	tbl, err := ldb.CreateTable("large")
+	if err == nil {
+		err = tbl.CreateIndex("large_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, strings.Repeat("x", 100)}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("large_id", &TestRecord{uint64(500)}, &rec); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if len(rec[1].([]byte)) != 100 {
+		t.Error("unexpected record", rec)
+	}
+
+	if _, err := OpenLarge(dbfile, -1); err != BAD_VALUES {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_59_ScanFieldsReuse(t *testing.T) {
+	tbl := getTable(t)
+
+	var expected []string
+
+	if err := tbl.ScanFields(INDEX_1, true, nil, func(fields []interface{}, err error) bool {
+		expected = append(expected, fmt.Sprint(fields...))
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan fields:", err)
+	}
+
+	var got []string
+	var prev []interface{}
+
+	reused := true
+
+	if err := tbl.ScanFieldsReuse(INDEX_1, true, nil, func(fields []interface{}) bool {
+		if prev != nil && &prev[0] != &fields[0] {
+			reused = false
+		}
+
+		prev = fields
+		got = append(got, fmt.Sprint(fields...))
+		return true
+	}); err != nil {
+		t.Fatal("scan fields reuse:", err)
+	}
+
+	if len(expected) == 0 || strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if !reused {
+		t.Error("the fields buffer was not reused")
+	}
+}
+
+func Test_60_Keys(t *testing.T) {
+	tbl, err := db.CreateTable("keys")
+	if err == nil {
+		err = tbl.CreateIndex("keys_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{1, "b", "x"},
+		{2, "a", "y"},
+		{3, "b", "z"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	keys, err := tbl.Keys("keys_name")
+	if err != nil {
+		t.Fatal("keys:", err)
+	}
+
+	var got []string
+
+	for _, key := range keys {
+		got = append(got, fmt.Sprintf("%s/%v", key...))
+	}
+
+	if s := strings.Join(got, " "); s != "a/2 b/1 b/3" {
+		t.Error("unexpected keys", s)
+	}
+
+	if _, err := tbl.Keys("nothing"); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_61_Upsert(t *testing.T) {
+	tbl, err := db.CreateTable("users")
+	if err == nil {
+		err = tbl.CreateIndex("users_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("users_email", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	id1, err := tbl.Upsert("users_email", &TestRecord{AUTOINCREMENT, "joe@example.com", "Joe"})
+	if err != nil {
+		t.Fatal("upsert:", err)
+	}
+
+	if _, err := tbl.Upsert("users_email", &TestRecord{AUTOINCREMENT, "ann@example.com", "Ann"}); err != nil {
+		t.Fatal("upsert:", err)
+	}
+
+	id2, err := tbl.Upsert("users_email", &TestRecord{AUTOINCREMENT, "joe@example.com", "Joseph"})
+	if err != nil {
+		t.Fatal("upsert:", err)
+	}
+
+	if id1 == 0 || id1 != id2 {
+		t.Error("expected the same id, got", id1, id2)
+	}
+
+	var got []string
+	var rec TestRecord
+
+	if err := tbl.Scan("users_id", true, nil, &rec, func(r DataRecord, err error) bool {
+		got = append(got, fmt.Sprintf("%v/%s/%s", rec...))
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if s := strings.Join(got, " "); s != "1/joe@example.com/Joseph 2/ann@example.com/Ann" {
+		t.Error("unexpected records", s)
+	}
+
+	if _, err := tbl.Upsert("nothing", &TestRecord{AUTOINCREMENT, "joe@example.com"}); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+}
+
+func Test_62_ScanProgress(t *testing.T) {
+	tbl, err := db.CreateTable("progress")
+	if err == nil {
+		err = tbl.CreateIndex("progress_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var recs []DataRecord
+
+	for i := 0; i < 2500; i++ {
+		recs = append(recs, &TestRecord{i})
+	}
+
+	if err := tbl.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	var rec TestRecord
+	var progress []int
+
+	rows := 0
+
+	if err := tbl.ScanProgress("progress_id", true, nil, &rec, func(r DataRecord, err error) bool {
+		rows++
+		return err == nil
+	}, func(seen int) {
+		progress = append(progress, seen)
+	}); err != nil {
+		t.Fatal("scan progress:", err)
+	}
+
+	if rows != 2500 || fmt.Sprint(progress) != "[1000 2000 2500]" {
+		t.Error("unexpected progress", rows, progress)
+	}
+
+	rows = 0
+
+	if err := tbl.ScanProgress("progress_id", true, nil, &rec, func(r DataRecord, err error) bool {
+		rows++
+		return rows < 10
+	}, nil); err != nil || rows != 10 {
+		t.Error("scan without progress:", rows, err)
+	}
+}
+
+func Test_63_GetViaIndex(t *testing.T) {
+	tbl, err := db.CreateTable("via")
+	if err == nil {
+		err = tbl.CreateIndex("via_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("via_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{AUTOINCREMENT, "a", "first", 1},
+		{AUTOINCREMENT, "b", "second", 2},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var rec TestRecord
+
+	if err := tbl.GetViaIndex("via_name", &TestRecord{nil, "b"}, &rec); err != nil {
+		t.Fatal("get via index:", err)
+	}
+
+	if s := fmt.Sprintf("%v/%s/%s/%v", rec...); s != "2/b/second/2" {
+		t.Error("unexpected record", s)
+	}
+
+	if err := tbl.GetViaIndex("via_name", &TestRecord{nil, "c"}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	// tables without primary storage return the index record
+	ntbl := getTable(t)
+
+	var expected TestRecord
+
+	if err := ntbl.First(INDEX_1, &expected); err != nil {
+		t.Fatal("first:", err)
+	}
+
+	if err := ntbl.GetViaIndex(INDEX_1, &expected, &rec); err != nil || fmt.Sprint(rec) != fmt.Sprint(expected) {
+		t.Error("expected", expected, "got", rec, err)
+	}
+}
+
+func Test_64_IncrField(t *testing.T) {
+	tbl, err := db.CreateTable("incr")
+	if err == nil {
+		err = tbl.CreateIndex("incr_name", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("incr_count", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{"visits", 0}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				if _, err := tbl.IncrField("incr_name", &TestRecord{"visits"}, 1, 1); err != nil {
+					t.Error("incr field:", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n, err := tbl.IncrField("incr_name", &TestRecord{"visits"}, 1, -50); err != nil || n != 150 {
+		t.Error("expected 150, got", n, err)
+	}
+
+	// the indexed field is updated in all indices
+	keys, err := tbl.Keys("incr_count")
+	if err != nil || len(keys) != 1 || keys[0][0] != int64(150) {
+		t.Error("unexpected keys", keys, err)
+	}
+
+	if _, err := tbl.IncrField("incr_name", &TestRecord{"visits"}, 0, 1); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if _, err := tbl.IncrField("incr_name", &TestRecord{"clicks"}, 1, 1); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+}
+
+func Test_65_ExternalField(t *testing.T) {
+	tbl, err := db.CreateTable("blobs")
+	if err == nil {
+		err = tbl.CreateIndex("blobs_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("blobs_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.SetExternalField(2); err != nil {
+		t.Fatal("set external field:", err)
+	}
+
+	if err := tbl.SetUpdatedField(3); err != nil {
+		t.Fatal("set updated field:", err)
+	}
+
+	blob := []byte(strings.Repeat("0123456789abcdef", 1<<16)) // 1MB
+
+	id, err := tbl.Put(&TestRecord{AUTOINCREMENT, "doc", blob, nil})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	// the index entries only contain the length of the blob
+	for _, index := range []string{"", "blobs_id", "blobs_name"} {
+		if size, err := tbl.Size(index); err != nil || size > 1024 {
+			t.Errorf("unexpected size for %q: %v %v", index, size, err)
+		}
+	}
+
+	if err := tbl.ScanFields("blobs_name", true, nil, func(fields []interface{}, err error) bool {
+		if fields[2] != int64(len(blob)) {
+			t.Error("expected the blob length, got", fields[2])
+		}
+
+		return err == nil
+	}); err != nil {
+		t.Fatal("scan fields:", err)
+	}
+
+	reloaded, err := db.GetTable("blobs")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	var rec TestRecord
+
+	if err := reloaded.Get("blobs_name", &TestRecord{nil, "doc"}, &rec); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if b, ok := rec[2].([]byte); !ok || !bytes.Equal(b, blob) {
+		t.Error("blob not restored")
+	}
+
+	// all the methods that return full records load the blob
+	restored := func(op string, rec DataRecord, err error) {
+		if err != nil {
+			t.Error(op+":", err)
+		} else if b, ok := (*rec.(*TestRecord))[2].([]byte); !ok || !bytes.Equal(b, blob) {
+			t.Error(op + ": blob not restored")
+		}
+	}
+
+	newRecord := func() DataRecord {
+		return &TestRecord{}
+	}
+
+	rec = nil
+	restored("First", &rec, tbl.First("blobs_name", &rec))
+	rec = nil
+	restored("Last", &rec, tbl.Last("blobs_name", &rec))
+	rec = nil
+	restored("GetNearest", &rec, tbl.GetNearest("blobs_name", &TestRecord{nil, "d"}, &rec, 1))
+
+	r, err := tbl.MinKey("blobs_name", newRecord)
+	restored("MinKey", r, err)
+	r, err = tbl.MaxKey("blobs_name", newRecord)
+	restored("MaxKey", r, err)
+
+	if cursor, err := tbl.Seek("blobs_name", nil); err != nil {
+		t.Error("seek:", err)
+	} else {
+		rec = nil
+		restored("Cursor.Record", &rec, cursor.Record(&rec))
+		cursor.Close()
+	}
+
+	if err := tbl.Query(Query{Index: "blobs_name"}, &TestRecord{}, func(rec DataRecord) bool {
+		restored("Query", rec, nil)
+		return true
+	}); err != nil {
+		t.Error("query:", err)
+	}
+
+	if err := tbl.MergeScan("blobs_id", "blobs_name", func(a, b DataRecord) bool { return false }, newRecord, func(rec DataRecord) bool {
+		restored("MergeScan", rec, nil)
+		return true
+	}); err != nil {
+		t.Error("merge scan:", err)
+	}
+
+	scanned := func(op string) func(DataRecord, error) bool {
+		return func(rec DataRecord, err error) bool {
+			restored(op, rec, err)
+			return true
+		}
+	}
+
+	if err := tbl.Scan("blobs_name", true, nil, &TestRecord{}, scanned("Scan")); err != nil {
+		t.Error("scan:", err)
+	}
+
+	if err := tbl.ScanProgress("blobs_name", true, nil, &TestRecord{}, scanned("ScanProgress"), nil); err != nil {
+		t.Error("scan progress:", err)
+	}
+
+	if err := tbl.Range("blobs_name", true, nil, nil, &TestRecord{}, scanned("Range")); err != nil {
+		t.Error("range:", err)
+	}
+
+	if _, err := tbl.ScanFromToken("blobs_name", true, "", 0, &TestRecord{}, func(rec DataRecord) bool {
+		restored("ScanFromToken", rec, nil)
+		return true
+	}); err != nil {
+		t.Error("scan from token:", err)
+	}
+
+	if err := tbl.ScanPrefixes("blobs_name", []DataRecord{&TestRecord{nil, "doc"}}, &TestRecord{}, func(rec DataRecord) bool {
+		restored("ScanPrefixes", rec, nil)
+		return true
+	}); err != nil {
+		t.Error("scan prefixes:", err)
+	}
+
+	if err := tbl.ScanGrouped("blobs_name", 1, newRecord, func(_ interface{}, members []DataRecord) {
+		for _, rec := range members {
+			restored("ScanGrouped", rec, nil)
+		}
+	}); err != nil {
+		t.Error("scan grouped:", err)
+	}
+
+	lists := map[string]func() ([]DataRecord, error){
+		"Take":      func() ([]DataRecord, error) { return tbl.Take("blobs_name", true, nil, 10, newRecord) },
+		"GetAll":    func() ([]DataRecord, error) { return tbl.GetAll("blobs_name", newRecord) },
+		"GetPrefix": func() ([]DataRecord, error) { return tbl.GetPrefix("blobs_name", &TestRecord{nil, "doc"}, newRecord) },
+		"ModifiedSince": func() ([]DataRecord, error) {
+			return tbl.ModifiedSince(time.Time{}, newRecord)
+		},
+	}
+
+	for op, list := range lists {
+		recs, err := list()
+		if err == nil && len(recs) != 1 {
+			t.Error(op+": expected 1 record, got", len(recs))
+		}
+
+		for _, rec := range recs {
+			restored(op, rec, err)
+		}
+
+		if err != nil {
+			t.Error(op+":", err)
+		}
+	}
+
+	if err := tbl.DeleteKey(id); err != nil {
+		t.Fatal("delete key:", err)
+	}
+
+	if err := db.Bolt().View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(schema("blobs")).Bucket(blobName).Stats().KeyN; n != 0 {
+			t.Error("expected no blobs, got", n)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("view:", err)
+	}
+}
+
+func Test_66_PutWith(t *testing.T) {
+	tbl, err := db.CreateTable("conflicts")
+	if err == nil {
+		err = tbl.CreateIndex("conflicts_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("conflicts_email", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	id, err := tbl.Put(&TestRecord{AUTOINCREMENT, "joe@example.com", "Joe"})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	name := func() string {
+		var rec TestRecord
+
+		if err := tbl.Get("conflicts_email", &TestRecord{nil, "joe@example.com"}, &rec); err != nil {
+			t.Fatal("get:", err)
+		}
+
+		return string(rec[2].([]byte))
+	}
+
+	// conflict on the email index
+	if key, err := tbl.PutWith(&TestRecord{AUTOINCREMENT, "joe@example.com", "Joseph"}, Ignore); err != nil || key != id {
+		t.Error("ignore: expected", id, "got", key, err)
+	}
+
+	if n := name(); n != "Joe" {
+		t.Error("ignore: record replaced with", n)
+	}
+
+	if _, err := tbl.PutWith(&TestRecord{AUTOINCREMENT, "joe@example.com", "Joseph"}, Fail); !errors.Is(err, DUPLICATE_KEY) {
+		t.Error("fail: expected DUPLICATE_KEY, got", err)
+	}
+
+	// conflict on the primary key
+	if _, err := tbl.PutWith(&TestRecord{id, "other@example.com", "Other"}, Fail); !errors.Is(err, DUPLICATE_KEY) {
+		t.Error("fail: expected DUPLICATE_KEY, got", err)
+	}
+
+	if seq, err := tbl.CurrentSequence(); err != nil || seq != id {
+		t.Error("expected sequence", id, "got", seq, err)
+	}
+
+	if _, err := tbl.PutWith(&TestRecord{id, "joe@example.com", "Joseph"}, Replace); err != nil {
+		t.Error("replace:", err)
+	}
+
+	if n := name(); n != "Joseph" {
+		t.Error("replace: record not replaced", n)
+	}
+
+	if _, err := tbl.PutWith(&TestRecord{AUTOINCREMENT, "ann@example.com", "Ann"}, Fail); err != nil {
+		t.Error("fail: unexpected error for a new record", err)
+	}
+
+	if _, err := tbl.PutWith(&TestRecord{AUTOINCREMENT}, ConflictPolicy(10)); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_67_UpdateWithRetry(t *testing.T) {
+	tbl, err := db.CreateTable("retry")
+	if err == nil {
+		err = tbl.CreateIndex("retry_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	calls := 0
+
+	if err := db.UpdateWithRetry(3, func(txn *Txn) error {
+		calls++
+
+		id, err := txn.Put(tbl, &TestRecord{AUTOINCREMENT, calls})
+		if err != nil {
+			return err
+		}
+
+		var rec TestRecord
+
+		if err := txn.Get(tbl, "retry_id", &TestRecord{id}, &rec); err != nil {
+			return err
+		}
+
+		if calls == 1 {
+			// transient failure: the first transaction is rolled back
+			return fmt.Errorf("conflict: %w", RETRY)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("update with retry:", err)
+	}
+
+	if calls != 2 {
+		t.Error("expected 2 calls, got", calls)
+	}
+
+	keys, err := tbl.Keys("retry_id")
+	if err != nil || len(keys) != 1 || keys[0][0] != uint64(1) {
+		t.Error("expected a single record, got", keys, err)
+	}
+
+	failure := errors.New("failure")
+	calls = 0
+
+	if err := db.UpdateWithRetry(3, func(txn *Txn) error {
+		calls++
+		return failure
+	}); err != failure || calls != 1 {
+		t.Error("expected a single failed call, got", calls, err)
+	}
+
+	calls = 0
+
+	if err := db.UpdateWithRetry(3, func(txn *Txn) error {
+		calls++
+		return RETRY
+	}); err != RETRY || calls != 3 {
+		t.Error("expected 3 retried calls, got", calls, err)
+	}
+}
+
+func Test_68_GetPrefix(t *testing.T) {
+	tbl, err := db.CreateTable("orders")
+	if err == nil {
+		err = tbl.CreateIndex("orders_customer", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{1, "bob", 10},
+		{2, "ann", 20},
+		{3, "bob", 30},
+		{4, "bobby", 40},
+		{5, "carl", 50},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	newRecord := func() DataRecord {
+		return &TestRecord{}
+	}
+
+	recs, err := tbl.GetPrefix("orders_customer", &TestRecord{nil, "bob"}, newRecord)
+	if err != nil {
+		t.Fatal("get prefix:", err)
+	}
+
+	var got []string
+
+	for _, rec := range recs {
+		got = append(got, fmt.Sprintf("%v/%s/%v", *rec.(*TestRecord)...))
+	}
+
+	if s := strings.Join(got, " "); s != "1/bob/10 3/bob/30" {
+		t.Error("unexpected records", s)
+	}
+
+	if recs, err := tbl.GetPrefix("orders_customer", &TestRecord{nil, "dave"}, newRecord); err != nil || len(recs) != 0 {
+		t.Error("expected no records, got", recs, err)
+	}
+
+	if _, err := tbl.GetPrefix("orders_customer", &TestRecord{}, newRecord); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_69_ChangeSequence(t *testing.T) {
+	const dbfile = "test_changes.db"
+
+	defer os.Remove(dbfile)
+
+	cdb, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer cdb.Close()
+
+	if seq, err := cdb.ChangeSequence(); err != nil || seq != 0 {
+		t.Error("expected sequence 0, got", seq, err)
+	}
+
+	tbl, err := cdb.CreateTable("changes")
+	if err == nil {
+		err = tbl.CreateIndex("changes_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var last uint64
+
+	advanced := func(op string, n uint64) {
+		t.Helper()
+
+		seq, err := cdb.ChangeSequence()
+		if err != nil || seq != last+n {
+			t.Errorf("%v: expected sequence %v, got %v %v", op, last+n, seq, err)
+		}
+
+		last = seq
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, i}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	advanced("put", 3)
+
+	if err := tbl.Delete("changes_id", &TestRecord{uint64(1)}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	advanced("delete", 1)
+
+	if err := tbl.DeleteKey(2); err != nil {
+		t.Fatal("delete key:", err)
+	}
+
+	advanced("delete key", 1)
+
+	if _, err := cdb.CreateTable("_store"); err != ALREADY_EXISTS {
+		t.Error("expected ALREADY_EXISTS for the reserved name, got", err)
+	}
+
+	if err := cdb.Close(); err != nil {
+		t.Fatal("close:", err)
+	}
+
+	if cdb, err = Open(dbfile); err != nil {
+		t.Fatal("reopen:", err)
+	}
+
+	advanced("reopen", 0)
+
+	if err := cdb.Walk(func(table string, k, v []byte) error {
+		if table != "changes" {
+			t.Error("unexpected table", table)
+		}
+
+		return nil
+	}); err != nil {
+		t.Error("walk:", err)
+	}
+
+	// a copy adds all the records to the new table
+	if err := cdb.CopyTable("changes", "changes_copy"); err != nil {
+		t.Fatal("copy table:", err)
+	}
+
+	advanced("copy table", 1)
+}
+
+func Test_70_NamedIndex(t *testing.T) {
+	tbl, err := db.CreateTable("named")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.CreateNamedIndex("named_email", true, "email"); !errors.Is(err, NO_SCHEMA) {
+		t.Error("expected NO_SCHEMA, got", err)
+	}
+
+	if err := tbl.SetFields("id", "name", "name"); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if err := tbl.SetFields("id", "name", "email"); err != nil {
+		t.Fatal("set fields:", err)
+	}
+
+	// the field names are stored with the table
+	tbl, err = db.GetTable("named")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := tbl.CreateNamedIndex("named_email", true, "email", "id"); err != nil {
+		t.Fatal("create named index:", err)
+	}
+
+	if err := tbl.CreateNamedIndex("named_phone", true, "phone"); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	for _, rec := range []TestRecord{
+		{1, "Joe", "joe@example.com"},
+		{2, "Ann", "ann@example.com"},
+	} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var rec TestRecord
+
+	if err := tbl.GetBy("named_email", &TestRecord{nil, nil, "ann@example.com"}, &rec); err != nil {
+		t.Fatal("get by:", err)
+	}
+
+	if s := fmt.Sprintf("%v/%s", rec[0], rec[1]); s != "2/Ann" {
+		t.Error("unexpected record", s)
+	}
+}
+
+func Test_71_RenumberKeys(t *testing.T) {
+	tbl, err := db.CreateTable("renumber")
+	if err == nil {
+		err = tbl.CreateIndex("renumber_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("renumber_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	for _, id := range []uint64{2, 4, 5} {
+		if err := tbl.DeleteKey(id); err != nil {
+			t.Fatal("delete key:", err)
+		}
+	}
+
+	keys, err := tbl.RenumberKeys()
+	if err != nil {
+		t.Fatal("renumber keys:", err)
+	}
+
+	if s := fmt.Sprint(keys); s != "map[1:1 3:2 6:3]" {
+		t.Error("unexpected mapping", s)
+	}
+
+	var rec TestRecord
+
+	for id, name := range []string{"a", "c", "f"} {
+		if err := tbl.GetKey(uint64(id+1), &rec); err != nil || string(rec[1].([]byte)) != name {
+			t.Error("get key:", id+1, rec, err)
+		}
+
+		if err := tbl.Get("renumber_name", &TestRecord{nil, name}, &rec); err != nil || rec[0] != uint64(id+1) {
+			t.Error("get by name:", name, rec, err)
+		}
+	}
+
+	if all, err := tbl.Keys("renumber_id"); err != nil || fmt.Sprint(all) != "[[1] [2] [3]]" {
+		t.Error("unexpected keys", all, err)
+	}
+
+	if id, err := tbl.Put(&TestRecord{AUTOINCREMENT, "g"}); err != nil || id != 4 {
+		t.Error("expected the next key to be 4, got", id, err)
+	}
+
+	// no primary storage
+	ktbl, err := db.GetTable("keys")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if _, err := ktbl.RenumberKeys(); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_72_ForEachFrom(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	collect := func(start []byte, reverse bool) string {
+		var keys []string
+
+		if err := tbl.ForEachFrom("seek_n", start, reverse, func(k, v []byte) error {
+			key, err := typedbuffer.DecodeAll(true, k)
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, fmt.Sprint(key[0]))
+			return nil
+		}); err != nil {
+			t.Fatal("for each from:", err)
+		}
+
+		return strings.Join(keys, " ")
+	}
+
+	key := func(n int64) []byte {
+		k, _ := typedbuffer.EncodeNils(true, n)
+		return k
+	}
+
+	for _, test := range []struct {
+		start    []byte
+		reverse  bool
+		expected string
+	}{
+		{key(50), false, "50 60 70 80 90"},
+		{key(50), true, "50 40 30 20 10 0"},
+		{key(55), false, "60 70 80 90"},
+		{key(55), true, "50 40 30 20 10 0"},
+		{key(95), true, "90 80 70 60 50 40 30 20 10 0"},
+		{key(-5), true, ""},
+		{nil, true, "90 80 70 60 50 40 30 20 10 0"},
+	} {
+		if got := collect(test.start, test.reverse); got != test.expected {
+			t.Errorf("start %v reverse %v: expected %q, got %q", test.start, test.reverse, test.expected, got)
+		}
+	}
+
+	stop := errors.New("stop")
+
+	if err := tbl.ForEachFrom("seek_n", nil, false, func(k, v []byte) error {
+		return stop
+	}); !errors.Is(err, stop) {
+		t.Error("expected the callback error, got", err)
+	}
+}
+
+type testStatus int
+
+const (
+	statusNew testStatus = iota
+	statusActive
+	statusClosed
+)
+
+func Test_73_Enum_Keys(t *testing.T) {
+	var recs []DataRecord
+
+	for i, status := range []testStatus{statusClosed, statusNew, statusActive, statusNew} {
+		recs = append(recs, &TestRecord{i, status, status})
+	}
+
+	_, tbl := testTable(t, db, "enums", "enums_status", []uint64{1, 0}, recs...)
+
+	info := tbl.indices["enums_status"]
+
+	k1, _, err1 := info.marshalKeyValue([]interface{}{1, statusActive})
+	k2, _, err2 := info.marshalKeyValue([]interface{}{int64(1), int64(statusActive)})
+	if err1 != nil || err2 != nil || !bytes.Equal(k1, k2) {
+		t.Error("different keys for the enum and int64 values", k1, k2, err1, err2)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("enums_status", &TestRecord{2, statusActive}, &rec); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	// the values are returned as the underlying type
+	if rec[1] != int64(statusActive) || rec[2] != int64(statusActive) {
+		t.Error("unexpected record", rec)
+	}
+
+	if n, err := tbl.DeletePrefix("enums_status", &TestRecord{nil, statusNew}); err != nil || n != 2 {
+		t.Error("expected 2 deleted records, got", n, err)
+	}
+}
+
+func Test_74_ValidateRecord(t *testing.T) {
+	tbl, err := db.CreateTable("validate")
+	if err == nil {
+		err = tbl.CreateIndex("validate_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("validate_name", true, 2, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if err := tbl.ValidateRecord(&TestRecord{1, "x", "name"}); err != nil {
+		t.Error("unexpected error for a valid record:", err)
+	}
+
+	if err := tbl.ValidateRecord(&TestRecord{1, "x"}); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	// not in strict mode: the missing field is indexed as nil
+	if _, err := tbl.Put(&TestRecord{1, "x"}); err != nil {
+		t.Error("put:", err)
+	}
+
+	tbl.Strict(true)
+
+	if _, err := tbl.Put(&TestRecord{2, "x"}); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{3, "x", "name"}); err != nil {
+		t.Error("put:", err)
+	}
+
+	if keys, err := tbl.Keys("validate_id"); err != nil || len(keys) != 2 {
+		t.Error("expected 2 records, got", keys, err)
+	}
+}
+
+func Test_75_Strict_Delete(t *testing.T) {
+	tbl, err := db.CreateTable("strict")
+	if err == nil {
+		err = tbl.CreateIndex("strict_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("strict_name", true, 2)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	// short records, written before enabling strict mode
+	for _, rec := range []TestRecord{{1, "x"}, {2, "y"}} {
+		if _, err := tbl.Put(&rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	tbl.Strict(true)
+
+	err = tbl.Delete("strict_id", &TestRecord{1})
+	if !errors.Is(err, BAD_VALUES) || !strings.Contains(err.Error(), "missing key field 2") {
+		t.Error("expected BAD_VALUES for field 2, got", err)
+	}
+
+	// the transaction was rolled back
+	var rec TestRecord
+
+	if err := tbl.Get("strict_id", &TestRecord{1}, &rec); err != nil {
+		t.Error("get:", err)
+	}
+
+	tbl.Strict(false)
+
+	if err := tbl.Delete("strict_id", &TestRecord{2}); err != nil {
+		t.Error("delete:", err)
+	}
+}
+
+func Test_76_PutRelated(t *testing.T) {
+	for _, name := range []string{"rel_orders", "rel_lines"} {
+		tbl, err := db.CreateTable(name)
+		if err == nil {
+			err = tbl.CreateIndex(name+"_id", true, 0)
+		}
+		if err != nil {
+			t.Fatal("create table:", err)
+		}
+	}
+
+	keys, err := db.PutRelated([]PutOp{
+		{"rel_orders", &TestRecord{AUTOINCREMENT, "order 1"}},
+		{"rel_lines", &TestRecord{AUTOINCREMENT, 1, "line 1"}},
+		{"rel_lines", &TestRecord{AUTOINCREMENT, 1, "line 2"}},
+	})
+	if err != nil {
+		t.Fatal("put related:", err)
+	}
+
+	if fmt.Sprint(keys) != "[1 1 2]" {
+		t.Error("unexpected keys", keys)
+	}
+
+	// the second operation fails, so the first one is rolled back
+	if _, err := db.PutRelated([]PutOp{
+		{"rel_orders", &TestRecord{AUTOINCREMENT, "order 2"}},
+		{"rel_nothing", &TestRecord{AUTOINCREMENT, 2, "line 1"}},
+	}); err != NO_TABLE {
+		t.Error("expected NO_TABLE, got", err)
+	}
+
+	orders, err := db.GetTable("rel_orders")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if keys, err := orders.Keys("rel_orders_id"); err != nil || len(keys) != 1 {
+		t.Error("expected a single order, got", keys, err)
+	}
+}
+
+func Test_77_Cache(t *testing.T) {
+	var recs []DataRecord
+
+	for i := 0; i < 3; i++ {
+		recs = append(recs, &TestRecord{i, "value"})
+	}
+
+	cdb, tbl := testTable(t, nil, "cached", "cached_id", []uint64{0}, recs...)
+
+	cdb.EnableCache(2)
+
+	var rec TestRecord
+
+	reads := func() int {
+		return cdb.Bolt().Stats().TxN
+	}
+
+	get := func(id int, expected string) {
+		t.Helper()
+
+		if err := tbl.Get("cached_id", &TestRecord{id}, &rec); err != nil || string(rec[1].([]byte)) != expected {
+			t.Error("get:", id, rec, err)
+		}
+	}
+
+	get(1, "value")
+
+	before := reads()
+
+	get(1, "value")
+
+	if n := reads() - before; n != 0 {
+		t.Error("expected a cached read, got", n, "transactions")
+	}
+
+	// Put invalidates the cache
+	if _, err := tbl.Put(&TestRecord{1, "updated"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	before = reads()
+
+	get(1, "updated")
+	get(1, "updated")
+
+	if n := reads() - before; n != 1 {
+		t.Error("expected 1 read transaction, got", n)
+	}
+
+	// the least recently used entry is evicted
+	get(0, "value")
+	get(2, "value")
+
+	before = reads()
+
+	get(1, "updated")
+
+	if n := reads() - before; n != 1 {
+		t.Error("expected 1 read transaction, got", n)
+	}
+
+	if err := tbl.Delete("cached_id", &TestRecord{1}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := tbl.Get("cached_id", &TestRecord{1}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY after delete, got", err)
+	}
+}
+
+func Test_78_Histogram(t *testing.T) {
+	tbl, err := db.CreateTable("histogram")
+	if err == nil {
+		err = tbl.CreateIndex("histogram_n", true, 0, 1)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("histogram_s", true, 2, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var recs []DataRecord
+
+	// 0 ... 99 and 100 more records with 5, so the first of 10 ranges has 110 records
+	for i := 0; i < 200; i++ {
+		n := i
+		if i >= 100 {
+			n = 5
+		}
+
+		recs = append(recs, &TestRecord{n, i, fmt.Sprintf("%c", 'a'+i%4)})
+	}
+
+	if err := tbl.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	hist, err := tbl.Histogram("histogram_n", 10)
+	if err != nil {
+		t.Fatal("histogram:", err)
+	}
+
+	if len(hist) != 10 {
+		t.Fatal("expected 10 ranges, got", len(hist))
+	}
+
+	for i, h := range hist {
+		expected := 10
+		if i == 0 {
+			expected = 110
+		}
+
+		if h.Count != expected {
+			t.Errorf("range %v (%v-%v): expected %v records, got %v", i, h.Low, h.High, expected, h.Count)
+		}
+	}
+
+	if hist[0].Low != 0.0 || hist[9].High != 99.0 {
+		t.Error("unexpected bounds", hist[0].Low, hist[9].High)
+	}
+
+	// strings: ranges with the same number of records
+	hist, err = tbl.Histogram("histogram_s", 4)
+	if err != nil {
+		t.Fatal("histogram:", err)
+	}
+
+	var got []string
+
+	for _, h := range hist {
+		got = append(got, fmt.Sprintf("%s-%s:%v", h.Low, h.High, h.Count))
+	}
+
+	if s := strings.Join(got, " "); s != "a-a:50 b-b:50 c-c:50 d-d:50" {
+		t.Error("unexpected histogram", s)
+	}
+
+	if _, err := tbl.Histogram("histogram_n", 0); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	// large indices are sampled
+	large, err := db.CreateTable("histogram_large")
+	if err == nil {
+		err = large.CreateIndex("histogram_large_n", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	const n = 5*histSample + 123
+
+	recs = recs[:0]
+
+	for i := 0; i < n; i++ {
+		recs = append(recs, &TestRecord{i})
+	}
+
+	if err := large.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	if hist, err = large.Histogram("histogram_large_n", 4); err != nil {
+		t.Fatal("histogram:", err)
+	}
+
+	total := 0
+
+	for i, h := range hist {
+		if d := h.Count - n/4; d < -n/100 || d > n/100 {
+			t.Errorf("range %v (%v-%v): expected about %v records, got %v", i, h.Low, h.High, n/4, h.Count)
+		}
+
+		total += h.Count
+	}
+
+	// the last key is always sampled
+	if hist[0].Low != 0.0 || hist[3].High != float64(n-1) || total != n {
+		t.Error("unexpected bounds", hist[0].Low, hist[3].High, total)
+	}
+
+	// the keys of hash indices are not ordered by value
+	if err := large.CreateHashIndex("histogram_large_hash", 0); err != nil {
+		t.Fatal("create index:", err)
+	}
+
+	if _, err := large.Histogram("histogram_large_hash", 4); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_79_Nil_Value(t *testing.T) {
+	tbl, err := db.CreateTable("nilvalue")
+	if err == nil {
+		err = tbl.CreateIndex("nilvalue_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, nil, "last"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	res := &TestRecord{}
+
+	if err := tbl.Get("nilvalue_id", &TestRecord{1}, res); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if len(*res) != 3 || (*res)[1] != nil || string((*res)[2].([]byte)) != "last" {
+		t.Error("unexpected record", *res)
+	}
+}
+
+func Test_80_Nil_Key(t *testing.T) {
+	_, tbl := testTable(t, db, "nilkey", "nilkey_name", []uint64{0, 1},
+		&TestRecord{"b", 2, "x"}, &TestRecord{nil, 1, "y"}, &TestRecord{"a", 3, "z"})
+
+	var got []string
+	var rec TestRecord
+
+	if err := tbl.Scan("nilkey_name", true, nil, &rec, func(rec DataRecord, err error) bool {
+		if err != nil {
+			t.Error("scan:", err)
+			return false
+		}
+
+		got = append(got, fmt.Sprint(rec.ToFieldList()...))
+		return true
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	// nil sorts first
+	if s := strings.Join(got, ","); s != "<nil> 1 [121],[97] 3 [122],[98] 2 [120]" {
+		t.Error("unexpected records", s)
+	}
+
+	keys, err := tbl.Keys("nilkey_name")
+	if err != nil || len(keys) != 3 || keys[0][0] != nil || keys[0][1] != int64(1) {
+		t.Error("unexpected keys", keys, err)
+	}
+}
+
+func Test_81_CoveringIndex(t *testing.T) {
+	tbl, err := db.CreateTable("covering")
+	if err == nil {
+		err = tbl.CreateIndex("covering_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateCoveringIndex("covering_name", true, []uint64{1}, []uint64{2})
+	}
+	if err == nil {
+		err = tbl.SetExternalField(4)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, bad := range [][2][]uint64{{{1}, {1}}, {{1}, nil}, {{1}, {2, 2}}, {{1}, {4}}} {
+		if err := tbl.CreateCoveringIndex("covering_bad", true, bad[0], bad[1]); !errors.Is(err, BAD_VALUES) {
+			t.Error("expected BAD_VALUES for", bad, "got", err)
+		}
+	}
+
+	// an included field can't be stored outside of the record
+	if err := tbl.SetExternalField(2); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	for _, name := range []string{"b", "a"} {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, name, "value " + name, "not included", "external"}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// the index values only contain the included fields
+	if err := tbl.ForEach("covering_name", func(k, v []byte) error {
+		if values, err := typedbuffer.DecodeAll(true, v); err != nil || len(values) != 1 {
+			t.Error("expected only the included field, got", values, err)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	// remove the primary storage: the scan should only read the index
+	if err := db.Update(func(txn *Txn) error {
+		return txn.Tx().Bucket(schema("covering")).DeleteBucket(dataName)
+	}); err != nil {
+		t.Fatal("delete primary storage:", err)
+	}
+
+	// the include list is persisted with the index
+	reloaded, err := db.GetTable("covering")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	for _, tbl := range []*Table{tbl, reloaded} {
+		var got []string
+		var rec TestRecord
+
+		if err := tbl.Scan("covering_name", true, nil, &rec, func(rec DataRecord, err error) bool {
+			if err != nil {
+				t.Error("scan:", err)
+				return false
+			}
+
+			fields := rec.ToFieldList()
+			if len(fields) != 3 {
+				t.Error("expected 3 fields, got", fields)
+				return false
+			}
+
+			got = append(got, fmt.Sprintf("%v %s=%s", fields[0], fields[1], fields[2]))
+			return true
+		}); err != nil {
+			t.Fatal("scan:", err)
+		}
+
+		// only the key field and the included field are set
+		if s := strings.Join(got, ","); s != "<nil> a=value a,<nil> b=value b" {
+			t.Error("unexpected records", s)
+		}
+	}
+
+	// the entries don't contain the full records
+	if err := tbl.Delete("covering_name", &TestRecord{nil, "a"}); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_82_WriteBatch(t *testing.T) {
+	tbl, err := db.CreateTable("writebatch")
+	if err == nil {
+		err = tbl.CreateIndex("writebatch_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "one"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	wb := tbl.NewBatch()
+	wb.Put(&TestRecord{2, "two"})
+	wb.Delete("writebatch_id", &TestRecord{1})
+	wb.Put(&TestRecord{3, "three"})
+
+	// nothing is written before Commit
+	if keys, _ := tbl.Keys("writebatch_id"); len(keys) != 1 {
+		t.Error("expected 1 record before commit, got", keys)
+	}
+
+	if err := wb.Commit(); err != nil {
+		t.Fatal("commit:", err)
+	}
+
+	if wb.Len() != 0 {
+		t.Error("expected an empty batch after commit")
+	}
+
+	if keys, err := tbl.Keys("writebatch_id"); err != nil || fmt.Sprint(keys) != "[[2] [3]]" {
+		t.Error("unexpected keys", keys, err)
+	}
+
+	// a failing operation rolls back the whole batch
+	wb.Put(&TestRecord{4, "four"})
+	wb.Delete("no_index", &TestRecord{2})
+
+	if err := wb.Commit(); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	if keys, err := tbl.Keys("writebatch_id"); err != nil || fmt.Sprint(keys) != "[[2] [3]]" {
+		t.Error("unexpected keys after rollback", keys, err)
+	}
+}
+
+func Test_83_Open_Shared(t *testing.T) {
+	const dbfile = "test_shared.db"
+
+	defer os.Remove(dbfile)
+
+	d1, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	// this would block forever without the registry
+	d2, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open again:", err)
+	}
+
+	if d1 == d2 || d1.Bolt() != d2.Bolt() {
+		t.Error("expected a new DataStore for the same database")
+	}
+
+	tbl, err := d1.CreateTable("shared")
+	if err == nil {
+		err = tbl.CreateIndex("shared_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "one"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := d1.Close(); err != nil {
+		t.Fatal("close:", err)
+	}
+
+	// closing the same DataStore again doesn't release the second one
+	if err := d1.Close(); err != nil {
+		t.Fatal("close again:", err)
+	}
+
+	if _, err := OpenEncrypted(dbfile, make([]byte, 32)); err != ALREADY_OPEN {
+		t.Error("expected ALREADY_OPEN, got", err)
+	}
+
+	// still open for the second reference
+	tbl2, err := d2.GetTable("shared")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if keys, err := tbl2.Keys("shared_id"); err != nil || len(keys) != 1 {
+		t.Error("expected 1 record, got", keys, err)
+	}
+
+	if err := d2.Close(); err != nil {
+		t.Fatal("close:", err)
+	}
+
+	if _, err := d2.GetTable("shared"); err == nil {
+		t.Error("expected an error after the last Close")
+	}
+
+	// a new Open after the last Close opens the database again
+	d3, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("reopen:", err)
+	}
+
+	defer d3.Close()
+
+	if d3.Bolt() == d1.Bolt() {
+		t.Error("expected a new database")
+	}
+}
+
+func Test_84_ReplicateTo(t *testing.T) {
+	src, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer src.Close()
+
+	dst, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer dst.Close()
+
+	tbl, err := src.CreateTable("replicate")
+	if err == nil {
+		err = tbl.CreateIndex("replicate_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("replicate_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var recs []DataRecord
+
+	for i := 0; i < 50; i++ {
+		recs = append(recs, &TestRecord{AUTOINCREMENT, fmt.Sprintf("name %02d", 49-i), i})
+	}
+
+	if err := tbl.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	if err := tbl.ReplicateTo(src, "replicate_copy", "replicate_id"); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	// twice: the second time the records are replaced
+	for i := 0; i < 2; i++ {
+		if err := tbl.ReplicateTo(dst, "replicate_copy", "replicate_id"); err != nil {
+			t.Fatal("replicate:", err)
+		}
+	}
+
+	dtbl, err := dst.GetTable("replicate_copy")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	for _, index := range []string{"replicate_id", "replicate_name"} {
+		var scans [2][]string
+
+		for i, st := range []*Table{tbl, dtbl} {
+			var rec TestRecord
+
+			if err := st.Scan(index, true, nil, &rec, func(rec DataRecord, err error) bool {
+				if err != nil {
+					t.Error("scan:", err)
+					return false
+				}
+
+				scans[i] = append(scans[i], fmt.Sprint(rec.ToFieldList()...))
+				return true
+			}); err != nil {
+				t.Fatal("scan:", err)
+			}
+		}
+
+		if len(scans[0]) != 50 || strings.Join(scans[0], ",") != strings.Join(scans[1], ",") {
+			t.Errorf("%v: expected %v, got %v", index, scans[0], scans[1])
+		}
+	}
+
+	if seq, _ := dtbl.CurrentSequence(); seq != 50 {
+		t.Error("expected sequence 50, got", seq)
+	}
+
+	// the sequence of the existing destination table follows the source one
+	for _, name := range []string{"new 1", "new 2"} {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, name, 0}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	if err := tbl.ReplicateTo(dst, "replicate_copy", "replicate_id"); err != nil {
+		t.Fatal("replicate:", err)
+	}
+
+	if seq, _ := dtbl.CurrentSequence(); seq != 52 {
+		t.Error("expected sequence 52, got", seq)
+	}
+
+	// but it's never lowered
+	if err := dtbl.SetSequence(100); err != nil {
+		t.Fatal("set sequence:", err)
+	}
+
+	if err := tbl.ReplicateTo(dst, "replicate_copy", "replicate_id"); err != nil {
+		t.Fatal("replicate:", err)
+	}
+
+	if seq, _ := dtbl.CurrentSequence(); seq != 100 {
+		t.Error("expected sequence 100, got", seq)
+	}
+}
+
+func Test_85_Changes(t *testing.T) {
+	src, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer src.Close()
+
+	dst, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer dst.Close()
+
+	if _, _, err := src.Changes(0); err != NO_CHANGELOG {
+		t.Error("expected NO_CHANGELOG, got", err)
+	}
+
+	tables := [2]*Table{}
+
+	for i, d := range []*DataStore{src, dst} {
+		tbl, err := d.CreateTable("changes")
+		if err == nil {
+			err = tbl.CreateIndex("changes_id", true, 0)
+		}
+		if err == nil {
+			err = tbl.CreateIndex("changes_name", true, 1, 0)
+		}
+		if err != nil {
+			t.Fatal("create table:", err)
+		}
+
+		tables[i] = tbl
+	}
+
+	if err := src.EnableChangeLog(); err != nil {
+		t.Fatal("enable change log:", err)
+	}
+
+	tbl := tables[0]
+
+	scan := func(tbl *Table) string {
+		var got []string
+		var rec TestRecord
+
+		if err := tbl.Scan("changes_name", true, nil, &rec, func(rec DataRecord, err error) bool {
+			got = append(got, fmt.Sprint(rec.ToFieldList()...))
+			return err == nil
+		}); err != nil {
+			t.Fatal("scan:", err)
+		}
+
+		return strings.Join(got, ",")
+	}
+
+	replicate := func(since uint64) uint64 {
+		changes, seq, err := src.Changes(since)
+		if err != nil {
+			t.Fatal("changes:", err)
+		}
+
+		if err := dst.ApplyChanges(changes); err != nil {
+			t.Fatal("apply changes:", err)
+		}
+
+		if s, d := scan(tbl), scan(tables[1]); s != d {
+			t.Errorf("expected %q, got %q", s, d)
+		}
+
+		return seq
+	}
+
+	for _, name := range []string{"one", "two", "three"} {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	seq := replicate(0)
+	if seq != 3 {
+		t.Error("expected sequence 3, got", seq)
+	}
+
+	// the new AUTOINCREMENT values of the destination table don't reuse the replayed primary keys
+	if n, err := tables[1].CurrentSequence(); err != nil || n != 3 {
+		t.Error("expected destination sequence 3, got", n, err)
+	}
+
+	// incremental changes
+	if err := tbl.Delete("changes_name", &TestRecord{uint64(2), "two"}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{uint64(1), "uno"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	changes, _, err := src.Changes(seq)
+	if err != nil || len(changes) != 2 || changes[0].Op != ChangeDelete || changes[1].Op != ChangePut {
+		t.Fatal("unexpected changes", changes, err)
+	}
+
+	seq = replicate(seq)
+
+	if err := tbl.ReplaceAll([]DataRecord{&TestRecord{AUTOINCREMENT, "four"}}); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	seq = replicate(seq)
+
+	if s := scan(tables[1]); s != "4 [102 111 117 114]" {
+		t.Error("unexpected records", s)
+	}
+
+	if err := src.TruncateChangeLog(seq); err != nil {
+		t.Fatal("truncate:", err)
+	}
+
+	if _, _, err := src.Changes(0); err != LOG_TRUNCATED {
+		t.Error("expected LOG_TRUNCATED, got", err)
+	}
+
+	if changes, _, err := src.Changes(seq); err != nil || len(changes) != 0 {
+		t.Error("expected no changes, got", changes, err)
+	}
+
+	// the records of a copied table are logged as puts of the new table
+	if err := src.CopyTable("changes", "changes_copy"); err != nil {
+		t.Fatal("copy table:", err)
+	}
+
+	if changes, _, err := src.Changes(seq); err != nil || len(changes) != 1 ||
+		changes[0].Table != "changes_copy" || changes[0].Op != ChangePut || fmt.Sprint(changes[0].Fields) != "[4 [102 111 117 114]]" {
+		t.Error("unexpected changes", changes, err)
+	}
+}
+
+func Test_86_RepairDeleteArtifacts(t *testing.T) {
+	rdb, tbl := testTable(t, nil, "repair", "repair_name", []uint64{1},
+		&TestRecord{AUTOINCREMENT, "one"}, &TestRecord{AUTOINCREMENT, "two"}, &TestRecord{AUTOINCREMENT, "three"})
+
+	// save the index entry of a record, delete the record and write the entry back (an orphan)
+	var orphan [2][]byte
+
+	if err := tbl.ForEach("repair_name", func(k, v []byte) error {
+		if orphan[0] == nil {
+			orphan = [2][]byte{append([]byte{}, k...), append([]byte{}, v...)}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.First("repair_name", &rec); err != nil {
+		t.Fatal("first:", err)
+	}
+
+	if err := tbl.DeleteKey(rec[0].(uint64)); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := tbl.PutRaw("repair_name", orphan[0], orphan[1]); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	if keys, _ := tbl.Keys("repair_name"); len(keys) != 3 {
+		t.Fatal("expected 3 entries (with the orphan), got", keys)
+	}
+
+	if n, err := rdb.RepairDeleteArtifacts(); err != nil || n != 1 {
+		t.Error("expected 1 repaired entry, got", n, err)
+	}
+
+	if keys, _ := tbl.Keys("repair_name"); fmt.Sprint(keys) != "[[[116 104 114 101 101]] [[116 119 111]]]" {
+		t.Error("unexpected entries", keys)
+	}
+
+	if n, err := rdb.RepairDeleteArtifacts(); err != nil || n != 0 {
+		t.Error("expected nothing to repair, got", n, err)
+	}
+
+	// an entry left by an update: the record exists, but with a different key
+	var stale [2][]byte
+
+	if err := tbl.ForEach("repair_name", func(k, v []byte) error {
+		stale = [2][]byte{append([]byte{}, k...), append([]byte{}, v...)}
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{uint64(2), "deux"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.PutRaw("repair_name", stale[0], stale[1]); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	if n, err := rdb.RepairDeleteArtifacts(); err != nil || n != 1 {
+		t.Error("expected 1 repaired entry, got", n, err)
+	}
+
+	if keys, _ := tbl.Keys("repair_name"); fmt.Sprint(keys) != "[[[100 101 117 120]] [[116 104 114 101 101]]]" {
+		t.Error("unexpected entries", keys)
+	}
+
+	// a table without primary storage: the indices are checked against each other
+	tbl, err := rdb.CreateTable("repair_noprimary")
+	if err == nil {
+		err = tbl.CreateIndex("repair_noprimary_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("repair_noprimary_name", false, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i, name := range []string{"one", "two", "three"} {
+		if _, err := tbl.Put(&TestRecord{i + 1, name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	if err := tbl.ForEach("repair_noprimary_name", func(k, v []byte) error {
+		orphan = [2][]byte{append([]byte{}, k...), append([]byte{}, v...)}
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	// the last entry by name is record 2 ("two"): delete it and write the name entry back
+	if err := tbl.Delete("repair_noprimary_id", &TestRecord{2, nil}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := tbl.PutRaw("repair_noprimary_name", orphan[0], orphan[1]); err != nil {
+		t.Fatal("put raw:", err)
+	}
+
+	if err := rdb.Bolt().View(func(tx *bolt.Tx) error {
+		if tx.Bucket(schema("repair_noprimary")).Bucket(dataName) != nil {
+			t.Error("expected no primary storage")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("view:", err)
+	}
+
+	if n, err := rdb.RepairDeleteArtifacts(); err != nil || n != 1 {
+		t.Error("expected 1 repaired entry, got", n, err)
+	}
+
+	var names []string
+
+	if err := tbl.ForEach("repair_noprimary_name", func(k, v []byte) error {
+		names = append(names, fmt.Sprint(k))
+		return nil
+	}); err != nil {
+		t.Fatal("for each:", err)
+	}
+
+	if len(names) != 2 {
+		t.Error("expected 2 entries, got", names)
+	}
+
+	if err := tbl.Get("repair_noprimary_name", &TestRecord{2, "two"}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY for the orphan, got", rec, err)
+	}
+
+	if n, err := rdb.RepairDeleteArtifacts(); err != nil || n != 0 {
+		t.Error("expected nothing to repair, got", n, err)
+	}
+}
+
+func Test_87_Desc_Index(t *testing.T) {
+	tbl, err := db.CreateTable("desc")
+	if err == nil {
+		err = tbl.CreateIndexSpec("desc_name_n", true, FieldSpec{Field: 0}, FieldSpec{Field: 1, Desc: true})
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []*TestRecord{{"b", 1}, {"a", 2}, {"b", 30}, {"a", 10}, {"ab", 5}, {"b", -4}} {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	expected := "a 10,a 2,ab 5,b 30,b 1,b -4"
+
+	check := func(tbl *Table) {
+		var got []string
+		var rec TestRecord
+
+		if err := tbl.Scan("desc_name_n", true, nil, &rec, func(rec DataRecord, err error) bool {
+			if err != nil {
+				t.Error("scan:", err)
+				return false
+			}
+
+			fields := rec.ToFieldList()
+			got = append(got, fmt.Sprintf("%s %v", fields[0], fields[1]))
+			return true
+		}); err != nil {
+			t.Fatal("scan:", err)
+		}
+
+		if s := strings.Join(got, ","); s != expected {
+			t.Errorf("expected %q, got %q", expected, s)
+		}
+	}
+
+	check(tbl)
+
+	// the sort order is persisted
+	tbl, err = db.GetTable("desc")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	check(tbl)
+
+	res := &TestRecord{}
+
+	if err := tbl.Get("desc_name_n", &TestRecord{"b", 30}, res); err != nil || (*res)[1] != int64(30) {
+		t.Error("get:", *res, err)
+	}
+
+	if err := tbl.Delete("desc_name_n", &TestRecord{"b", 30}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	expected = "a 10,a 2,ab 5,b 1,b -4"
+	check(tbl)
+}
+
+func Test_88_GetAll(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	recs, err := tbl.GetAll("seek_n", func() DataRecord {
+		return &TestRecord{}
+	})
+	if err != nil {
+		t.Fatal("get all:", err)
+	}
+
+	if len(recs) != 10 {
+		t.Fatal("expected 10 records, got", len(recs))
+	}
+
+	for i, rec := range recs {
+		if key := (*rec.(*TestRecord))[0]; key != int64(i*10) {
+			t.Error("expected key", i*10, "got", key)
+		}
+	}
+
+	if recs[0] == recs[1] {
+		t.Error("records are not distinct")
+	}
+
+	if _, err := tbl.GetAll("seek_n", nil); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_89_IndicesFor(t *testing.T) {
+	tbl, err := db.CreateTable("indicesfor")
+	if err == nil {
+		err = tbl.CreateIndex("indicesfor_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("indicesfor_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	rec := &TestRecord{1, "one"}
+
+	if _, err := tbl.Put(rec); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	keys, err := tbl.IndicesFor(rec)
+	if err != nil || len(keys) != 2 || keys["indicesfor_id"] == nil || keys["indicesfor_name"] == nil {
+		t.Fatal("expected the record in both indices, got", keys, err)
+	}
+
+	// remove the entry from one index only (as an interrupted Delete)
+	if err := db.Update(func(txn *Txn) error {
+		return txn.Tx().Bucket(tbl.indices["indicesfor_name"].bucket).Delete(keys["indicesfor_name"])
+	}); err != nil {
+		t.Fatal("delete entry:", err)
+	}
+
+	keys, err = tbl.IndicesFor(rec)
+	if err != nil || len(keys) != 2 || keys["indicesfor_id"] == nil || keys["indicesfor_name"] != nil {
+		t.Error("expected the record only in indicesfor_id, got", keys, err)
+	}
+
+	if keys, err := tbl.IndicesFor(&TestRecord{2, "two"}); err != nil || keys["indicesfor_id"] != nil || keys["indicesfor_name"] != nil {
+		t.Error("expected no keys, got", keys, err)
+	}
+}
+
+func Test_90_MaxValueSize(t *testing.T) {
+	tbl, err := db.CreateTableOpts("maxvalue", TableOptions{MaxValueSize: 100})
+	if err == nil {
+		err = tbl.CreateIndex("maxvalue_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, strings.Repeat("x", 50)}); err != nil {
+		t.Error("put:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{2, strings.Repeat("x", 200)}); !errors.Is(err, VALUE_TOO_LARGE) {
+		t.Error("expected VALUE_TOO_LARGE, got", err)
+	}
+
+	// the limit is persisted
+	tbl, err = db.GetTable("maxvalue")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{3, strings.Repeat("x", 200)}); !errors.Is(err, VALUE_TOO_LARGE) {
+		t.Error("expected VALUE_TOO_LARGE, got", err)
+	}
+
+	if keys, err := tbl.Keys("maxvalue_id"); err != nil || len(keys) != 1 {
+		t.Error("expected 1 record, got", keys, err)
+	}
+
+	if _, err := db.CreateTableOpts("maxvalue_bad", TableOptions{MaxValueSize: -1}); err != BAD_VALUES {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_91_ScanPrefixes(t *testing.T) {
+	tbl, err := db.CreateTable("prefixes")
+	if err == nil {
+		err = tbl.CreateIndex("prefixes_tenant", true, 0, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var recs []DataRecord
+
+	for tenant := 1; tenant <= 5; tenant++ {
+		for id := 1; id <= 3; id++ {
+			recs = append(recs, &TestRecord{tenant, id})
+		}
+	}
+
+	if err := tbl.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	scan := func(prefixes ...DataRecord) string {
+		var got []string
+		var rec TestRecord
+
+		if err := tbl.ScanPrefixes("prefixes_tenant", prefixes, &rec, func(rec DataRecord) bool {
+			got = append(got, fmt.Sprint(rec.ToFieldList()...))
+			return true
+		}); err != nil {
+			t.Fatal("scan prefixes:", err)
+		}
+
+		return strings.Join(got, ",")
+	}
+
+	// in key order, independently of the order of the prefixes
+	if s := scan(&TestRecord{4}, &TestRecord{2}); s != "2 1,2 2,2 3,4 1,4 2,4 3" {
+		t.Error("unexpected records", s)
+	}
+
+	// overlapping prefixes
+	if s := scan(&TestRecord{3, 2}, &TestRecord{3}, &TestRecord{5, 1}); s != "3 1,3 2,3 3,5 1" {
+		t.Error("unexpected records", s)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.ScanPrefixes("prefixes_tenant", []DataRecord{&TestRecord{}}, &rec, func(DataRecord) bool {
+		return true
+	}); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_92_SaveSchema(t *testing.T) {
+	tbl, err := db.CreateTable("saveschema")
+	if err == nil {
+		err = tbl.CreateNumericIndex("saveschema_n", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	info := tbl.indices["saveschema_n"]
+	info.nilFirst = false
+	info.numeric = false
+	tbl.indices["saveschema_n"] = info
+
+	if err := tbl.SaveSchema(); err != nil {
+		t.Fatal("save schema:", err)
+	}
+
+	tbl, err = db.GetTable("saveschema")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	info = tbl.indices["saveschema_n"]
+
+	if info.nilFirst || info.numeric {
+		t.Error("the index options were not saved", info.nilFirst, info.numeric)
+	}
+
+	if len(info.iplist) != 2 || info.iplist[0].field != 0 || info.iplist[0].pos != 1 || info.iplist[1].field != 1 || info.iplist[1].pos != 0 {
+		t.Error("unexpected key fields", info.iplist)
+	}
+}
+
+func Test_93_GetOrPut(t *testing.T) {
+	tbl, err := db.CreateTable("getorput")
+	if err == nil {
+		err = tbl.CreateIndex("getorput_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	const callers = 10
+
+	var wg sync.WaitGroup
+	var created int32
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var res TestRecord
+
+			ok, err := tbl.GetOrPut("getorput_name", &TestRecord{nil, "key"}, &TestRecord{AUTOINCREMENT, "key", i}, &res)
+			if err != nil {
+				t.Error("get or put:", err)
+				return
+			}
+
+			if ok {
+				atomic.AddInt32(&created, 1)
+			} else if len(res) != 3 || string(res[1].([]byte)) != "key" {
+				t.Error("unexpected record", res)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if created != 1 {
+		t.Error("expected 1 caller to create the record, got", created)
+	}
+
+	if keys, err := tbl.Keys("getorput_name"); err != nil || len(keys) != 1 {
+		t.Error("expected 1 record, got", keys, err)
+	}
+}
+
+func Test_94_Float_Keys(t *testing.T) {
+	tbl, err := db.CreateTable("floats")
+	if err == nil {
+		err = tbl.CreateIndex("floats_f", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	values := []float64{3.5, -1, 0, -100.25, 42, -0.5, math.Inf(-1), 1e-9, math.Inf(1)}
+
+	for i, f := range values {
+		if _, err := tbl.Put(&TestRecord{f, i}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var got []string
+	var rec TestRecord
+
+	if err := tbl.Scan("floats_f", true, nil, &rec, func(rec DataRecord, err error) bool {
+		if err != nil {
+			t.Error("scan:", err)
+			return false
+		}
+
+		got = append(got, fmt.Sprint(rec.ToFieldList()[0]))
+		return true
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if s := strings.Join(got, " "); s != "-Inf -100.25 -1 -0.5 0 1e-09 3.5 42 +Inf" {
+		t.Error("unexpected order", s)
+	}
+
+	res := &TestRecord{}
+
+	if err := tbl.Get("floats_f", &TestRecord{-0.5}, res); err != nil || (*res)[0] != -0.5 || (*res)[1] != int64(5) {
+		t.Error("get:", *res, err)
+	}
+
+	// range scan across the sign change
+	got = nil
+
+	if err := tbl.Query(Query{Index: "floats_f", Start: &TestRecord{-1.0}, End: &TestRecord{3.5}}, &rec, func(rec DataRecord) bool {
+		got = append(got, fmt.Sprint(rec.ToFieldList()[0]))
+		return true
+	}); err != nil {
+		t.Fatal("query:", err)
+	}
+
+	if s := strings.Join(got, " "); s != "-1 -0.5 0 1e-09" {
+		t.Error("unexpected range", s)
+	}
+}
+
+func Test_95_GetKeys(t *testing.T) {
+	tbl, err := db.CreateTable("getkeys")
+	if err == nil {
+		err = tbl.CreateIndex("getkeys_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var ids []uint64
+
+	for _, name := range []string{"one", "two", "three"} {
+		id, err := tbl.Put(&TestRecord{AUTOINCREMENT, name})
+		if err != nil {
+			t.Fatal("put:", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	recs, err := tbl.GetKeys([]uint64{ids[2], 1000, ids[0]}, func() DataRecord {
+		return &TestRecord{}
+	})
+	if err != nil {
+		t.Fatal("get keys:", err)
+	}
+
+	if len(recs) != 3 || recs[1] != nil {
+		t.Fatal("unexpected records", recs)
+	}
+
+	for i, expected := range []string{"three", "", "one"} {
+		if recs[i] == nil {
+			continue
+		}
+
+		if rec := *recs[i].(*TestRecord); string(rec[1].([]byte)) != expected {
+			t.Error("expected", expected, "got", rec)
+		}
+	}
+}
+
+func Test_96_Path_FileSize(t *testing.T) {
+	const dbfile = "test_path.db"
+
+	defer os.Remove(dbfile)
+
+	pdb, err := Open(dbfile)
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer pdb.Close()
+
+	if path := pdb.Path(); path != dbfile {
+		t.Error("expected path", dbfile, "got", path)
+	}
+
+	size, err := pdb.FileSize()
+	if err != nil || size <= 0 {
+		t.Fatal("file size:", size, err)
+	}
+
+	tbl, err := pdb.CreateTable("path")
+	if err == nil {
+		err = tbl.CreateIndex("path_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	var recs []DataRecord
+
+	for i := 0; i < 1000; i++ {
+		recs = append(recs, &TestRecord{i, strings.Repeat("x", 1000)})
+	}
+
+	if err := tbl.ReplaceAll(recs); err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	if grown, err := pdb.FileSize(); err != nil || grown <= size {
+		t.Error("expected the file to grow from", size, "got", grown, err)
+	}
+}
+
+func Test_97_SyncPolicy(t *testing.T) {
+	sdb, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer sdb.Close()
+
+	if err := sdb.SetSyncPolicy(SyncPolicy{Mode: SyncEveryN}); err != BAD_VALUES {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if err := sdb.SetSyncPolicy(SyncPolicy{Mode: SyncEveryN, N: 3}); err != nil {
+		t.Fatal("set sync policy:", err)
+	}
+
+	if !sdb.db.NoSync {
+		t.Error("expected NoSync for SyncEveryN")
+	}
+
+	tbl, err := sdb.CreateTable("sync")
+	if err == nil {
+		err = tbl.CreateIndex("sync_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i := 0; i < 7; i++ {
+		if _, err := tbl.Put(&TestRecord{i}); err != nil {
+			t.Fatal("put:", err)
+		}
+
+		if syncs := atomic.LoadUint64(&sdb.syncs); syncs != uint64((i+1)/3) {
+			t.Errorf("after %v writes: expected %v syncs, got %v", i+1, (i+1)/3, syncs)
+		}
+	}
+
+	// concurrent writes (and policy changes) don't lose counts
+	var wg sync.WaitGroup
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 10; i++ {
+				if g == 0 {
+					sdb.SetSyncPolicy(SyncPolicy{Mode: SyncEveryN, N: 3})
+				}
+
+				if _, err := tbl.Put(&TestRecord{100 + g*10 + i}); err != nil {
+					t.Error("put:", err)
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	if writes := atomic.LoadInt64(&sdb.writes); writes < 0 || writes >= 3 {
+		t.Error("expected less than 3 unsynced writes, got", writes)
+	}
+
+	sdb.SetBulk(false)
+
+	if sdb.db.NoSync {
+		t.Error("expected sync after every transaction")
+	}
+}
+
+func Test_98_MinKey_MaxKey(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	newRecord := func() DataRecord {
+		return &TestRecord{}
+	}
+
+	if rec, err := tbl.MinKey("seek_n", newRecord); err != nil || (*rec.(*TestRecord))[0] != int64(0) {
+		t.Error("expected min key 0, got", rec, err)
+	}
+
+	if rec, err := tbl.MaxKey("seek_n", newRecord); err != nil || (*rec.(*TestRecord))[0] != int64(90) {
+		t.Error("expected max key 90, got", rec, err)
+	}
+
+	empty, err := db.CreateTable("minmax_empty")
+	if err == nil {
+		err = empty.CreateIndex("minmax_empty_n", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := empty.MinKey("minmax_empty_n", newRecord); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	if _, err := empty.MaxKey("minmax_empty_n", newRecord); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+}
+
+func Test_100_Snapshot(t *testing.T) {
+	var recs []DataRecord
+
+	for i := 0; i < 10; i++ {
+		recs = append(recs, &TestRecord{i, "before"})
+	}
+
+	_, tbl := testTable(t, db, "snapshot", "snapshot_id", []uint64{0}, recs...)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal("snapshot:", err)
+	}
+
+	// a change after the snapshot is not visible in the snapshot
+	done := make(chan error)
+
+	go func() {
+		_, err := tbl.Put(&TestRecord{5, "after"})
+		done <- err
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatal("put:", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		res := &TestRecord{}
+
+		if err := tbl.GetSnapshot("snapshot_id", &TestRecord{i}, res, snap); err != nil {
+			t.Fatal("get snapshot:", err)
+		}
+
+		if string((*res)[1].([]byte)) != "before" {
+			t.Error("unexpected record", *res)
+		}
+	}
+
+	if err := tbl.GetSnapshot("snapshot_id", &TestRecord{42}, &TestRecord{}, snap); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Error("close:", err)
+	}
+
+	if err := tbl.GetSnapshot("snapshot_id", &TestRecord{1}, &TestRecord{}, snap); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES for a closed snapshot, got", err)
+	}
+
+	res := &TestRecord{}
+
+	if err := tbl.Get("snapshot_id", &TestRecord{5}, res); err != nil || string((*res)[1].([]byte)) != "after" {
+		t.Error("get:", *res, err)
+	}
+}
+
+func Test_101_Buckets(t *testing.T) {
+	tbl, err := db.CreateTable("buckets")
+	if err == nil {
+		err = tbl.CreateIndex("buckets_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	names, err := db.Buckets()
+	if err != nil {
+		t.Fatal("buckets:", err)
+	}
+
+	found := map[string]bool{}
+
+	for _, name := range names {
+		found[name] = true
+	}
+
+	for _, name := range []string{"buckets", "buckets_id_idx"} {
+		if !found[name] {
+			t.Error("missing bucket", name, "in", names)
+		}
+	}
+
+	if !sort.StringsAreSorted(names) {
+		t.Error("buckets not sorted", names)
+	}
+}
+
+func Test_102_AutoIncrement_Rollback(t *testing.T) {
+	tbl, err := db.CreateTable("autoinc")
+	if err == nil {
+		err = tbl.CreateIndex("autoinc_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("autoinc_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if key, err := tbl.Put(&TestRecord{AUTOINCREMENT, "first"}); err != nil || key != 1 {
+		t.Fatal("put:", key, err)
+	}
+
+	// make the writes to the secondary index fail
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("autoinc_name_idx"))
+	}); err != nil {
+		t.Fatal("delete bucket:", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "failed"}); err == nil {
+			t.Fatal("expected put to fail")
+		}
+	}
+
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("autoinc_name_idx"))
+		return err
+	}); err != nil {
+		t.Fatal("create bucket:", err)
+	}
+
+	key, err := tbl.Put(&TestRecord{AUTOINCREMENT, "second"})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if key != 2 {
+		t.Error("expected key 2 after the failed puts, got", key)
+	}
+
+	recs, err := tbl.GetAll("autoinc_id", func() DataRecord { return &TestRecord{} })
+	if err != nil || len(recs) != 2 {
+		t.Error("expected 2 records, got", recs, err)
+	}
+}
+
+func Test_103_SetIndexUnique(t *testing.T) {
+	tbl, err := db.CreateTable("uniq")
+	if err == nil {
+		err = tbl.CreateIndex("uniq_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("uniq_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	names := func() (list []string) {
+		tbl.Scan("uniq_name", true, nil, &TestRecord{}, func(rec DataRecord, err error) bool {
+			if err != nil {
+				t.Fatal("scan:", err)
+			}
+
+			list = append(list, string((*rec.(*TestRecord))[1].([]byte)))
+			return true
+		})
+
+		return
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// non-unique: records with the same name are all in the index
+	if err := tbl.SetIndexUnique("uniq_name", false); err != nil {
+		t.Fatal("set non-unique:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "b"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if list := names(); strings.Join(list, ",") != "a,b,b,c" {
+		t.Error("unexpected entries", list)
+	}
+
+	// the index definition is persisted
+	reloaded, err := db.GetTable("uniq")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if fields := reloaded.indices["uniq_name"].keyFields(); len(fields) != 2 || fields[1] != 0 {
+		t.Error("unexpected key fields", fields)
+	}
+
+	// unique with duplicates fails and leaves the index as it was
+	if err := tbl.SetIndexUnique("uniq_name", true); !errors.Is(err, DUPLICATE_KEY) {
+		t.Error("expected DUPLICATE_KEY, got", err)
+	}
+
+	if list := names(); strings.Join(list, ",") != "a,b,b,c" {
+		t.Error("unexpected entries after failed change", list)
+	}
+
+	if err := tbl.Delete("uniq_id", &TestRecord{uint64(4)}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := tbl.SetIndexUnique("uniq_name", true); err != nil {
+		t.Fatal("set unique:", err)
+	}
+
+	res := &TestRecord{}
+
+	if err := tbl.Get("uniq_name", &TestRecord{nil, "b"}, res); err != nil || (*res)[0] != uint64(2) {
+		t.Error("get:", *res, err)
+	}
+
+	if err := tbl.SetIndexUnique("uniq_id", false); err != nil {
+		t.Error("set non-unique on primary key:", err)
+	}
+
+	if err := tbl.SetIndexUnique("uniq_missing", true); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	// without primary storage the records are kept apart by the fields that are not in the key
+	np, err := db.CreateTable("uniq_noprimary")
+	if err == nil {
+		err = np.CreateIndex("uniq_noprimary_id", true, 0)
+	}
+	if err == nil {
+		err = np.CreateIndex("uniq_noprimary_name", true, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i, name := range []string{"a", "b"} {
+		if _, err := np.Put(&TestRecord{i + 1, name, "x"}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	if err := np.SetIndexUnique("uniq_noprimary_name", false); err != nil {
+		t.Fatal("set non-unique without primary storage:", err)
+	}
+
+	if _, err := np.Put(&TestRecord{3, "b", "y"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	var got []string
+
+	if err := np.Scan("uniq_noprimary_name", true, nil, &TestRecord{}, func(rec DataRecord, err error) bool {
+		if err != nil {
+			t.Fatal("scan:", err)
+		}
+
+		got = append(got, fmt.Sprint((*rec.(*TestRecord))[0]))
+		return true
+	}); err != nil {
+		t.Fatal("scan:", err)
+	}
+
+	if s := strings.Join(got, ","); s != "1,2,3" {
+		t.Error("unexpected entries", s)
+	}
+
+	if reloaded, err := db.GetTable("uniq_noprimary"); err != nil {
+		t.Fatal("get table:", err)
+	} else if fields := reloaded.indices["uniq_noprimary_name"].keyFields(); fmt.Sprint(fields) != "[1 0 2]" {
+		t.Error("unexpected key fields", fields)
+	}
+
+	if err := np.SetIndexUnique("uniq_noprimary_name", true); !errors.Is(err, DUPLICATE_KEY) {
+		t.Error("expected DUPLICATE_KEY, got", err)
+	}
+
+	if err := np.Delete("uniq_noprimary_id", &TestRecord{int64(3)}); err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if err := np.SetIndexUnique("uniq_noprimary_name", true); err != nil {
+		t.Fatal("set unique without primary storage:", err)
+	}
+
+	if fields := np.indices["uniq_noprimary_name"].keyFields(); fmt.Sprint(fields) != "[1]" {
+		t.Error("unexpected key fields", fields)
+	}
+}
+
+func Test_104_HashIndex(t *testing.T) {
+	tbl, err := db.CreateTable("hashed")
+	if err == nil {
+		err = tbl.CreateIndex("hashed_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateHashIndex("hashed_content", 1, 2)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []*TestRecord{
+		{AUTOINCREMENT, "some content", int64(1)},
+		{AUTOINCREMENT, "other content", int64(1)},
+		{AUTOINCREMENT, "some content", int64(1)},
+	} {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	keys, err := tbl.Keys("hashed_content")
+	if err != nil {
+		t.Fatal("keys:", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatal("expected 2 entries, got", len(keys))
+	}
+
+	if h, ok := keys[0][0].([]byte); !ok || len(h) != sha256.Size {
+		t.Error("expected a hash, got", keys[0])
+	}
+
+	// seen before: the entry is the last record put with the same content
+	res := &TestRecord{}
+
+	if err := tbl.Get("hashed_content", &TestRecord{nil, "some content", 1}, res); err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if (*res)[0] != uint64(3) || string((*res)[1].([]byte)) != "some content" || (*res)[2] != int64(1) {
+		t.Error("unexpected record", *res)
+	}
+
+	// not seen
+	if err := tbl.Get("hashed_content", &TestRecord{nil, "some content", 2}, res); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY, got", err)
+	}
+
+	// the option is persisted
+	reloaded, err := db.GetTable("hashed")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	if err := reloaded.Get("hashed_content", &TestRecord{nil, "other content", 1}, res); err != nil || (*res)[0] != uint64(2) {
+		t.Error("get after reload:", *res, err)
+	}
+}
+
+func Test_105_ScanGrouped(t *testing.T) {
+	tbl, err := db.CreateTable("grouped")
+	if err == nil {
+		err = tbl.CreateIndex("grouped_cat", true, 0, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []*TestRecord{
+		{"fruit", "pear"},
+		{"veg", "leek"},
+		{"fruit", "apple"},
+		{"nut", "almond"},
+		{"veg", "carrot"},
+		{"fruit", "fig"},
+	} {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	var groups []string
+
+	err = tbl.ScanGrouped("grouped_cat", 0, func() DataRecord { return &TestRecord{} }, func(key interface{}, members []DataRecord) {
+		names := make([]string, len(members))
+
+		for i, rec := range members {
+			names[i] = string((*rec.(*TestRecord))[1].([]byte))
+		}
+
+		groups = append(groups, string(key.([]byte))+":"+strings.Join(names, ","))
+	})
+	if err != nil {
+		t.Fatal("scan grouped:", err)
+	}
+
+	expected := []string{"fruit:apple,fig,pear", "nut:almond", "veg:carrot,leek"}
+
+	if strings.Join(groups, " ") != strings.Join(expected, " ") {
+		t.Error("expected", expected, "got", groups)
+	}
+}
+
+func Test_106_MergeScan(t *testing.T) {
+	tbl, err := db.CreateTable("merged")
+	if err == nil {
+		err = tbl.CreateIndex("merged_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreatePartialIndex("merged_open", true, func(rec DataRecord) bool {
+			return rec.ToFieldList()[1] == "open"
+		}, 2, 0)
+	}
+	if err == nil {
+		err = tbl.CreatePartialIndex("merged_closed", true, func(rec DataRecord) bool {
+			return rec.ToFieldList()[1] == "closed"
+		}, 2, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i, rec := range []*TestRecord{
+		{nil, "open", int64(30)},
+		{nil, "closed", int64(10)},
+		{nil, "open", int64(5)},
+		{nil, "closed", int64(40)},
+		{nil, "draft", int64(1)},
+		{nil, "closed", int64(20)},
+	} {
+		(*rec)[0] = int64(i)
+
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	value := func(rec DataRecord) int64 {
+		return (*rec.(*TestRecord))[2].(int64)
+	}
+
+	var values []int64
+
+	err = tbl.MergeScan("merged_open", "merged_closed", func(a, b DataRecord) bool {
+		return value(a) < value(b)
+	}, func() DataRecord { return &TestRecord{} }, func(rec DataRecord) bool {
+		values = append(values, value(rec))
+		return true
+	})
+	if err != nil {
+		t.Fatal("merge scan:", err)
+	}
+
+	if fmt.Sprint(values) != "[5 10 20 30 40]" {
+		t.Error("unexpected order", values)
+	}
+
+	values = nil
+
+	tbl.MergeScan("merged_open", "merged_closed", func(a, b DataRecord) bool {
+		return value(a) < value(b)
+	}, func() DataRecord { return &TestRecord{} }, func(rec DataRecord) bool {
+		values = append(values, value(rec))
+		return len(values) < 2
+	})
+
+	if fmt.Sprint(values) != "[5 10]" {
+		t.Error("expected the scan to stop after 2 records, got", values)
+	}
+
+	if err := tbl.MergeScan("merged_open", "merged_missing", func(a, b DataRecord) bool { return false },
+		func() DataRecord { return &TestRecord{} }, func(DataRecord) bool { return true }); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	// with primary storage the records in both indices are only returned once
+	tbl, err = db.CreateTable("merged_primary")
+	if err == nil {
+		err = tbl.CreateIndex("merged_primary_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreatePartialIndex("merged_primary_high", true, func(rec DataRecord) bool {
+			return rec.ToFieldList()[2].(int64) >= 20
+		}, 2, 0)
+	}
+	if err == nil {
+		err = tbl.CreatePartialIndex("merged_primary_closed", true, func(rec DataRecord) bool {
+			return rec.ToFieldList()[1] == "closed"
+		}, 2, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []*TestRecord{
+		{AUTOINCREMENT, "open", int64(30)},
+		{AUTOINCREMENT, "closed", int64(10)},
+		{AUTOINCREMENT, "open", int64(5)},
+		{AUTOINCREMENT, "closed", int64(40)},
+		{AUTOINCREMENT, "closed", int64(20)},
+	} {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	values = nil
+
+	err = tbl.MergeScan("merged_primary_high", "merged_primary_closed", func(a, b DataRecord) bool {
+		return value(a) < value(b)
+	}, func() DataRecord { return &TestRecord{} }, func(rec DataRecord) bool {
+		values = append(values, value(rec))
+		return true
+	})
+	if err != nil {
+		t.Fatal("merge scan:", err)
+	}
+
+	if fmt.Sprint(values) != "[10 20 30 40]" {
+		t.Error("unexpected records", values)
+	}
+}
+
+func Test_107_Composite_Key_Boundaries(t *testing.T) {
+	tbl, err := db.CreateTable("boundaries")
+	if err == nil {
+		err = tbl.CreateIndex("boundaries_key", true, 0, 1)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for _, rec := range []*TestRecord{
+		{"a", "bc", int64(1)},
+		{"ab", "c", int64(2)},
+		{[]byte("a"), []byte("b\x00c"), int64(3)},
+		{[]byte("a\x00b"), []byte("c"), int64(4)},
+	} {
+		if _, err := tbl.Put(rec); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	keys, err := tbl.Keys("boundaries_key")
+	if err != nil {
+		t.Fatal("keys:", err)
+	}
+
+	if len(keys) != 4 {
+		t.Fatal("expected 4 distinct keys, got", keys)
+	}
+
+	for _, test := range []struct {
+		key   *TestRecord
+		value int64
+	}{
+		{&TestRecord{"a", "bc"}, 1},
+		{&TestRecord{"ab", "c"}, 2},
+		{&TestRecord{"a", "b\x00c"}, 3},
+		{&TestRecord{"a\x00b", "c"}, 4},
+	} {
+		res := &TestRecord{}
+
+		if err := tbl.Get("boundaries_key", test.key, res); err != nil || (*res)[2] != test.value {
+			t.Error("get", *test.key, ":", *res, err)
+		}
+	}
+
+	// the prefix "a" matches the keys with "a" as the first field, not "ab" or "a\x00b"
+	recs, err := tbl.GetPrefix("boundaries_key", &TestRecord{"a"}, func() DataRecord { return &TestRecord{} })
+	if err != nil {
+		t.Fatal("get prefix:", err)
+	}
+
+	if len(recs) != 2 {
+		t.Error("expected 2 records with prefix \"a\", got", len(recs))
+	}
+
+	for _, rec := range recs {
+		if string((*rec.(*TestRecord))[0].([]byte)) != "a" {
+			t.Error("unexpected record for prefix", *rec.(*TestRecord))
+		}
+	}
+}
+
+func Test_108_ModifiedSince(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		name := fmt.Sprintf("modified_%v", indexed)
+
+		tbl, err := db.CreateTable(name)
+		if err == nil {
+			err = tbl.CreateIndex(name+"_id", true, 0)
+		}
+		if err == nil && indexed {
+			err = tbl.CreateIndex(name+"_updated", true, 2, 0)
+		}
+		if err == nil {
+			err = tbl.SetUpdatedField(2)
+		}
+		if err != nil {
+			t.Fatal("create table:", err)
+		}
+
+		for _, n := range []string{"a", "b", "c", "d"} {
+			if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, n, nil}); err != nil {
+				t.Fatal("put:", err)
+			}
+		}
+
+		time.Sleep(time.Millisecond)
+		since := time.Now()
+		time.Sleep(time.Millisecond)
+
+		// update b and add e
+		if _, err := tbl.Put(&TestRecord{uint64(2), "b2", nil}); err != nil {
+			t.Fatal("put:", err)
+		}
+
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "e", nil}); err != nil {
+			t.Fatal("put:", err)
+		}
+
+		recs, err := tbl.ModifiedSince(since, func() DataRecord { return &TestRecord{} })
+		if err != nil {
+			t.Fatal("modified since:", err)
+		}
+
+		var names []string
+
+		for _, rec := range recs {
+			r := *rec.(*TestRecord)
+			names = append(names, string(r[1].([]byte)))
+
+			if ts, ok := r[2].(time.Time); !ok || !ts.After(since) {
+				t.Error("unexpected last-modified time", r)
+			}
+		}
+
+		sort.Strings(names)
+
+		if strings.Join(names, ",") != "b2,e" {
+			t.Error("indexed:", indexed, "expected b2,e got", names)
+		}
+	}
+
+	tbl, err := db.CreateTable("modified_none")
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.ModifiedSince(time.Now(), func() DataRecord { return &TestRecord{} }); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES without a last-modified field, got", err)
+	}
+}
+
+func Test_109_Txn_ReadYourWrites(t *testing.T) {
+	tbl, err := db.CreateTable("txnread")
+	if err == nil {
+		err = tbl.CreateIndex("txnread_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{1, "old"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	value := func(rec *TestRecord) string {
+		return string((*rec)[1].([]byte))
+	}
+
+	if err := db.Update(func(txn *Txn) error {
+		if _, err := txn.Put(tbl, &TestRecord{1, "new"}); err != nil {
+			return err
+		}
+
+		var rec TestRecord
+
+		// the uncommitted write is visible in the transaction...
+		if err := txn.Get(tbl, "txnread_id", &TestRecord{1}, &rec); err != nil {
+			return err
+		}
+
+		if value(&rec) != "new" {
+			t.Error("expected the new value in the transaction, got", rec)
+		}
+
+		// ...but not outside
+		if err := tbl.Get("txnread_id", &TestRecord{1}, &rec); err != nil {
+			return err
+		}
+
+		if value(&rec) != "old" {
+			t.Error("expected the old value outside the transaction, got", rec)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("update:", err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("txnread_id", &TestRecord{1}, &rec); err != nil || value(&rec) != "new" {
+		t.Error("expected the new value after commit, got", rec, err)
+	}
+}
+
+func Test_110_Checksum(t *testing.T) {
+	build := func(name string, opts TableOptions, records []*TestRecord) *Table {
+		tbl, err := db.CreateTableOpts(name, opts)
+		if err == nil {
+			err = tbl.CreateIndex(name+"_id", true, 0)
+		}
+		if err != nil {
+			t.Fatal("create table:", err)
+		}
+
+		for _, rec := range records {
+			if _, err := tbl.Put(rec); err != nil {
+				t.Fatal("put:", err)
+			}
+		}
+
+		return tbl
+	}
+
+	records := []*TestRecord{{1, "one"}, {2, "two"}, {3, "three"}}
+	reversed := []*TestRecord{records[2], records[1], records[0]}
+
+	t1 := build("checksum1", TableOptions{}, records)
+	t2 := build("checksum2", TableOptions{Compression: GzipCompression}, reversed)
+
+	sum1, err := t1.Checksum("checksum1_id")
+	if err != nil {
+		t.Fatal("checksum:", err)
+	}
+
+	sum2, err := t2.Checksum("checksum2_id")
+	if err != nil {
+		t.Fatal("checksum:", err)
+	}
+
+	if sum1 != sum2 || len(sum1) != 2*sha256.Size {
+		t.Error("expected equal checksums, got", sum1, sum2)
+	}
+
+	if _, err := t2.Put(&TestRecord{2, "TWO"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if sum, err := t2.Checksum("checksum2_id"); err != nil || sum == sum1 {
+		t.Error("expected a different checksum after a change, got", sum, err)
+	}
+
+	if _, err := t1.Checksum("checksum_missing"); !errors.Is(err, NO_INDEX) {
+		t.Error("expected NO_INDEX, got", err)
+	}
+
+	// the external fields are stored outside of the entries (that only contain their length)
+	blobSum := func(name, value string) string {
+		tbl := build(name, TableOptions{}, nil)
+
+		if err := tbl.SetExternalField(1); err != nil {
+			t.Fatal("set external field:", err)
+		}
+
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, value}); err != nil {
+			t.Fatal("put:", err)
+		}
+
+		sum, err := tbl.Checksum(name + "_id")
+		if err != nil {
+			t.Fatal("checksum:", err)
+		}
+
+		return sum
+	}
+
+	if blobSum("checksum3", "aaaa") == blobSum("checksum4", "bbbb") {
+		t.Error("expected different checksums for different external fields")
+	}
+
+	if blobSum("checksum5", "aaaa") != blobSum("checksum6", "aaaa") {
+		t.Error("expected equal checksums for the same external fields")
+	}
+}
+
+func Test_111_Primary_Existing_Records(t *testing.T) {
+	tbl, err := db.CreateTable("primaryfill")
+	if err == nil {
+		err = tbl.CreateIndex("primaryfill_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("primaryfill_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	// records written before the primary storage is enabled (as by older versions)
+	for i, name := range []string{"a", "b", "c"} {
+		if _, err := tbl.Put(&TestRecord{uint64(i + 1), name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	if err := tbl.SetSequence(3); err != nil {
+		t.Fatal("set sequence:", err)
+	}
+
+	// the first AUTOINCREMENT record enables the primary storage
+	if key, err := tbl.Put(&TestRecord{AUTOINCREMENT, "d"}); err != nil || key != 4 {
+		t.Fatal("put:", key, err)
+	}
+
+	if err := tbl.RebuildIndex("primaryfill_name"); err != nil {
+		t.Fatal("rebuild index:", err)
+	}
+
+	keys, err := tbl.Keys("primaryfill_name")
+	if err != nil || len(keys) != 4 {
+		t.Error("expected 4 entries after rebuild, got", keys, err)
+	}
+
+	res := &TestRecord{}
+
+	if err := tbl.GetKey(1, res); err != nil || string((*res)[1].([]byte)) != "a" {
+		t.Error("get key:", *res, err)
+	}
+
+	// a record without a valid primary key: the primary storage is not enabled
+	tbl, err = db.CreateTable("primarynone")
+	if err == nil {
+		err = tbl.CreateIndex("primarynone_id", true, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{"x", "a"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "b"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if keys, err := tbl.Keys("primarynone_id"); err != nil || len(keys) != 2 {
+		t.Error("expected 2 entries, got", keys, err)
+	}
+
+	if err := tbl.GetKey(1, res); !errors.Is(err, NO_KEY) {
+		t.Error("expected no primary storage, got", err)
+	}
+
+	// indices that don't agree (a stale entry left in one of them): the primary storage is not enabled
+	tbl, err = db.CreateTable("primarystale")
+	if err == nil {
+		err = tbl.CreateIndex("primarystale_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("primarystale_name", true, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		if _, err := tbl.Put(&TestRecord{uint64(i + 1), name}); err != nil {
+			t.Fatal("put:", err)
+		}
+	}
+
+	// remove record 3 from one index only
+	if err := db.Bolt().Update(func(tx *bolt.Tx) error {
+		k, _, err := tbl.indices["primarystale_id"].marshalKeyValue([]interface{}{uint64(3), "c"})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(tbl.indices["primarystale_id"].bucket).Delete(k)
+	}); err != nil {
+		t.Fatal("delete entry:", err)
+	}
+
+	if err := tbl.SetSequence(3); err != nil {
+		t.Fatal("set sequence:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "d"}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	if err := tbl.GetKey(1, res); !errors.Is(err, NO_KEY) {
+		t.Error("expected no primary storage, got", err)
+	}
+
+	if err := db.Bolt().View(func(tx *bolt.Tx) error {
+		if tx.Bucket(schema("primarystale")).Bucket(dataName) != nil {
+			t.Error("expected no primary storage bucket")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal("view:", err)
+	}
+}
+
+func Test_112_Changes_Encrypted(t *testing.T) {
+	dbfile := filepath.Join(t.TempDir(), "test_changes.db")
+
+	edb, err := OpenEncrypted(dbfile, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal("open encrypted:", err)
+	}
+
+	defer edb.Close()
+
+	tbl, err := edb.CreateTable("changes_secret")
+	if err == nil {
+		err = tbl.CreateIndex("changes_secret_id", true, 0)
+	}
+	if err == nil {
+		err = edb.EnableChangeLog()
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	const secret = "very secret value"
+
+	if _, err := tbl.Put(&TestRecord{1, secret}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	entries := 0
+
+	if err := edb.Bolt().View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeName).Bucket(changeLogName).ForEach(func(k, v []byte) error {
+			entries++
+
+			if bytes.Contains(v, []byte(secret)) {
+				t.Error("the change log contains the plain value")
+			}
+
+			return nil
+		})
+	}); err != nil {
+		t.Fatal("view:", err)
+	}
+
+	if entries != 1 {
+		t.Error("expected 1 log entry, got", entries)
+	}
+
+	changes, _, err := edb.Changes(0)
+	if err != nil || len(changes) != 1 || string(changes[0].Fields[1].([]byte)) != secret {
+		t.Error("unexpected changes", changes, err)
+	}
+}
+
+func Test_113_Seek_Copy(t *testing.T) {
+	if err := db.CopyTable("seek", "seek_copy"); err != nil {
+		t.Fatal("copy table:", err)
+	}
+
+	tbl, err := db.GetTable("seek_copy")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	cursor, err := tbl.Seek("seek_n", &TestRecord{45})
+	if err != nil {
+		t.Fatal("seek:", err)
+	}
+
+	var rec TestRecord
+
+	if err := cursor.Record(&rec); err != nil || rec[0] != int64(50) {
+		t.Error("expected 50, got", rec, err)
+	}
+
+	cursor.Close()
+
+	// a typed nil key starts from the first record
+	var key *TestRecord
+
+	cursor, err = tbl.Seek("seek_n", key)
+	if err != nil {
+		t.Fatal("seek:", err)
+	}
+
+	defer cursor.Close()
+
+	if err := cursor.Record(&rec); err != nil || rec[0] != int64(0) {
+		t.Error("expected 0, got", rec, err)
+	}
+
+	// a typed nil record
+	if err := cursor.Record(key); !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+}
+
+func Test_114_BulkLoad_Errors(t *testing.T) {
+	tbl, err := db.CreateTable("bulkload_errors")
+	if err == nil {
+		err = tbl.CreateIndex("bulkload_errors_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.CreateIndex("bulkload_errors_n", false, 1, 0)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	recs := make(chan DataRecord)
+
+	go func() {
+		for i := 0; i < bulkChunk+10; i++ {
+			recs <- &TestRecord{AUTOINCREMENT, i}
+		}
+
+		// the load stops here
+		var rec *TestRecord
+		recs <- rec
+
+		close(recs)
+	}()
+
+	count, err := tbl.BulkLoad(recs)
+	if !errors.Is(err, BAD_VALUES) {
+		t.Error("expected BAD_VALUES, got", err)
+	}
+
+	if count != bulkChunk {
+		t.Error("expected", bulkChunk, "records, got", count)
+	}
+
+	// the channel is drained by the caller
+	for range recs {
+	}
+
+	// the committed chunk is indexed
+	for _, index := range []string{"bulkload_errors_id", "bulkload_errors_n"} {
+		if keys, err := tbl.Keys(index); err != nil || len(keys) != bulkChunk {
+			t.Error(index, ": expected", bulkChunk, "keys, got", len(keys), err)
+		}
+	}
+
+	// replacing records doesn't leave the previous entries
+	recs = make(chan DataRecord)
+
+	go func() {
+		for i := 1; i <= 10; i++ {
+			recs <- &TestRecord{i, -i}
+		}
+
+		close(recs)
+	}()
+
+	if count, err := tbl.BulkLoad(recs); err != nil || count != 10 {
+		t.Fatal("bulk load:", count, err)
+	}
+
+	if keys, err := tbl.Keys("bulkload_errors_n"); err != nil || len(keys) != bulkChunk {
+		t.Error("expected", bulkChunk, "keys, got", len(keys), err)
+	}
+
+	var rec TestRecord
+
+	if err := tbl.Get("bulkload_errors_n", &TestRecord{1, 0}, &rec); !errors.Is(err, NO_KEY) {
+		t.Error("expected NO_KEY for the replaced record, got", err)
+	}
+}
+
+func Test_115_Updated_Replicate(t *testing.T) {
+	src, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer src.Close()
+
+	dst, err := OpenMemory()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	defer dst.Close()
+
+	tbl, err := src.CreateTable("updated")
+	if err == nil {
+		err = tbl.CreateIndex("updated_id", true, 0)
+	}
+	if err == nil {
+		err = tbl.SetUpdatedField(2)
+	}
+	if err != nil {
+		t.Fatal("create table:", err)
+	}
+
+	if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "a", nil}); err != nil {
+		t.Fatal("put:", err)
+	}
+
+	updated := func(tbl *Table) time.Time {
+		var rec TestRecord
+
+		if err := tbl.GetKey(1, &rec); err != nil {
+			t.Fatal("get:", err)
+		}
+
+		ts, _ := rec[2].(time.Time)
+		return ts
+	}
+
+	stamped := updated(tbl)
+	if stamped.IsZero() {
+		t.Fatal("expected a last-modified time")
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if err := tbl.ReplicateTo(dst, "updated", "updated_id"); err != nil {
+		t.Fatal("replicate:", err)
+	}
+
+	dtbl, err := dst.GetTable("updated")
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	// the copy keeps the time of the original write
+	if ts := updated(dtbl); !ts.Equal(stamped) {
+		t.Error("expected", stamped, "got", ts)
+	}
+}
+
+func Test_116_Typed_Nil_Bounds(t *testing.T) {
+	tbl, err := db.GetTable("seek") // keys 0, 10, ... 90
+	if err != nil {
+		t.Fatal("get table:", err)
+	}
+
+	// a typed nil record is the same as no bound
+	var none *TestRecord
+
+	count := func(op string, scan func(res DataRecord, callback func(DataRecord) bool) error) {
+		n := 0
+
+		if err := scan(&TestRecord{}, func(DataRecord) bool {
+			n++
+			return true
+		}); err != nil {
+			t.Error(op+":", err)
+		} else if n != 10 {
+			t.Error(op+": expected 10 records, got", n)
+		}
+	}
+
+	count("Scan", func(res DataRecord, callback func(DataRecord) bool) error {
+		return tbl.Scan("seek_n", true, none, res, func(rec DataRecord, err error) bool {
+			return err == nil && callback(rec)
+		})
+	})
+
+	count("Range", func(res DataRecord, callback func(DataRecord) bool) error {
+		return tbl.Range("seek_n", true, none, none, res, func(rec DataRecord, err error) bool {
+			return err == nil && callback(rec)
+		})
+	})
+
+	count("Query", func(res DataRecord, callback func(DataRecord) bool) error {
+		return tbl.Query(Query{Index: "seek_n", Prefix: none, Start: none, End: none}, res, callback)
+	})
+}
+
+///////////////////////////////////////////////////////////////
+
+func benchTable(b *testing.B, name string) *Table {
+	tbl, err := db.GetTable(name)
+	if err == NO_TABLE {
+		if tbl, err = db.CreateTable(name); err == nil {
+			err = tbl.CreateIndex(name+"_id", true, 0)
+		}
+	}
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return tbl
+}
+
+func Benchmark_Put_Parallel(b *testing.B) {
+	tbl := benchTable(b, "bench_put")
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "some value"}); err != nil {
+				b.Error("put:", err)
+			}
+		}
+	})
+}
+
+func Benchmark_BatchPut_Parallel(b *testing.B) {
+	tbl := benchTable(b, "bench_batch")
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tbl.BatchPut(&TestRecord{AUTOINCREMENT, "some value"}); err != nil {
+				b.Error("batch put:", err)
+			}
+		}
+	})
+}
+
+func Benchmark_Put_Load(b *testing.B) {
+	tbl := benchTable(b, "bench_load_put")
+
+	for i := 0; i < b.N; i++ {
+		if _, err := tbl.Put(&TestRecord{AUTOINCREMENT, "some value"}); err != nil {
+			b.Fatal("put:", err)
+		}
+	}
+}
+
+func Benchmark_BulkLoad(b *testing.B) {
+	tbl := benchTable(b, "bench_load_bulk")
+
+	recs := make(chan DataRecord, 100)
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			recs <- &TestRecord{AUTOINCREMENT, "some value"}
+		}
+
+		close(recs)
+	}()
+
+	if _, err := tbl.BulkLoad(recs); err != nil {
+		b.Fatal("bulk load:", err)
+	}
+}
+
+func wideTable(b *testing.B) *Table {
+	tbl := benchTable(b, "bench_wide")
+
+	if err := tbl.First("bench_wide_id", &TestRecord{}); errors.Is(err, NO_KEY) {
+		for i := 0; i < 1000; i++ {
+			rec := TestRecord{AUTOINCREMENT}
+			for f := 0; f < 20; f++ {
+				rec = append(rec, fmt.Sprintf("field %v of record %v", f, i))
+			}
+
+			if _, err := tbl.Put(&rec); err != nil {
+				b.Fatal("put:", err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	return tbl
+}
+
+func Benchmark_Scan(b *testing.B) {
+	tbl := wideTable(b)
+
+	var rec TestRecord
+
+	for i := 0; i < b.N; i++ {
+		if err := tbl.Scan("bench_wide_id", true, nil, &rec, func(rec DataRecord, err error) bool {
+			return true
+		}); err != nil {
+			b.Fatal("scan:", err)
+		}
+	}
+}
+
+func Benchmark_ScanFields(b *testing.B) {
+	tbl := wideTable(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := tbl.ScanFields("bench_wide_id", true, nil, func(fields []interface{}, err error) bool {
+			return true
+		}); err != nil {
+			b.Fatal("scan fields:", err)
+		}
+	}
+}
+
+func Benchmark_ScanFieldsReuse(b *testing.B) {
+	tbl := wideTable(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := tbl.ScanFieldsReuse("bench_wide_id", true, nil, func(fields []interface{}) bool {
+			return true
+		}); err != nil {
+			b.Fatal("scan fields reuse:", err)
+		}
+	}
+}
+
+func Benchmark_ScanKeys(b *testing.B) {
+	tbl := wideTable(b)
+
+	for i := 0; i < b.N; i++ {
+		if err := tbl.ScanKeys("bench_wide_id", true, func(key []interface{}) bool {
+			return true
+		}); err != nil {
+			b.Fatal("scan keys:", err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package boltql
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// A LRU cache of index entries (the encoded values, keyed by table, index and encoded key) used by Get.
+//
+// The cache is invalidated as a whole when a transaction that modifies the records is committed: each entry
+// is tagged with the generation of the cache when the read started, and entries of older generations are ignored
+// (so that a read that overlaps a commit doesn't add a stale value).
+//
+type cache struct {
+	lock  sync.Mutex
+	size  int
+	gen   uint64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	gen   uint64
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+//
+// Enable a cache of the last size records read by Get (size <= 0 disables the cache, the default).
+//
+// The cache is consulted before reading from the database, and is cleared every time records are added,
+// updated or deleted, so it's only useful for tables that are read much more often than they are written
+// (the records of tables with external fields are never cached).
+//
+// The cache can be enabled or disabled while the DataStore is used: the running operations keep using
+// the cache they started with.
+//
+func (d *DataStore) EnableCache(size int) {
+	var c *cache
+	if size > 0 {
+		c = newCache(size)
+	}
+
+	d.cacheLock.Lock()
+	defer d.cacheLock.Unlock()
+
+	d.cache = c
+}
+
+//
+// return the cache (nil if not enabled)
+//
+func (d *DataStore) loadCache() *cache {
+	d.cacheLock.RLock()
+	defer d.cacheLock.RUnlock()
+
+	return d.cache
+}
+
+//
+// the cache key for an index entry
+//
+func cacheKey(table, index string, k []byte) string {
+	return table + "\x00" + index + "\x00" + string(k)
+}
+
+//
+// return the current generation (to tag the entries read from now on)
+//
+func (c *cache) generation() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.gen
+}
+
+func (c *cache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if entry.gen != c.gen {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *cache) add(key string, value []byte, gen uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if gen != c.gen {
+		// the value may be stale
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		e.Value = &cacheEntry{key: key, value: value, gen: gen}
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, value: value, gen: gen})
+
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+//
+// remove all the entries and start a new generation
+//
+func (c *cache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gen++
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
+
+//
+// clear the cache (if enabled) when the transaction is committed
+//
+func (d *DataStore) invalidate(tx *bolt.Tx) {
+	if c := d.loadCache(); c != nil {
+		tx.OnCommit(c.clear)
+	}
+}
+
+//
+// get a record given the index and the key, as get, but looking up the index entry in the cache first
+// (and adding it to the cache if not found)
+//
+func (t *Table) cachedGet(c *cache, index string, key, res DataRecord) error {
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	sk, _, err := info.marshalKeyValue(key.ToFieldList())
+	if err != nil {
+		return err
+	}
+
+	if sk == nil {
+		return NO_KEY
+	}
+
+	ck := cacheKey(t.name, index, sk)
+
+	v, ok := c.get(ck)
+	if !ok {
+		gen := c.generation()
+
+		err := t.d.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(info.bucket)
+			if b == nil {
+				return NO_INDEX
+			}
+
+			if v = b.Get(sk); v == nil {
+				return NO_KEY
+			}
+
+			// the value is only valid during the transaction
+			v = append([]byte{}, v...)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		c.add(ck, v, gen)
+	}
+
+	fields, err := t.decode(info, sk, v)
+	if err != nil {
+		return err
+	}
+
+	res.FromFieldList(fields)
+	return nil
+}
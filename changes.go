@@ -0,0 +1,427 @@
+package boltql
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/gobs/typedbuffer"
+)
+
+//
+// The store-wide metadata is stored in a top level bucket with this name (that can't be used as a table name)
+//
+var storeName = []byte("_store")
+
+//
+// create the schema bucket for a new table (returns ALREADY_EXISTS if the table exists or the name is reserved)
+//
+func createSchema(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	if name == string(storeName) {
+		return nil, ALREADY_EXISTS
+	}
+
+	return tx.CreateBucket(schema(name))
+}
+
+//
+// Return the change sequence of the store: a number incremented by every mutation of any table
+// (each record added, replaced or deleted), persisted with the data.
+//
+// A consumer that processes the changes can store the last sequence it has seen and compare it
+// with the current one (i.e. after a restart) to detect that it missed some changes.
+// The sequence is 0 for a store that was never modified.
+//
+func (d *DataStore) ChangeSequence() (uint64, error) {
+	db := d.db
+
+	var seq uint64
+
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(storeName); b != nil {
+			seq = b.Sequence()
+		}
+
+		return nil
+	})
+
+	return seq, err
+}
+
+//
+// advance the change sequence by n (the number of changed records),
+// invalidate the cache and count the writes for the sync policy when the transaction is committed
+//
+func (d *DataStore) changed(tx *bolt.Tx, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	d.invalidate(tx)
+
+	if p := d.policy(); p.Mode == SyncEveryN {
+		tx.OnCommit(func() {
+			d.countWrites(p, n)
+		})
+	}
+
+	b, err := tx.CreateBucketIfNotExists(storeName)
+	if err != nil {
+		return err
+	}
+
+	return b.SetSequence(b.Sequence() + uint64(n))
+}
+
+//
+// The change log (see EnableChangeLog) is a nested bucket of the store bucket, keyed by change sequence
+//
+var changeLogName = []byte("log")
+
+//
+// the keys of the change log options in the store bucket
+//
+var (
+	changeLogKey = []byte("changelog") // present if the change log is enabled
+	truncatedKey = []byte("truncated") // the highest sequence removed from the log
+)
+
+//
+// A ChangeOp is the type of a change in the change log
+//
+type ChangeOp int
+
+const (
+	ChangePut    ChangeOp = iota // a record was added or replaced
+	ChangeDelete                 // a record was deleted
+	ChangeClear                  // all the records of the table were removed (i.e. by ReplaceAll)
+)
+
+//
+// A Change is a mutation of a record, as returned by Changes.
+//
+// Fields contains the full record (for ChangePut, the record as written and, for ChangeDelete, the deleted record)
+// and is nil for ChangeClear. External fields (see SetExternalField) only contain the length of the values.
+//
+// Primary is the position of the primary key field, for tables with primary storage (-1 for the other tables),
+// so that ApplyChanges can replace the records by primary key.
+//
+type Change struct {
+	Seq     uint64
+	Table   string
+	Op      ChangeOp
+	Primary int
+	Fields  []interface{}
+}
+
+//
+// Start recording the changes of all the tables in a persisted change log, that can be read with Changes
+// (i.e. to replicate the changes to another store, with ApplyChanges, without full scans).
+//
+// The log only contains the changes after this call, so reading from an earlier sequence returns LOG_TRUNCATED.
+// The log grows with every change, so the consumers should call TruncateChangeLog after processing the changes.
+//
+// Enabling the change log again has no effect
+//
+func (d *DataStore) EnableChangeLog() error {
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(storeName)
+		if err != nil {
+			return err
+		}
+
+		if b.Get(changeLogKey) != nil {
+			return nil
+		}
+
+		if _, err := b.CreateBucketIfNotExists(changeLogName); err != nil {
+			return err
+		}
+
+		if err := b.Put(truncatedKey, seqKey(b.Sequence())); err != nil {
+			return err
+		}
+
+		return b.Put(changeLogKey, []byte{1})
+	})
+}
+
+//
+// Return the changes with a sequence greater than since (in sequence order) and the current change sequence,
+// that should be passed as since to the next call.
+//
+// Returns NO_CHANGELOG if the change log is not enabled and LOG_TRUNCATED if some of the changes after since
+// are not in the log anymore (see TruncateChangeLog), in which case the consumer should do a full copy
+// of the tables (i.e. with ReplicateTo) and read the changes from the current sequence.
+//
+// Changes made with PutRaw advance the sequence but are not in the log.
+// The log entries are compressed and encrypted as the records of the table, so for a store opened with OpenEncrypted
+// the changes can only be read by a store opened with the same key (the other stores get ENCRYPTED).
+//
+func (d *DataStore) Changes(since uint64) (changes []Change, seq uint64, err error) {
+	db := d.db
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeName)
+		if b == nil || b.Get(changeLogKey) == nil {
+			return NO_CHANGELOG
+		}
+
+		if since < truncatedSeq(b) {
+			return LOG_TRUNCATED
+		}
+
+		seq = b.Sequence()
+
+		c := b.Bucket(changeLogName).Cursor()
+
+		// the entries are sealed by the tables (see Table.changed), but only the store matters to open them
+		log := &Table{d: d}
+
+		for k, v := c.Seek(seqKey(since + 1)); k != nil; k, v = c.Next() {
+			v, _, err := log.openValue(v)
+			if err != nil {
+				return err
+			}
+
+			change, err := decodeChange(k, v)
+			if err != nil {
+				return err
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return changes, seq, nil
+}
+
+//
+// Remove the changes with a sequence lower or equal to upTo from the change log
+// (i.e. after all the consumers have processed them).
+//
+// Reading the changes from a sequence lower than upTo returns LOG_TRUNCATED
+//
+func (d *DataStore) TruncateChangeLog(upTo uint64) error {
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeName)
+		if b == nil || b.Get(changeLogKey) == nil {
+			return NO_CHANGELOG
+		}
+
+		if upTo <= truncatedSeq(b) {
+			return nil
+		}
+
+		log := b.Bucket(changeLogName)
+
+		var keys [][]byte
+
+		c := log.Cursor()
+
+		for k, _ := c.First(); k != nil && bytes.Compare(k, seqKey(upTo)) <= 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			if err := log.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return b.Put(truncatedKey, seqKey(upTo))
+	})
+}
+
+//
+// Apply the changes returned by Changes (i.e. from another store) in a single transaction.
+//
+// The tables should exist, with the same indices as the tables where the changes were made.
+// As for PutRelated, the predicates of partial indices are not available, so changes to tables
+// with partial indices return NO_PREDICATE.
+//
+// The sequence of each table is raised to the primary keys of the replayed records (if lower),
+// so that the AUTOINCREMENT values of new records don't reuse them.
+//
+func (d *DataStore) ApplyChanges(changes []Change) error {
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		tables := map[string]*Table{}
+
+		for _, change := range changes {
+			t, ok := tables[change.Table]
+			if !ok {
+				var err error
+
+				if t, err = d.loadTable(tx, change.Table); err != nil {
+					return err
+				}
+
+				tables[change.Table] = t
+			}
+
+			// the primary storage is enabled by the first record with an AUTOINCREMENT field,
+			// that the changes don't contain
+			if _, err := t.enablePrimary(tx.Bucket(schema(t.name)), change.Primary); err != nil {
+				return err
+			}
+
+			var err error
+
+			switch change.Op {
+			case ChangePut:
+				rec := fieldList(change.Fields)
+
+				// the new AUTOINCREMENT values must not reuse the primary keys of the replayed records
+				var key uint64
+				if key, err = t.replay(tx, &rec); err == nil {
+					err = raiseSequence(tx.Bucket(schema(t.name)), key)
+				}
+
+			case ChangeDelete:
+				err = t.deleteRecord(tx, change.Fields)
+
+			case ChangeClear:
+				if err = t.clear(tx, tx.Bucket(schema(t.name))); err == nil {
+					err = t.changed(tx, ChangeClear, nil)
+				}
+
+			default:
+				err = BAD_VALUES
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//
+// delete a record (given the full list of fields) from all the indices of the table
+//
+func (t *Table) deleteRecord(tx *bolt.Tx, fields []interface{}) error {
+	names := make([]string, 0, len(t.indices))
+	for index, info := range t.indices {
+		// the entries of covering indices don't contain the full records
+		if info.complete() {
+			names = append(names, index)
+		}
+	}
+
+	if len(names) == 0 {
+		return NO_INDEX
+	}
+
+	sort.Strings(names)
+
+	rec := fieldList(fields)
+
+	_, err := t.delete(tx, names[0], &rec)
+	return err
+}
+
+//
+// record a change of the table: advance the change sequence and, if the change log is enabled, add the change to the log
+//
+func (t *Table) changed(tx *bolt.Tx, op ChangeOp, fields []interface{}) error {
+	if err := t.d.changed(tx, 1); err != nil {
+		return err
+	}
+
+	b := tx.Bucket(storeName)
+	if b.Get(changeLogKey) == nil {
+		return nil
+	}
+
+	primary, err := primaryIndex(tx.Bucket(schema(t.name)))
+	if err != nil {
+		return err
+	}
+
+	pos := int64(-1)
+	if primary != nil {
+		pos = int64(primary.iplist[0].field)
+	}
+
+	values := make([]interface{}, 0, len(fields)+3)
+	values = append(values, t.name, int64(op), pos)
+
+	for _, f := range fields {
+		values = append(values, normalizeKey(f))
+	}
+
+	v, err := typedbuffer.EncodeNils(true, values...)
+	if err != nil {
+		return err
+	}
+
+	// the entries contain the records, so they are compressed and encrypted as the record values
+	if v, err = t.sealValue(v); err != nil {
+		return err
+	}
+
+	return b.Bucket(changeLogName).Put(seqKey(b.Sequence()), v)
+}
+
+//
+// the key of a change in the change log
+//
+func seqKey(seq uint64) []byte {
+	k, _ := typedbuffer.Encode(seq)
+	return k
+}
+
+//
+// return the highest sequence removed from the change log
+//
+func truncatedSeq(b *bolt.Bucket) uint64 {
+	seq, _, _ := typedbuffer.Decode(b.Get(truncatedKey))
+	n, _ := seq.(uint64)
+	return n
+}
+
+//
+// decode a change log entry
+//
+func decodeChange(k, v []byte) (change Change, err error) {
+	seq, _, err := typedbuffer.Decode(k)
+	if err != nil {
+		return change, err
+	}
+
+	values, err := typedbuffer.DecodeAll(true, v)
+	if err != nil {
+		return change, err
+	}
+
+	if len(values) < 3 {
+		return change, SCHEMA_CORRUPTED
+	}
+
+	n, _ := seq.(uint64)
+	name, _ := values[0].([]byte)
+	op, _ := values[1].(int64)
+	pos, _ := values[2].(int64)
+
+	change = Change{Seq: n, Table: string(name), Op: ChangeOp(op), Primary: int(pos)}
+
+	if change.Op != ChangeClear {
+		change.Fields = values[3:]
+	}
+
+	return change, nil
+}
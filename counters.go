@@ -0,0 +1,223 @@
+package boltql
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+	"github.com/gobs/typedbuffer"
+)
+
+//
+// The group counts of an index are stored in the table metadata, as "<index>/count/<group key>",
+// where the group key is the encoded list of the values of the counter fields
+//
+const countOption = "count/"
+
+//
+// Set the counter fields of an index: Put and Delete maintain the number of index entries for each
+// distinct combination of the values of the counter fields (a group), that can be read with GroupCount.
+//
+// The counts are computed for the existing entries of the index and then kept up to date by all the
+// operations that modify the index. Calling SetCounterField again replaces the counter fields (and recomputes the counts).
+//
+// Returns NO_INDEX if the index doesn't exist and BAD_VALUES if no field is specified
+//
+func (t *Table) SetCounterField(index string, groupFields ...uint64) (err error) {
+	defer t.wrapError("SetCounterField", index, &err)
+
+	db := t.d.db
+
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	if len(groupFields) == 0 {
+		return BAD_VALUES
+	}
+
+	info.counter = append([]uint64{}, groupFields...)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		ib := tx.Bucket(info.bucket)
+		if ib == nil {
+			return NO_INDEX
+		}
+
+		if err := info.saveOptions(b, index); err != nil {
+			return err
+		}
+
+		if err := clearCounts(b, index); err != nil {
+			return err
+		}
+
+		return ib.ForEach(func(k, v []byte) error {
+			return t.countEntry(tx, index, info, k, v, 1)
+		})
+	})
+
+	if err == nil {
+		t.indices[index] = info
+	}
+
+	return err
+}
+
+//
+// Return the number of entries in the index with the same values of the counter fields (see SetCounterField) as key.
+//
+// Only the counter fields of key are used (the other fields can be left unset).
+//
+// Returns NO_INDEX if the index doesn't exist and NO_COUNTER if the index has no counter fields
+//
+func (t *Table) GroupCount(index string, key DataRecord) (count int, err error) {
+	defer t.wrapError("GroupCount", index, &err)
+
+	if isNil(key) {
+		return 0, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	info, ok := t.indices[index]
+	if !ok {
+		return 0, NO_INDEX
+	}
+
+	if info.counter == nil {
+		return 0, NO_COUNTER
+	}
+
+	gk, err := info.groupKey(key.ToFieldList())
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		if n, ok := getMeta(b, countKey(index, gk)).(int64); ok {
+			count = int(n)
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+//
+// the metadata key for the count of a group
+//
+func countKey(index string, gk []byte) string {
+	return indexOption(index, countOption) + string(gk)
+}
+
+//
+// return the encoded values of the counter fields
+//
+func (info indexinfo) groupKey(fields []interface{}) ([]byte, error) {
+	values := make([]interface{}, len(info.counter))
+
+	for i, pos := range info.counter {
+		if pos < uint64(len(fields)) {
+			if isNested(fields[pos]) {
+				return nil, NESTED_KEY
+			}
+
+			values[i] = normalizeKey(fields[pos])
+		}
+	}
+
+	gk, err := typedbuffer.Encode(values...)
+	if err != nil {
+		return nil, BAD_VALUES
+	}
+
+	return gk, nil
+}
+
+//
+// update the count of the group of the record by delta (if the index has counter fields)
+//
+func (t *Table) countFields(tx *bolt.Tx, index string, info indexinfo, fields []interface{}, delta int64) error {
+	if info.counter == nil {
+		return nil
+	}
+
+	b := tx.Bucket(schema(t.name))
+	if b == nil {
+		return NO_TABLE
+	}
+
+	gk, err := info.groupKey(fields)
+	if err != nil {
+		return err
+	}
+
+	key := countKey(index, gk)
+
+	n, _ := getMeta(b, key).(int64)
+	if n += delta; n > 0 {
+		return putMeta(b, key, n)
+	}
+
+	if m := b.Bucket(metaName); m != nil {
+		return m.Delete([]byte(key))
+	}
+
+	return nil
+}
+
+//
+// update the count of the group of an existing index entry by delta
+// (nothing to do if the index has no counter fields or the entry doesn't exist, i.e. v is nil)
+//
+func (t *Table) countEntry(tx *bolt.Tx, index string, info indexinfo, k, v []byte, delta int64) error {
+	if info.counter == nil || v == nil {
+		return nil
+	}
+
+	fields, err := t.decode(info, k, v)
+	if err != nil {
+		return err
+	}
+
+	return t.countFields(tx, index, info, fields, delta)
+}
+
+//
+// remove all the group counts of an index
+//
+func clearCounts(b *bolt.Bucket, index string) error {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return nil
+	}
+
+	prefix := []byte(indexOption(index, countOption))
+
+	var keys [][]byte
+
+	c := m.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
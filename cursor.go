@@ -0,0 +1,145 @@
+package boltql
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+//
+// A Cursor is a handle positioned on an index entry, that can be moved in either direction.
+//
+// The cursor keeps a read transaction open until Close is called, so it should be closed
+// as soon as possible (and writes should not be attempted from the same goroutine while a cursor is open).
+//
+type Cursor struct {
+	t    *Table
+	tx   *bolt.Tx
+	c    *bolt.Cursor
+	info indexinfo
+
+	k, v []byte
+	eof  int // 0: positioned on a record, 1: past the last record, -1: before the first record
+}
+
+//
+// Return a cursor positioned on the first record with key greater or equal to the input key
+// (or on the first record of the index if key is nil)
+//
+func (t *Table) Seek(index string, key DataRecord) (cursor *Cursor, err error) {
+	defer t.wrapError("Seek", index, &err)
+
+	db := t.d.db
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	b := t.indexBucket(tx, index)
+	if b == nil {
+		tx.Rollback()
+		return nil, NO_INDEX
+	}
+
+	cursor = &Cursor{t: t, tx: tx, c: b.Cursor(), info: t.indices[index]}
+
+	var sk []byte
+
+	if !isNil(key) {
+		if sk, _, err = cursor.info.marshalKeyValue(key.ToFieldList()); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if sk == nil {
+		cursor.set(cursor.c.First())
+	} else {
+		cursor.set(cursor.c.Seek(sk))
+	}
+
+	if cursor.k == nil {
+		cursor.eof = 1
+	}
+
+	return cursor, nil
+}
+
+func (c *Cursor) set(k, v []byte) {
+	c.k, c.v = k, v
+	if k != nil {
+		c.eof = 0
+	}
+}
+
+//
+// Move to the next record. Returns false if there are no more records
+//
+func (c *Cursor) Next() bool {
+	switch c.eof {
+	case 1:
+		return false
+
+	case -1:
+		c.set(c.c.First())
+
+	default:
+		c.set(c.c.Next())
+	}
+
+	if c.k == nil {
+		c.eof = 1
+	}
+
+	return c.k != nil
+}
+
+//
+// Move to the previous record. Returns false if there are no more records
+//
+func (c *Cursor) Prev() bool {
+	switch c.eof {
+	case -1:
+		return false
+
+	case 1:
+		c.set(c.c.Last())
+
+	default:
+		c.set(c.c.Prev())
+	}
+
+	if c.k == nil {
+		c.eof = -1
+	}
+
+	return c.k != nil
+}
+
+//
+// Decode the current record into res. Returns NO_KEY if the cursor is not positioned on a record
+// and BAD_VALUES if res is nil
+//
+func (c *Cursor) Record(res DataRecord) error {
+	if isNil(res) {
+		return BAD_VALUES
+	}
+
+	if c.k == nil {
+		return NO_KEY
+	}
+
+	fields, err := c.t.decodeRecord(c.tx, c.info, c.k, c.v)
+	if err != nil {
+		return err
+	}
+
+	res.FromFieldList(fields)
+	return nil
+}
+
+//
+// Close the cursor, releasing the read transaction
+//
+func (c *Cursor) Close() error {
+	return c.tx.Rollback()
+}
@@ -0,0 +1,168 @@
+package boltql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+//
+// Record values can be wrapped in an "envelope", a small header that describes how the value was written
+// (i.e. the schema version of the record).
+//
+// An envelope starts with envelopeMarker (that is not a valid typedbuffer type) followed by a flags byte
+// and the optional header fields indicated by the flags. Values without the marker are plain typedbuffer encoded values.
+//
+const envelopeMarker = 0xFE
+
+const (
+	envVersion   = 1 << iota // the header contains the record schema version (uvarint)
+	envGzip                  // the value is compressed with gzip
+	envEncrypted             // the value is encrypted (AES-GCM, prefixed by the nonce)
+)
+
+//
+// wrap the encoded value in an envelope, if needed
+//
+func (t *Table) sealValue(v []byte) ([]byte, error) {
+	compress := t.compression == GzipCompression && len(v) > 0
+	aead := t.d.aead
+
+	if t.version == 0 && !compress && aead == nil {
+		return v, nil
+	}
+
+	header := make([]byte, 2, 2+binary.MaxVarintLen64)
+	header[0] = envelopeMarker
+
+	if t.version != 0 {
+		header[1] |= envVersion
+
+		var ver [binary.MaxVarintLen64]byte
+		header = append(header, ver[:binary.PutUvarint(ver[:], uint64(t.version))]...)
+	}
+
+	if compress {
+		header[1] |= envGzip
+
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(v); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		v = buf.Bytes()
+	}
+
+	if aead != nil {
+		header[1] |= envEncrypted
+
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+
+		// the header is authenticated, so that it can't be modified without failing the decryption
+		v = aead.Seal(nonce, nonce, v, header)
+	}
+
+	return append(header, v...), nil
+}
+
+//
+// unwrap the value from its envelope, returning the encoded value and the record schema version
+//
+func (t *Table) openValue(v []byte) ([]byte, int, error) {
+	if len(v) == 0 || v[0] != envelopeMarker {
+		return v, 0, nil
+	}
+
+	if len(v) < 2 {
+		return nil, 0, BAD_VALUES
+	}
+
+	flags := v[1]
+	hlen := 2
+
+	version := 0
+
+	if flags&envVersion != 0 {
+		ver, n := binary.Uvarint(v[hlen:])
+		if n <= 0 {
+			return nil, 0, BAD_VALUES
+		}
+
+		version = int(ver)
+		hlen += n
+	}
+
+	header, v := v[:hlen], v[hlen:]
+
+	if flags&envEncrypted != 0 {
+		aead := t.d.aead
+		if aead == nil {
+			return nil, 0, ENCRYPTED
+		}
+
+		if len(v) < aead.NonceSize() {
+			return nil, 0, BAD_VALUES
+		}
+
+		nonce, ciphertext := v[:aead.NonceSize()], v[aead.NonceSize():]
+
+		var err error
+
+		if v, err = aead.Open(nil, nonce, ciphertext, header); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if flags&envGzip != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(v))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if v, err = ioutil.ReadAll(r); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return v, version, nil
+}
+
+//
+// decode an index entry into a list of fields, upgrading old records if a migration function is registered
+//
+func (t *Table) decode(info indexinfo, k, v []byte) ([]interface{}, error) {
+	return t.decodeInto(nil, info, k, v)
+}
+
+//
+// decode an index entry as decode, reusing the fields buffer
+//
+func (t *Table) decodeInto(buf []interface{}, info indexinfo, k, v []byte) ([]interface{}, error) {
+	v, version, err := t.openValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := info.unmarshalInto(buf, k, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if version < t.version && t.migrate != nil {
+		fields = t.migrate(version, fields)
+	}
+
+	t.restoreTimeFields(fields)
+	return fields, nil
+}
@@ -0,0 +1,44 @@
+package boltql
+
+import (
+	"fmt"
+)
+
+//
+// Error is the error returned by table operations (Get, Put, Scan, Delete, etc.)
+// It adds the operation, table and index (if any) to the underlying error (i.e. NO_KEY),
+// that can be checked with errors.Is(err, NO_KEY) or retrieved with errors.Unwrap
+//
+type Error struct {
+	Op    string
+	Table string
+	Index string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Index == "" {
+		return fmt.Sprintf("boltql: %v %v: %v", e.Op, e.Table, e.Err)
+	}
+
+	return fmt.Sprintf("boltql: %v %v/%v: %v", e.Op, e.Table, e.Index, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//
+// wrap the error (if not nil) with the operation context (called via defer)
+//
+func (t *Table) wrapError(op, index string, err *error) {
+	if *err == nil {
+		return
+	}
+
+	if _, ok := (*err).(*Error); ok {
+		return
+	}
+
+	*err = &Error{Op: op, Table: t.name, Index: index, Err: *err}
+}
@@ -0,0 +1,122 @@
+package boltql
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// the field names of a table are stored in the table metadata, as "_field/<name>" with the field position
+//
+const fieldMeta = "_field/"
+
+//
+// Set the names of the record fields, in the order returned by ToFieldList (see CreateNamedIndex).
+//
+// The names are stored with the table and replace the ones previously set.
+// Returns BAD_VALUES if a name is empty or duplicated
+//
+func (t *Table) SetFields(names ...string) (err error) {
+	defer t.wrapError("SetFields", "", &err)
+
+	db := t.d.db
+
+	fields := map[string]int{}
+
+	for pos, name := range names {
+		if _, ok := fields[name]; ok || name == "" {
+			return BAD_VALUES
+		}
+
+		fields[name] = pos
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		if m := b.Bucket(metaName); m != nil {
+			prefix := []byte(fieldMeta)
+
+			var keys [][]byte
+
+			c := m.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+
+			for _, k := range keys {
+				if err := m.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+
+		for name, pos := range fields {
+			if err := putMeta(b, fieldMeta+name, uint64(pos)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		t.fields = fields
+	}
+
+	return err
+}
+
+//
+// load the field names from the table metadata
+//
+func (t *Table) loadFields(b *bolt.Bucket) {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return
+	}
+
+	prefix := []byte(fieldMeta)
+
+	c := m.Cursor()
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if pos, ok := getMeta(b, string(k)).(uint64); ok {
+			if t.fields == nil {
+				t.fields = map[string]int{}
+			}
+
+			t.fields[string(k[len(prefix):])] = int(pos)
+		}
+	}
+}
+
+//
+// Create an index (as CreateIndex) given the names of the key fields (see SetFields) instead of their positions.
+//
+// Returns NO_SCHEMA if the field names were not set and BAD_VALUES if a name is unknown
+//
+func (t *Table) CreateNamedIndex(index string, nilFirst bool, fieldNames ...string) (err error) {
+	defer t.wrapError("CreateNamedIndex", index, &err)
+
+	if t.fields == nil {
+		return NO_SCHEMA
+	}
+
+	fields := make([]uint64, len(fieldNames))
+
+	for i, name := range fieldNames {
+		pos, ok := t.fields[name]
+		if !ok {
+			return BAD_VALUES
+		}
+
+		fields[i] = uint64(pos)
+	}
+
+	return t.createIndex(index, indexinfo{nilFirst: nilFirst}, fields)
+}
@@ -0,0 +1,210 @@
+package boltql
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// A HistEntry is a range of values of the leading key field of an index, with the (estimated) number of records in range
+//
+type HistEntry struct {
+	Low   interface{} // lowest value in range (inclusive)
+	High  interface{} // highest value in range (inclusive)
+	Count int         // estimated number of records
+}
+
+// minimum number of keys decoded by Histogram (the sample is between histSample and 2*histSample keys)
+const histSample = 10000
+
+//
+// Return the approximate distribution of the values of the leading key field of an index, in (up to) buckets ranges
+// (i.e. to find if a prefix scan will return many records).
+//
+// For numeric values the ranges have the same width, between the lowest and the highest value
+// (Low and High are float64), so the counts show how the values are distributed. For the other types
+// (i.e. strings) the ranges have the same number of records, so the width of the ranges shows the distribution.
+//
+// All the keys of the index are visited, in a single pass (so the cost is proportional to the size of the index),
+// but for indices with more than 20000 keys only a sample of the keys (evenly spaced in key order) is decoded
+// and the counts are scaled to the number of keys, so the result is an approximation. The first and the last keys
+// are always decoded, so the Low of the first range and the High of the last range are the real bounds.
+//
+// Returns BAD_VALUES for hash indices, since their keys are not ordered by value.
+//
+func (t *Table) Histogram(index string, buckets int) (hist []HistEntry, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Histogram", index, &err)
+
+	if buckets <= 0 {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	var values []interface{}
+
+	step, total := 1, 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+		if info.hash {
+			return BAD_VALUES
+		}
+
+		c := b.Cursor()
+
+		sampled := false
+
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if total++; (total-1)%step != 0 {
+				sampled = false
+				continue
+			}
+
+			sampled = true
+
+			key, err := info.decodeKey(k)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, key[0])
+
+			if len(values) == 2*histSample {
+				// keep every other value and sample half of the following keys
+				for j := 0; j < histSample; j++ {
+					values[j] = values[2*j]
+				}
+
+				values = values[:histSample]
+				step *= 2
+				sampled = false
+			}
+		}
+
+		if total > 0 && !sampled {
+			// always include the last key, so that the ranges cover all the values
+			k, _ := c.Last()
+
+			key, err := info.decodeKey(k)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, key[0])
+		}
+
+		return nil
+	})
+
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	if t.indices[index].isDesc(0) {
+		// back in ascending order
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+
+	if numeric, ok := toFloats(values); ok {
+		return numericHistogram(numeric, buckets, total), nil
+	}
+
+	// the values are sorted (in key order): split them in buckets of the same size
+
+	if buckets > len(values) {
+		buckets = len(values)
+	}
+
+	for i := 0; i < buckets; i++ {
+		lo, hi := i*len(values)/buckets, (i+1)*len(values)/buckets
+		hist = append(hist, HistEntry{Low: values[lo], High: values[hi-1], Count: scale(hi, len(values), total) - scale(lo, len(values), total)})
+	}
+
+	return hist, nil
+}
+
+//
+// convert the values to float64 (returns false if any of them is not a number)
+//
+func toFloats(values []interface{}) ([]float64, bool) {
+	floats := make([]float64, len(values))
+
+	for i, v := range values {
+		switch n := v.(type) {
+		case int64:
+			floats[i] = float64(n)
+		case uint64:
+			floats[i] = float64(n)
+		case float64:
+			floats[i] = n
+		default:
+			return nil, false
+		}
+	}
+
+	return floats, true
+}
+
+//
+// scale the number of sampled values to the total number of keys
+//
+func scale(n, sampled, total int) int {
+	return n * total / sampled
+}
+
+//
+// split the (sorted) values in ranges of the same width, with the counts scaled to the total number of keys
+//
+func numericHistogram(values []float64, buckets, total int) []HistEntry {
+	lo, hi := values[0], values[len(values)-1]
+
+	if lo == hi {
+		buckets = 1
+	}
+
+	width := (hi - lo) / float64(buckets)
+
+	hist := make([]HistEntry, buckets)
+
+	for i := range hist {
+		hist[i].Low = lo + float64(i)*width
+		hist[i].High = lo + float64(i+1)*width
+	}
+
+	hist[buckets-1].High = hi
+
+	for _, v := range values {
+		i := buckets - 1
+		if width > 0 {
+			if i = int((v - lo) / width); i >= buckets {
+				i = buckets - 1
+			}
+		}
+
+		hist[i].Count++
+	}
+
+	// scale the cumulative counts, so that the sum of the counts is the number of keys
+	n := 0
+
+	for i := range hist {
+		lo := scale(n, len(values), total)
+		n += hist[i].Count
+		hist[i].Count = scale(n, len(values), total) - lo
+	}
+
+	return hist
+}
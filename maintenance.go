@@ -0,0 +1,493 @@
+package boltql
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/gobs/typedbuffer"
+)
+
+// the suffix of the index bucket names (see indices and tableIndices)
+var indexSuffix = []byte("_idx")
+
+//
+// Remove the orphaned index buckets: top level buckets named as index buckets that are not referenced
+// by any table schema (i.e. left by an interrupted operation).
+//
+// This is conservative, so that the buckets created through Bolt() are never removed. A bucket is only
+// considered orphaned if it's named "<table>.<index>_idx" (as the index buckets of a copied or renamed table)
+// and the table exists, or if it's named "<table>_<name>_idx", the table exists and all its keys
+// decode as index keys. Buckets that contain nested buckets (so they could be tables) are never removed.
+//
+// Returns the names of the removed buckets
+//
+func (d *DataStore) Vacuum() (removed []string, err error) {
+	db := d.db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		referenced := map[string]bool{}
+		tables := map[string]bool{}
+
+		var candidates []string
+
+		if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.HasSuffix(name, indexSuffix) {
+				if !hasNestedBuckets(b) {
+					candidates = append(candidates, string(name))
+				}
+
+				return nil
+			}
+
+			if bytes.Equal(name, storeName) {
+				return nil
+			}
+
+			buckets := schemaIndexBuckets(b)
+			for _, bucket := range buckets {
+				referenced[string(bucket)] = true
+			}
+
+			if len(buckets) > 0 || b.Bucket(metaName) != nil {
+				tables[string(name)] = true
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, name := range candidates {
+			if referenced[name] || !orphanedIndex(tx.Bucket([]byte(name)), name, tables) {
+				continue
+			}
+
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+
+			removed = append(removed, name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(removed)
+	return removed, nil
+}
+
+//
+// Call fn for every record of every table in the store, in a single read transaction, with the table name
+// and the raw key and value of the record.
+//
+// The records are read from the primary storage or, for tables without primary storage, from the first index
+// (by name) that contains the full records, so each record is visited once. Index buckets and buckets
+// that are not tables are skipped.
+//
+// For tables with primary storage k is the encoded primary key, otherwise it's the encoded index key.
+// In both cases v is the value as stored: the encoded record (without the key fields, for an index),
+// wrapped in an envelope if the table has a schema version, compression or encryption,
+// so it can't be decoded without the table definition.
+//
+func (d *DataStore) Walk(fn func(table string, k, v []byte) error) error {
+	db := d.db
+
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.HasSuffix(name, indexSuffix) || bytes.Equal(name, storeName) {
+				return nil
+			}
+
+			source := recordBucket(tx, b)
+			if source == nil {
+				return nil
+			}
+
+			table := string(name)
+
+			return source.ForEach(func(k, v []byte) error {
+				return fn(table, k, v)
+			})
+		})
+	})
+}
+
+//
+// Return the names of all the top-level buckets in the store, sorted: the table (schema) buckets,
+// the index buckets and the internal buckets (i.e. the store metadata), without any filtering.
+//
+// This is meant for inspection and debugging (i.e. to find stray buckets), use TableExists and GetTable
+// to access the tables
+//
+func (d *DataStore) Buckets() ([]string, error) {
+	db := d.db
+
+	var names []string
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+//
+// Remove the stale index entries of the tables with primary storage: the entries that don't match the primary record
+// with the same primary key, because the record was deleted or updated (i.e. left by older versions, where Delete
+// and Put could fail to find the old entries because they encoded the keys differently).
+//
+// Each entry is checked against the primary record: the entry is removed if the record doesn't exist,
+// or if its key for the index (computed from the primary record) is different.
+//
+// Tables without primary storage have no reference copy of the records, so their indices are checked against each other:
+// an entry is removed if the key of its record is missing from any of the other indices (a table with a single index
+// can't be checked).
+//
+// This is a one-time repair operation, that reads all the index entries in a single transaction.
+// Partial indices are not checked (and are not used as a reference), since their predicates are not available.
+//
+// Returns the number of removed entries
+//
+func (d *DataStore) RepairDeleteArtifacts() (repaired int, err error) {
+	db := d.db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		var names []string
+
+		if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !bytes.HasSuffix(name, indexSuffix) && !bytes.Equal(name, storeName) && len(schemaIndexBuckets(b)) > 0 {
+				names = append(names, string(name))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			t, err := d.loadTable(tx, name)
+			if err != nil {
+				return err
+			}
+
+			n, err := t.repairIndices(tx)
+			if err != nil {
+				return err
+			}
+
+			repaired += n
+		}
+
+		if repaired > 0 {
+			d.invalidate(tx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return repaired, nil
+}
+
+//
+// remove the index entries that don't match the records in the primary storage (see RepairDeleteArtifacts)
+//
+func (t *Table) repairIndices(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket(schema(t.name))
+
+	primary, err := primaryIndex(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if primary == nil {
+		return t.repairCrossIndices(tx)
+	}
+
+	data := b.Bucket(dataName)
+
+	repaired := 0
+
+	for index, info := range t.indices {
+		if info.partial {
+			continue
+		}
+
+		ib := tx.Bucket(info.bucket)
+		if ib == nil {
+			continue
+		}
+
+		var stale [][]byte
+
+		if err := ib.ForEach(func(k, v []byte) error {
+			fields, err := t.decode(info, k, v)
+			if err != nil {
+				return err
+			}
+
+			id, err := primary.primaryID(fields)
+			if err != nil {
+				// not a valid record: leave it alone
+				return nil
+			}
+
+			if ok, err := t.matchesPrimary(data, *primary, info, id, k); ok || err != nil {
+				return err
+			}
+
+			if err := t.countFields(tx, index, info, fields, -1); err != nil {
+				return err
+			}
+
+			stale = append(stale, k)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+
+		for _, k := range stale {
+			if err := ib.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+
+		repaired += len(stale)
+	}
+
+	return repaired, nil
+}
+
+//
+// remove the index entries of a table without primary storage whose record is missing from the other indices
+// (see RepairDeleteArtifacts). The stale entries of all the indices are found before removing any of them
+//
+func (t *Table) repairCrossIndices(tx *bolt.Tx) (int, error) {
+	full := map[string]*bolt.Bucket{}
+
+	for index, info := range t.indices {
+		if info.partial || !info.complete() {
+			continue
+		}
+
+		if ib := tx.Bucket(info.bucket); ib != nil {
+			full[index] = ib
+		}
+	}
+
+	if len(full) < 2 {
+		return 0, nil
+	}
+
+	stale := map[string][][]byte{}
+
+	for index, ib := range full {
+		info := t.indices[index]
+
+		if err := ib.ForEach(func(k, v []byte) error {
+			fields, err := t.decode(info, k, v)
+			if err != nil {
+				return err
+			}
+
+			for other, ob := range full {
+				if other == index {
+					continue
+				}
+
+				ik, _, err := t.indices[other].marshalKeyValue(fields)
+				if err != nil {
+					// not a valid record for the other index: leave it alone
+					return nil
+				}
+
+				if ik != nil && ob.Get(ik) == nil {
+					if err := t.countFields(tx, index, info, fields, -1); err != nil {
+						return err
+					}
+
+					stale[index] = append(stale[index], k)
+					return nil
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	repaired := 0
+
+	for index, keys := range stale {
+		for _, k := range keys {
+			if err := full[index].Delete(k); err != nil {
+				return 0, err
+			}
+		}
+
+		repaired += len(keys)
+	}
+
+	return repaired, nil
+}
+
+//
+// return true if the primary record with the specified id exists and has the key k in the index
+//
+func (t *Table) matchesPrimary(data *bolt.Bucket, primary, info indexinfo, id uint64, k []byte) (bool, error) {
+	if data == nil {
+		return false, nil
+	}
+
+	pk := primaryKey(id)
+
+	v := data.Get(pk)
+	if v == nil {
+		return false, nil
+	}
+
+	fields, err := t.decode(primary, pk, v)
+	if err != nil {
+		return false, err
+	}
+
+	ik, _, err := info.marshalKeyValue(fields)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(ik, k), nil
+}
+
+//
+// return the bucket that contains the full records of a table (the primary storage, or the first index by name)
+// or nil if the bucket is not a table (or the table has no records)
+//
+func recordBucket(tx *bolt.Tx, b *bolt.Bucket) *bolt.Bucket {
+	// as in repairIndices, the primary storage contains all the records once it's enabled (see enablePrimary)
+	if primary, _ := primaryIndex(b); primary != nil {
+		return b.Bucket(dataName)
+	}
+
+	// bolt iterates the keys in order, so the first index is the first by name
+	for _, info := range schemaIndices(b) {
+		if info.complete() {
+			return tx.Bucket(info.bucket)
+		}
+	}
+
+	return nil
+}
+
+//
+// return true if the bucket contains nested buckets
+//
+func hasNestedBuckets(b *bolt.Bucket) bool {
+	c := b.Cursor()
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// return true if an unreferenced bucket named as an index bucket clearly belongs to one of the tables (see Vacuum)
+//
+func orphanedIndex(b *bolt.Bucket, name string, tables map[string]bool) bool {
+	index := strings.TrimSuffix(name, string(indexSuffix))
+
+	if dot := strings.LastIndex(index, "."); dot >= 0 {
+		return tables[index[:dot]]
+	}
+
+	known := false
+
+	for table := range tables {
+		if strings.HasPrefix(index, table+"_") {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		return false
+	}
+
+	// the keys of an index bucket are encoded fields, as created by marshalKeyValue
+	entries := 0
+
+	if err := b.ForEach(func(k, v []byte) error {
+		if _, err := typedbuffer.DecodeAll(true, k); err != nil {
+			return err
+		}
+
+		entries++
+		return nil
+	}); err != nil {
+		return false
+	}
+
+	return entries > 0
+}
+
+//
+// return the names of the index buckets referenced by a bucket, if it's a table schema
+// (the entries that can't be decoded as index definitions are ignored, so this is safe
+// to call on any bucket)
+//
+func schemaIndexBuckets(b *bolt.Bucket) (buckets [][]byte) {
+	for _, info := range schemaIndices(b) {
+		buckets = append(buckets, info.bucket)
+	}
+
+	return
+}
+
+//
+// return the definitions of the indices of a schema bucket (in name order), with their options
+//
+func schemaIndices(b *bolt.Bucket) (infos []indexinfo) {
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		nilFirst, rest, err := typedbuffer.Decode(v)
+		if _, ok := nilFirst.(bool); err != nil || !ok {
+			return nil
+		}
+
+		if _, err := typedbuffer.DecodeUintArray(rest); err != nil {
+			return nil
+		}
+
+		var info indexinfo
+
+		info.loadOptions(b, string(k))
+		infos = append(infos, info)
+		return nil
+	})
+
+	return
+}
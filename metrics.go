@@ -0,0 +1,59 @@
+package boltql
+
+import (
+	"time"
+)
+
+//
+// Metrics is the interface used to collect operation metrics (i.e. to export them to Prometheus).
+//
+// Each method is called at the end of an operation with its duration and the returned error (nil on success):
+//
+// ObservePut for the writes: Put, PutWith, BatchPut, BulkLoad, GetOrPut, Upsert, IncrField and PutRaw,
+// and CopyTable, RenameTable (and Table.Rename) and RenameIndex.
+//
+// ObserveGet for the single record reads: Get, GetKey, GetKeys, GetBy, GetViaIndex, GetNearest, First, Last,
+// MinKey, MaxKey, GetRaw and GetSnapshot.
+//
+// ObserveScan for the scans: Scan, ScanProgress, ScanFields, ScanFieldsReuse, ScanKeys, Keys, ScanFromToken, Range,
+// ScanPrefixes, ScanGrouped, Take, GetAll, GetPrefix, Query, MergeScan, ModifiedSince, Checksum, Histogram, Size,
+// ForEach, ForEachFrom and ForEachChunked.
+//
+// ObserveDelete for Delete, DeleteKey and DeletePrefix
+//
+type Metrics interface {
+	ObservePut(dur time.Duration, err error)
+	ObserveGet(dur time.Duration, err error)
+	ObserveScan(dur time.Duration, err error)
+	ObserveDelete(dur time.Duration, err error)
+}
+
+//
+// Set the metrics collector (nil to disable metrics collection, the default).
+//
+// The collector can be changed while the DataStore is used: the running operations report
+// to the collector set when they started.
+//
+func (d *DataStore) SetMetrics(m Metrics) {
+	d.metricsLock.Lock()
+	defer d.metricsLock.Unlock()
+
+	d.metrics = m
+}
+
+//
+// return the metrics collector (nil if not set)
+//
+func (d *DataStore) loadMetrics() Metrics {
+	d.metricsLock.RLock()
+	defer d.metricsLock.RUnlock()
+
+	return d.metrics
+}
+
+//
+// report the duration of an operation started at start, and its result (called via defer)
+//
+func observe(f func(time.Duration, error), start time.Time, err *error) {
+	f(time.Since(start), *err)
+}
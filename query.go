@@ -0,0 +1,306 @@
+package boltql
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// A Query describes a scan of an index, with optional key bounds, a filter on the records and a limit.
+//
+// All the fields except Index are optional: the zero value of a field doesn't restrict the query
+// (i.e. Query{Index: "name"} returns all the records in the index, in ascending order).
+//
+// Prefix, Start and End are records where only the leading key fields are set (as for GetBy):
+//
+// Prefix selects the records with a key starting with the specified fields,
+// Start selects the records with a key greater or equal to the specified fields (inclusive),
+// End selects the records with a key lower than the specified fields (exclusive).
+//
+// The bounds are always in index order, also for descending queries.
+//
+// Filter is called on each record in range and the records for which it returns false are skipped.
+// Offset is the number of matching records to skip and Limit the maximum number of records to return (0 for no limit).
+//
+type Query struct {
+	Index      string
+	Prefix     DataRecord
+	Start      DataRecord
+	End        DataRecord
+	Descending bool
+	Filter     func(DataRecord) bool
+	Offset     int
+	Limit      int
+}
+
+//
+// Run a query (see Query), calling the user function for each matching record until it returns false.
+//
+// The record passed to the user function is res, filled with the record fields.
+//
+func (t *Table) Query(q Query, res DataRecord, callback func(DataRecord) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Query", q.Index, &err)
+
+	if isNil(res) || q.Offset < 0 || q.Limit < 0 {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, q.Index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[q.Index]
+
+		var prefix, lower, upper []byte
+
+		for _, bound := range []struct {
+			rec DataRecord
+			key *[]byte
+		}{
+			{q.Prefix, &prefix},
+			{q.Start, &lower},
+			{q.End, &upper},
+		} {
+			if isNil(bound.rec) {
+				continue
+			}
+
+			k, err := info.marshalPrefix(bound.rec.ToFieldList())
+			if err != nil {
+				return err
+			}
+
+			*bound.key = k
+		}
+
+		// restrict the bounds to the prefix range, so that the records in range are contiguous
+		if prefix != nil {
+			if lower == nil || bytes.Compare(prefix, lower) > 0 {
+				lower = prefix
+			}
+
+			if end := prefixEnd(prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+				upper = end
+			}
+		}
+
+		inRange := func(k []byte) bool {
+			return k != nil &&
+				(prefix == nil || bytes.HasPrefix(k, prefix)) &&
+				(lower == nil || bytes.Compare(k, lower) >= 0) &&
+				(upper == nil || bytes.Compare(k, upper) < 0)
+		}
+
+		c := b.Cursor()
+
+		var k, v []byte
+		var next func() ([]byte, []byte)
+
+		if q.Descending {
+			if upper == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(upper); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+
+			next = c.Prev
+		} else {
+			if lower == nil {
+				k, v = c.First()
+			} else {
+				k, v = c.Seek(lower)
+			}
+
+			next = c.Next
+		}
+
+		skip := q.Offset
+
+		for ; inRange(k); k, v = next() {
+			fields, err := t.decodeRecord(tx, info, k, v)
+			if err != nil {
+				return err
+			}
+
+			res.FromFieldList(fields)
+
+			if q.Filter != nil && !q.Filter(res) {
+				continue
+			}
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			n++
+
+			if !callback(res) || (q.Limit > 0 && n >= q.Limit) {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// Scan two indices at the same time (in ascending key order, in a single read transaction) and call the user
+// function with the records of both, merged in the order defined by less, until it returns false
+// (i.e. the union of two partial indices, sorted by a field that is not in their keys).
+//
+// Each index should be sorted consistently with less, or the result is not sorted.
+// When less doesn't order two records, the one from indexA comes first.
+//
+// For tables with primary storage the records in both indices are only returned once (the first time they are found),
+// using the primary key to recognize them: the keys of the returned records are kept in memory until the end of the scan.
+// For the other tables there is no way to tell two copies of a record from two equal records, so the records
+// in both indices are returned twice.
+//
+// Each record is allocated by calling newRecord, so the user function can retain it
+//
+func (t *Table) MergeScan(indexA, indexB string, less func(a, b DataRecord) bool, newRecord func() DataRecord, callback func(DataRecord) bool) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("MergeScan", indexA, &err)
+
+	if less == nil || newRecord == nil {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		type side struct {
+			info indexinfo
+			c    *bolt.Cursor
+			rec  DataRecord // the current record (nil at the end of the index)
+			id   uint64     // the primary key of the current record
+			pk   bool       // the current record has a primary key
+		}
+
+		sb := tx.Bucket(schema(t.name))
+		if sb == nil {
+			return NO_TABLE
+		}
+
+		primary, err := primaryIndex(sb)
+		if err != nil {
+			return err
+		}
+
+		// the primary keys of the returned records (nil if the table has no primary storage)
+		var seen map[uint64]bool
+		if primary != nil {
+			seen = map[uint64]bool{}
+		}
+
+		// move the cursor of s (with First or Next) and decode the record (if any) as the current record
+		load := func(s *side, move func() ([]byte, []byte)) error {
+			k, v := move()
+			if k == nil {
+				s.rec = nil
+				return nil
+			}
+
+			fields, err := t.decodeRecord(tx, s.info, k, v)
+			if err != nil {
+				return err
+			}
+
+			if primary != nil {
+				id, err := primary.primaryID(fields)
+				s.id, s.pk = id, err == nil
+			}
+
+			s.rec = newRecord()
+			s.rec.FromFieldList(fields)
+			return nil
+		}
+
+		var sides [2]side
+
+		for i, index := range []string{indexA, indexB} {
+			b := t.indexBucket(tx, index)
+			if b == nil {
+				return NO_INDEX
+			}
+
+			sides[i] = side{info: t.indices[index], c: b.Cursor()}
+
+			if err := load(&sides[i], sides[i].c.First); err != nil {
+				return err
+			}
+		}
+
+		a, b := &sides[0], &sides[1]
+
+		for a.rec != nil || b.rec != nil {
+			s := a
+			if a.rec == nil || (b.rec != nil && less(b.rec, a.rec)) {
+				s = b
+			}
+
+			if seen == nil || !s.pk || !seen[s.id] {
+				if s.pk && seen != nil {
+					seen[s.id] = true
+				}
+
+				n++
+
+				if !callback(s.rec) {
+					break
+				}
+			}
+
+			if err := load(s, s.c.Next); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	endSpan(span, n, err)
+	return err
+}
+
+//
+// return the smallest key greater than all the keys starting with prefix
+// (nil if there is none, when the prefix is all 0xFF)
+//
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
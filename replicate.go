@@ -0,0 +1,243 @@
+package boltql
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// Return a checksum of the content of an index (the hex encoded SHA-256 of all its entries), to cheaply check
+// that two tables (i.e. a table and its replica) contain the same records.
+//
+// The entries are read in ascending key order, that is the canonical order: each key and value (decompressed
+// and decrypted, so that the table options don't change the result) is added to the hash, prefixed by its length,
+// followed by the values of the external fields of the record (see SetExternalField).
+// Indices with the same definition and the same records have the same checksum
+//
+func (t *Table) Checksum(index string) (sum string, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("Checksum", index, &err)
+
+	h := sha256.New()
+
+	var size [binary.MaxVarintLen64]byte
+
+	write := func(b []byte) {
+		n := binary.PutUvarint(size[:], uint64(len(b)))
+		h.Write(size[:n])
+		h.Write(b)
+	}
+
+	// the values of the external fields are added after the entry of their record, by position
+	var blobs []int
+
+	for pos := range t.blobs {
+		blobs = append(blobs, pos)
+	}
+
+	sort.Ints(blobs)
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+	n := 0
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := t.indexBucket(tx, index)
+		if b == nil {
+			return NO_INDEX
+		}
+
+		info := t.indices[index]
+
+		return b.ForEach(func(k, v []byte) error {
+			ov, _, err := t.openValue(v)
+			if err != nil {
+				return err
+			}
+
+			write(k)
+			write(ov)
+			n++
+
+			if len(blobs) == 0 {
+				return nil
+			}
+
+			fields, err := t.decodeRecord(tx, info, k, v)
+			if err != nil {
+				return err
+			}
+
+			for _, pos := range blobs {
+				if pos < len(fields) {
+					if blob, ok := fields[pos].([]byte); ok {
+						write(blob)
+					}
+				}
+			}
+
+			return nil
+		})
+	})
+
+	endSpan(span, n, err)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//
+// Copy all the records of the table, read from the specified index, to a table (dstTable) in another DataStore
+// (i.e. for a simple one-way sync between databases).
+//
+// If the destination table doesn't exist it's created with the same options and indices of the table,
+// and indices missing from an existing destination table are created and filled with its records.
+// On every run the sequence of the destination table is raised to the source one (if lower),
+// so that new AUTOINCREMENT values don't conflict. The records are written as by Put, so records
+// with the same keys are replaced (but the last-modified field, if any, keeps the value of the source record).
+//
+// The index buckets of the destination table are named after the table (as for CopyTable).
+// Returns BAD_VALUES if dst is the DataStore of the table (use CopyTable instead)
+// or if index is a covering index (that doesn't contain the full records)
+//
+func (t *Table) ReplicateTo(dst *DataStore, dstTable string, index string) (err error) {
+	defer t.wrapError("ReplicateTo", index, &err)
+
+	if dst == nil || dst.store == t.d.store {
+		return BAD_VALUES
+	}
+
+	info, ok := t.indices[index]
+	if !ok {
+		return NO_INDEX
+	}
+
+	if !info.complete() {
+		return BAD_VALUES
+	}
+
+	db := t.d.db
+
+	return db.View(func(stx *bolt.Tx) error {
+		sb := stx.Bucket(schema(t.name))
+		if sb == nil {
+			return NO_TABLE
+		}
+
+		ib := t.indexBucket(stx, index)
+		if ib == nil {
+			return NO_INDEX
+		}
+
+		return dst.db.Update(func(dtx *bolt.Tx) error {
+			dt, err := dst.mirrorTable(dtx, t, sb, dstTable)
+			if err != nil {
+				return err
+			}
+
+			return ib.ForEach(func(k, v []byte) error {
+				fields, err := t.decodeRecord(stx, info, k, v)
+				if err != nil {
+					return err
+				}
+
+				rec := fieldList(fields)
+
+				_, err = dt.replay(dtx, &rec)
+				return err
+			})
+		})
+	})
+}
+
+//
+// return the table (called name) with the same definition of src (read from its schema bucket sb),
+// creating the table and the missing indices
+//
+func (d *DataStore) mirrorTable(tx *bolt.Tx, src *Table, sb *bolt.Bucket, name string) (*Table, error) {
+	b := tx.Bucket(schema(name))
+
+	if b == nil {
+		var err error
+
+		if b, err = createSchema(tx, name); err != nil {
+			return nil, err
+		}
+
+		if m := sb.Bucket(metaName); m != nil {
+			dm, err := b.CreateBucket(metaName)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := m.ForEach(dm.Put); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the records are copied with their primary keys, so the sequence is kept at least as high as the source one
+	if err := raiseSequence(b, sb.Sequence()); err != nil {
+		return nil, err
+	}
+
+	dt, err := d.loadTable(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, info := range src.indices {
+		if dinfo, ok := dt.indices[index]; ok {
+			if dinfo.partial && dinfo.pred == nil {
+				dinfo.pred = info.pred
+				dt.indices[index] = dinfo
+			}
+
+			continue
+		}
+
+		if err := b.Put([]byte(index), sb.Get([]byte(index))); err != nil {
+			return nil, err
+		}
+
+		info.bucket = tableIndices(name, index)
+
+		if _, err := tx.CreateBucket(info.bucket); err != nil {
+			return nil, err
+		}
+
+		if err := info.saveOptions(b, index); err != nil {
+			return nil, err
+		}
+
+		// the group counts (if copied with the metadata) are recomputed with the new entries
+		if err := clearCounts(b, index); err != nil {
+			return nil, err
+		}
+
+		// add the records already in the table to the new index
+		rt := &Table{name: name, indices: map[string]indexinfo{index: info}, version: dt.version, compression: dt.compression, d: d}
+
+		if err := dt.forEachRecord(tx, "", func(fields []interface{}) error {
+			return rt.putEntries(tx, fields)
+		}); err != nil {
+			return nil, err
+		}
+
+		dt.indices[index] = info
+	}
+
+	return dt, nil
+}
@@ -0,0 +1,80 @@
+package boltql
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// A Snapshot is a read transaction shared by many reads (see GetSnapshot), so that they see the same
+// consistent version of the database and don't pay the cost of starting a transaction each.
+//
+// The snapshot keeps the transaction open until Close is called: while it's open bolt can't reuse the pages
+// freed by the following writes (so the file grows) or remap the file when it needs to grow (so writes that
+// grow the file block until the snapshot is closed). Snapshots should be closed as soon as possible
+// and should not be used concurrently.
+//
+type Snapshot struct {
+	tx *bolt.Tx
+	d  *DataStore
+}
+
+//
+// Open a snapshot of the database (see Snapshot). The snapshot must be closed with Close
+//
+func (d *DataStore) Snapshot() (*Snapshot, error) {
+	db := d.db
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{tx: tx, d: d}, nil
+}
+
+//
+// Close the snapshot, releasing the read transaction.
+//
+// It's safe to call Close multiple times
+//
+func (s *Snapshot) Close() error {
+	if s.tx == nil {
+		return nil
+	}
+
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+//
+// Get a record from the table (as Get) in a snapshot, so that all the reads in the snapshot
+// see the same version of the records. The changes made after the snapshot was opened are not visible.
+//
+// Returns BAD_VALUES if the snapshot is closed or of another DataStore
+//
+func (t *Table) GetSnapshot(index string, key, res DataRecord, snap *Snapshot) (err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveGet, time.Now(), &err)
+	}
+
+	defer t.wrapError("GetSnapshot", index, &err)
+
+	if isNil(key) || isNil(res) || snap == nil || snap.tx == nil || snap.d.store != t.d.store {
+		return BAD_VALUES
+	}
+
+	span := t.startSpan("Get")
+
+	err = t.get(snap.tx, index, key, res)
+
+	n := 0
+	if err == nil {
+		n = 1
+	}
+
+	endSpan(span, n, err)
+	return err
+}
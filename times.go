@@ -0,0 +1,268 @@
+package boltql
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// Return the value used to store a time.Time field: the number of nanoseconds since the Unix epoch,
+// that sorts in chronological order (for times between the years 1678 and 2262).
+//
+// time.Time fields are converted automatically by Put (and in the keys passed to Get, Scan, etc.),
+// so this is only needed to compare with the raw stored values.
+//
+func TimeKey(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+//
+// time.Time fields are stored as int64 (see TimeKey) and the positions of the time fields of a table
+// are stored in the table metadata (as "_time/<position>") so they can be converted back when decoding a record
+//
+const timeMeta = "_time/"
+
+func timeField(pos int) string {
+	return fmt.Sprintf("%v%v", timeMeta, pos)
+}
+
+//
+// return the set of time fields of the table (nil if there are none)
+//
+func (t *Table) timeFields() map[int]bool {
+	m, _ := t.times.Load().(map[int]bool)
+	return m
+}
+
+//
+// load the positions of the time fields from the table metadata
+//
+func (t *Table) loadTimeFields(b *bolt.Bucket) {
+	m := b.Bucket(metaName)
+	if m == nil {
+		return
+	}
+
+	prefix := []byte(timeMeta)
+	times := map[int]bool{}
+
+	c := m.Cursor()
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if pos, err := strconv.Atoi(string(k[len(prefix):])); err == nil {
+			times[pos] = true
+		}
+	}
+
+	if len(times) > 0 {
+		t.times.Store(times)
+	}
+}
+
+//
+// convert the time.Time fields in the list to int64 (in place) and record their positions in the table metadata
+// (the list of time fields in the Table is only updated when the transaction is committed)
+//
+func (t *Table) storeTimeFields(b *bolt.Bucket, fields []interface{}) error {
+	known := t.timeFields()
+
+	var added []int
+
+	for i, f := range fields {
+		tf, ok := f.(time.Time)
+		if !ok {
+			continue
+		}
+
+		fields[i] = TimeKey(tf)
+
+		if known[i] {
+			continue
+		}
+
+		if err := putMeta(b, timeField(i), true); err != nil {
+			return err
+		}
+
+		added = append(added, i)
+	}
+
+	if len(added) > 0 {
+		b.Tx().OnCommit(func() {
+			// writable transactions are serialized, so there are no concurrent updates
+			times := map[int]bool{}
+
+			for pos := range t.timeFields() {
+				times[pos] = true
+			}
+
+			for _, pos := range added {
+				times[pos] = true
+			}
+
+			t.times.Store(times)
+		})
+	}
+
+	return nil
+}
+
+//
+// convert the stored time fields back to time.Time (in place)
+//
+func (t *Table) restoreTimeFields(fields []interface{}) {
+	for pos := range t.timeFields() {
+		if pos >= len(fields) {
+			continue
+		}
+
+		if n, ok := fields[pos].(int64); ok {
+			fields[pos] = time.Unix(0, n)
+		}
+	}
+}
+
+//
+// the position of the last-modified field of a table is stored in the table metadata (see SetUpdatedField)
+//
+const updatedMeta = "_updated"
+
+//
+// Set the last-modified field of the table: Put (and the other methods that add or replace records)
+// set the field to the current time, so that ModifiedSince can return the records changed after a given time.
+//
+// The field is only set if the record has it (i.e. it's not past the end of the list of fields).
+// Records copied from another table or database (by ApplyChanges, ReplicateTo, CopyTable and RenumberKeys)
+// keep their value, and ExplainPut doesn't set it.
+//
+func (t *Table) SetUpdatedField(field uint) (err error) {
+	defer t.wrapError("SetUpdatedField", "", &err)
+
+	db := t.d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		return putMeta(b, updatedMeta, uint64(field))
+	})
+}
+
+//
+// set the last-modified field of the record (if the table has one) to the current time (in place)
+//
+func stampUpdated(b *bolt.Bucket, fields []interface{}) {
+	if pos, ok := getMeta(b, updatedMeta).(uint64); ok && pos < uint64(len(fields)) {
+		fields[pos] = time.Now()
+	}
+}
+
+//
+// Return the records modified after since, according to the last-modified field (see SetUpdatedField).
+// Each record is allocated by calling newRecord.
+//
+// If an index has the last-modified field as its first key field the records are read from the index
+// (starting after since, in index order), otherwise all the records of the table are scanned.
+//
+// Returns BAD_VALUES if the table has no last-modified field
+//
+func (t *Table) ModifiedSince(since time.Time, newRecord func() DataRecord) (recs []DataRecord, err error) {
+	if m := t.d.loadMetrics(); m != nil {
+		defer observe(m.ObserveScan, time.Now(), &err)
+	}
+
+	defer t.wrapError("ModifiedSince", "", &err)
+
+	if newRecord == nil {
+		return nil, BAD_VALUES
+	}
+
+	db := t.d.db
+
+	span := t.startSpan("Scan")
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(schema(t.name))
+		if b == nil {
+			return NO_TABLE
+		}
+
+		pos, ok := getMeta(b, updatedMeta).(uint64)
+		if !ok {
+			return BAD_VALUES
+		}
+
+		add := func(fields []interface{}) error {
+			if pos < uint64(len(fields)) {
+				if ts, ok := fields[pos].(time.Time); ok && ts.After(since) {
+					if err := t.loadBlobs(tx, fields); err != nil {
+						return err
+					}
+
+					rec := newRecord()
+					rec.FromFieldList(fields)
+
+					recs = append(recs, rec)
+				}
+			}
+
+			return nil
+		}
+
+		for _, info := range t.indices {
+			if len(info.iplist) == 0 || info.hash || info.partial || info.isDesc(0) || info.keyFields()[0] != pos {
+				continue
+			}
+
+			ib := tx.Bucket(info.bucket)
+			if ib == nil {
+				return NO_INDEX
+			}
+
+			key := make([]interface{}, pos+1)
+			key[pos] = since
+
+			prefix, err := info.marshalPrefix(key)
+			if err != nil {
+				return err
+			}
+
+			c := ib.Cursor()
+
+			// skip the records modified at since
+			k, v := c.First()
+			if start := prefixEnd(prefix); start != nil {
+				k, v = c.Seek(start)
+			}
+
+			for ; k != nil; k, v = c.Next() {
+				fields, err := t.decode(info, k, v)
+				if err != nil {
+					return err
+				}
+
+				if err := add(fields); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		return t.forEachRecord(tx, "", add)
+	})
+
+	endSpan(span, len(recs), err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
@@ -0,0 +1,70 @@
+package boltql
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//
+// Set the OpenTelemetry tracer used to create a span for each Put, Get, Scan and Delete operation
+// (nil to disable tracing, the default). The other reads are traced as Get (i.e. GetNearest, First and Last)
+// or Scan (i.e. ScanFromToken, Size and ForEach).
+//
+// Spans are named after the operation and the table (i.e. "Put mytable") and record the number
+// of keys read or written and the returned error.
+//
+// Only the spans of PutContext, GetContext, ScanContext and DeleteContext join the caller's trace
+// (they are started from the input context, as children of the caller span): all the other methods
+// start their spans from context.Background(), so they are always the root of a new trace.
+//
+func (d *DataStore) WithTracer(tracer trace.Tracer) {
+	d.traceLock.Lock()
+	defer d.traceLock.Unlock()
+
+	d.tracer = tracer
+}
+
+//
+// start a span for the operation op on this table (returns nil if there is no tracer)
+//
+func (t *Table) startSpan(op string) trace.Span {
+	return t.startSpanContext(context.Background(), op)
+}
+
+//
+// start a span for the operation op on this table, from ctx (returns nil if there is no tracer)
+//
+func (t *Table) startSpanContext(ctx context.Context, op string) trace.Span {
+	t.d.traceLock.RLock()
+	tracer := t.d.tracer
+	t.d.traceLock.RUnlock()
+
+	if tracer == nil {
+		return nil
+	}
+
+	_, span := tracer.Start(ctx, op+" "+t.name,
+		trace.WithAttributes(attribute.String("boltql.table", t.name)))
+	return span
+}
+
+//
+// end a span started with startSpan, recording the number of keys and the error (if any)
+//
+func endSpan(span trace.Span, keys int, err error) {
+	if span == nil {
+		return
+	}
+
+	span.SetAttributes(attribute.Int("boltql.keys", keys))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,168 @@
+package boltql
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//
+// A Txn is a writable transaction, used to read and write records of multiple tables atomically (see DataStore.Update).
+//
+// A Txn is only valid inside the function passed to Update and should not be used concurrently
+//
+type Txn struct {
+	tx *bolt.Tx
+	d  *DataStore
+}
+
+//
+// Return the underlying bolt transaction
+//
+func (txn *Txn) Tx() *bolt.Tx {
+	return txn.tx
+}
+
+//
+// Add a record to the table (as Table.Put) in the transaction
+//
+func (txn *Txn) Put(t *Table, rec DataRecord) (uint64, error) {
+	if t.d.store != txn.d.store || isNil(rec) {
+		return 0, BAD_VALUES
+	}
+
+	return t.put(txn.tx, rec)
+}
+
+//
+// Get a record from the table (as Table.Get) in the transaction, including the changes made by the transaction
+//
+func (txn *Txn) Get(t *Table, index string, key, res DataRecord) error {
+	if t.d.store != txn.d.store || isNil(key) || isNil(res) {
+		return BAD_VALUES
+	}
+
+	return t.get(txn.tx, index, key, res)
+}
+
+//
+// Run the function in a writable transaction: the transaction is committed if the function returns nil
+// and rolled back if it returns an error (that is returned by Update)
+//
+func (d *DataStore) Update(fn func(*Txn) error) error {
+	db := d.db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return fn(&Txn{tx: tx, d: d})
+	})
+}
+
+//
+// A PutOp is a record to add to a table, with DataStore.PutRelated
+//
+type PutOp struct {
+	Table  string
+	Record DataRecord
+}
+
+//
+// Add records to multiple tables (i.e. an order and its order lines) in a single transaction:
+// either all the records are added or, if any of them fails, none is.
+//
+// The table definitions are loaded in the transaction (once per table), so partial indices can't be used
+// (their predicates are not stored) and return NO_PREDICATE.
+//
+// Returns the values of the first AUTOINCREMENT field of each record, in the order of the operations
+//
+func (d *DataStore) PutRelated(ops []PutOp) ([]uint64, error) {
+	db := d.db
+
+	for _, op := range ops {
+		if isNil(op.Record) {
+			return nil, BAD_VALUES
+		}
+	}
+
+	keys := make([]uint64, len(ops))
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		tables := map[string]*Table{}
+
+		for i, op := range ops {
+			t, ok := tables[op.Table]
+			if !ok {
+				var err error
+
+				if t, err = d.loadTable(tx, op.Table); err != nil {
+					return err
+				}
+
+				tables[op.Table] = t
+			}
+
+			key, err := t.put(tx, op.Record)
+			if err != nil {
+				return err
+			}
+
+			keys[i] = key
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+//
+// RETRY can be returned (or wrapped) by the function passed to UpdateWithRetry to retry the transaction
+//
+var RETRY = errors.New("retry transaction")
+
+//
+// the wait before the second attempt of UpdateWithRetry (doubled after every attempt)
+//
+const retryBackoff = 10 * time.Millisecond
+
+//
+// Run the function in a writable transaction, as Update, retrying up to attempts times (with exponential backoff,
+// starting from 10ms) if the transaction fails with a retryable error.
+//
+// The retryable errors are RETRY (returned by the function, i.e. for a conflict detected by the application)
+// and bolt.ErrTimeout. Any other error is returned immediately: since the transaction is rolled back, the function
+// is always run from a clean state but it should not have side effects outside of the transaction.
+//
+// Returns the error of the last attempt
+//
+func (d *DataStore) UpdateWithRetry(attempts int, fn func(*Txn) error) (err error) {
+	if attempts < 1 {
+		return BAD_VALUES
+	}
+
+	wait := retryBackoff
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		if err = d.Update(fn); !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+//
+// return true if the transaction can be retried after the error
+//
+func retryable(err error) bool {
+	return errors.Is(err, RETRY) || errors.Is(err, bolt.ErrTimeout)
+}